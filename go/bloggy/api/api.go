@@ -3,6 +3,7 @@ package api
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
@@ -10,6 +11,10 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 	"github.com/sebito91/bootdotdev/go/bloggy/internal/database"
+	"github.com/sebito91/bootdotdev/go/cors"
+	"github.com/sebito91/bootdotdev/go/httpcache"
+	"github.com/sebito91/bootdotdev/go/logging"
+	"github.com/sebito91/bootdotdev/go/tracing"
 )
 
 // apiConfig is a struct to hold references to our database, router, and other components
@@ -20,8 +25,9 @@ type apiConfig struct {
 	sleepInterval time.Duration
 }
 
-// GetAPI generates the new route for the aggregator and returns a handle to the router
-func GetAPI(concurrency int, sleepInterval time.Duration) (*apiConfig, error) {
+// GetAPI generates the new route for the aggregator and returns a handle to the router. The /v1 routes
+// answer cross-origin requests according to corsPolicy.
+func GetAPI(concurrency int, sleepInterval time.Duration, corsPolicy cors.Policy) (*apiConfig, error) {
 	apiCfg := &apiConfig{
 		concurrency:   concurrency,
 		sleepInterval: sleepInterval,
@@ -38,11 +44,20 @@ func GetAPI(concurrency int, sleepInterval time.Duration) (*apiConfig, error) {
 		return apiCfg, err
 	}
 
-	apiCfg.DB = database.New(db)
+	apiCfg.DB = database.New(tracing.WrapDB(db))
 
 	r := chi.NewRouter()
 
+	// every request gets an ID, a trace span and an access log line, written with the logger configured at startup
+	r.Use(logging.MiddlewareRequestID)
+	r.Use(tracing.Middleware)
+	r.Use(logging.MiddlewareAccessLog(slog.Default()))
+
 	r.Route("/v1", func(r chi.Router) {
+		r.Use(corsPolicy.Handler)
+		// JSON responses carry a weak ETag for conditional GETs and are compressed when the client allows it
+		r.Use(httpcache.Handler)
+
 		r.Get("/", mainPage)
 
 		r.Get("/readiness", readinessEndpoint)
@@ -71,6 +86,6 @@ func GetAPI(concurrency int, sleepInterval time.Duration) (*apiConfig, error) {
 func mainPage(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("we're A-OK!")); err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("failed to write: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("failed to write: %s", err))
 	}
 }
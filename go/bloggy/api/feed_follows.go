@@ -29,24 +29,24 @@ func (ac *apiConfig) createFeedFollow(w http.ResponseWriter, r *http.Request, us
 	newFeedFollowChk := newFeedFollowCheck{}
 
 	if err := decoder.Decode(&newFeedFollowChk); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("createFeedFollow: could not decode JSON payload: %s", err))
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("createFeedFollow: could not decode JSON payload: %s", err))
 		return
 	}
 
 	newFeedFollowUUID, err := uuid.Parse(newFeedFollowChk.FeedID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "createFeedFollow: received invalid value for `feed_id` field")
+		respondWithError(w, r, http.StatusBadRequest, "createFeedFollow: received invalid value for `feed_id` field")
 		return
 	}
 
 	if newFeedFollowUUID == uuid.Nil {
-		respondWithError(w, http.StatusBadRequest, "createFeedFollow: `feed_id` field cannot be empty")
+		respondWithError(w, r, http.StatusBadRequest, "createFeedFollow: `feed_id` field cannot be empty")
 		return
 	}
 
 	newUUID, err := uuid.NewRandom()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeedFollow: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeedFollow: %s", err))
 		return
 	}
 
@@ -61,7 +61,7 @@ func (ac *apiConfig) createFeedFollow(w http.ResponseWriter, r *http.Request, us
 
 	dbFeedFollow, err := ac.DB.CreateFeedFollow(r.Context(), newFeedFollow)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeedFollow: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeedFollow: %s", err))
 		return
 	}
 
@@ -80,7 +80,7 @@ func (ac *apiConfig) createFeedFollow(w http.ResponseWriter, r *http.Request, us
 func (ac *apiConfig) getFeedFollows(w http.ResponseWriter, r *http.Request, user database.User) {
 	dbFeedFollows, err := ac.DB.GetFeedFollowsByUser(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("getFeedFollows: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("getFeedFollows: %s", err))
 		return
 	}
 
@@ -31,29 +31,29 @@ func (ac *apiConfig) createFeed(w http.ResponseWriter, r *http.Request, user dat
 	newFeedChk := newFeedCheck{}
 
 	if err := decoder.Decode(&newFeedChk); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("createFeed: could not decode JSON payload: %s", err))
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("createFeed: could not decode JSON payload: %s", err))
 		return
 	}
 
 	if newFeedChk.Name == "" {
-		respondWithError(w, http.StatusBadRequest, "createFeed: did not receive value for `name` field")
+		respondWithError(w, r, http.StatusBadRequest, "createFeed: did not receive value for `name` field")
 		return
 	}
 
 	if newFeedChk.URL == "" {
-		respondWithError(w, http.StatusBadRequest, "createFeed: did not receive value for `url` field")
+		respondWithError(w, r, http.StatusBadRequest, "createFeed: did not receive value for `url` field")
 		return
 	}
 
 	newUUID, err := uuid.NewRandom()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
 		return
 	}
 
 	newFeedFollowUUID, err := uuid.NewRandom()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
 		return
 	}
 
@@ -77,13 +77,13 @@ func (ac *apiConfig) createFeed(w http.ResponseWriter, r *http.Request, user dat
 
 	dbFeed, err := ac.DB.CreateFeed(r.Context(), newFeed)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeed: %s", err))
 		return
 	}
 
 	dbFeedFollow, err := ac.DB.CreateFeedFollow(r.Context(), newFeedFollow)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createFeed: createFeedFollow: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createFeed: createFeedFollow: %s", err))
 		return
 	}
 
@@ -117,7 +117,7 @@ func (ac *apiConfig) createFeed(w http.ResponseWriter, r *http.Request, user dat
 func (ac *apiConfig) getFeeds(w http.ResponseWriter, r *http.Request) {
 	dbFeeds, err := ac.DB.GetFeeds(r.Context())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("getFeeds: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("getFeeds: %s", err))
 		return
 	}
 
@@ -3,9 +3,11 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+
+	"github.com/sebito91/bootdotdev/go/logging"
 )
 
 // fetchAPIToken is a helper function to extract the APIKey from a given request
@@ -18,8 +20,17 @@ func fetchAPIToken(r *http.Request) (string, error) {
 	return strings.TrimPrefix(bearer, "ApiKey "), nil
 }
 
-// respondWithError will write out an error message to the console
-func respondWithError(w http.ResponseWriter, code int, msg string) {
+// respondWithError will write out an error message to the console, and log it against the request ID,
+// route and user of the request
+func respondWithError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	level := slog.LevelWarn
+	if code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	slog.LogAttrs(r.Context(), level, "request failed",
+		append(logging.RequestAttrs(r), slog.Int("status", code), slog.String("error", msg))...)
+
 	respondWithJSON(w, code, struct {
 		Error string `json:"error"`
 	}{
@@ -31,14 +42,14 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	dat, datErr := json.Marshal(payload)
 	if datErr != nil {
-		log.Printf("Error marshaling JSON response: %s", datErr)
+		slog.Error("could not marshal JSON response", "error", datErr)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if _, wErr := w.Write(dat); wErr != nil {
-		log.Printf("Error writing JSON to page: %s", wErr)
+		slog.Error("could not write JSON to page", "error", wErr)
 		return
 	}
 }
@@ -53,5 +64,5 @@ func readinessEndpoint(w http.ResponseWriter, r *http.Request) {
 }
 
 func errorTester(w http.ResponseWriter, r *http.Request) {
-	respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	respondWithError(w, r, http.StatusInternalServerError, "Internal Server Error")
 }
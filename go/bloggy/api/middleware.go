@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/sebito91/bootdotdev/go/bloggy/internal/database"
+	"github.com/sebito91/bootdotdev/go/logging"
 )
 
 // authedHandler is a custom function handler type that only deals with
@@ -18,16 +19,17 @@ func (ac *apiConfig) middlewareAuth(handler authedHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		apiKey, err := fetchAPIToken(r)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("middlewareAuth: %s", err))
+			respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("middlewareAuth: %s", err))
 			return
 		}
 
 		user, err := ac.DB.GetUserByApiKey(r.Context(), apiKey)
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("middlewareAuth user fetch: %s", err))
+			respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("middlewareAuth user fetch: %s", err))
 			return
 		}
 
+		logging.SetUser(r.Context(), user.ID.String())
 		handler(w, r, user)
 	}
 }
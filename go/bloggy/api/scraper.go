@@ -4,19 +4,28 @@ import (
 	"context"
 	"encoding/xml"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/sebito91/bootdotdev/go/bloggy/internal/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// scraperTracer starts the spans for each round of scraping and each feed within it
+var scraperTracer = otel.Tracer("github.com/sebito91/bootdotdev/go/bloggy/api/scraper")
+
 // StartScraping is a goroutine that handles the article scraping from various sources
 // within the 'feeds' database table. This function will itself kick off up to `concurrency`
 // goroutines to fetch deduplicated sources from their locations.
 func (ac *apiConfig) StartScraping() {
-	log.Printf("starting to scrape records using %d goroutines set to poll every %s\n", ac.concurrency, ac.sleepInterval)
+	slog.Info("starting to scrape feeds", "concurrency", ac.concurrency, "interval", ac.sleepInterval)
 	ticker := time.NewTicker(ac.sleepInterval)
 
 	feedsArgs := database.GetNextFeedsToFetchParams{
@@ -26,75 +35,137 @@ func (ac *apiConfig) StartScraping() {
 	// kick off the ticker to start our collection
 	for ; ; <-ticker.C {
 		feedsArgs.LastFetchedAt = time.Now().Add(-ac.sleepInterval)
-		feeds, err := ac.DB.GetNextFeedsToFetch(context.Background(), feedsArgs)
-		if err != nil {
-			log.Printf("could not fetch feeds: %s\n", err)
-			continue
-		}
-
-		log.Printf("found %d feeds to fetch\n", len(feeds))
-
-		wg := &sync.WaitGroup{}
-		for _, feed := range feeds {
-			wg.Add(1)
-			go ac.fetchFeed(wg, feed)
-		}
-		wg.Wait()
+		ac.pollFeeds(feedsArgs)
+	}
+}
+
+// pollFeeds runs a single round of the scraper, fetching each of the feeds that are due concurrently.
+// Every round is traced as its own span with one child span per feed.
+func (ac *apiConfig) pollFeeds(feedsArgs database.GetNextFeedsToFetchParams) {
+	ctx, span := scraperTracer.Start(context.Background(), "scraper.pollFeeds")
+	defer span.End()
+
+	feeds, err := ac.DB.GetNextFeedsToFetch(ctx, feedsArgs)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.Error("could not fetch feeds", "error", err)
+		return
+	}
+
+	slog.Info("found feeds to fetch", "count", len(feeds))
+	span.SetAttributes(attribute.Int("scraper.feeds", len(feeds)))
+
+	wg := &sync.WaitGroup{}
+	for _, feed := range feeds {
+		wg.Add(1)
+		go ac.fetchFeed(ctx, wg, feed)
 	}
+	wg.Wait()
 }
 
 // fetchFeed is a helper function to retrieve the XML from the given RSS feed. Once
 // an attempt to fetch is made each feed is updated in the `feeds` table.
-func (ac *apiConfig) fetchFeed(wg *sync.WaitGroup, feed database.Feed) {
+func (ac *apiConfig) fetchFeed(ctx context.Context, wg *sync.WaitGroup, feed database.Feed) {
 	defer wg.Done()
 
-	_, err := ac.DB.MarkFeedFetched(context.Background(), database.MarkFeedFetchedParams{
+	ctx, span := scraperTracer.Start(ctx, "scraper.fetchFeed", trace.WithAttributes(
+		attribute.String("feed.id", feed.ID.String()),
+		attribute.String("feed.url", feed.Url),
+	))
+	defer span.End()
+
+	_, err := ac.DB.MarkFeedFetched(ctx, database.MarkFeedFetchedParams{
 		LastFetchedAt: time.Now(),
 		ID:            feed.ID,
 	})
 	if err != nil {
-		log.Printf("could not mark feed %s: %s\n", feed.ID, err)
+		slog.Error("could not mark feed fetched", "feed_id", feed.ID, "error", err)
 		return
 	}
 
-	feedItems, err := ac.scrapeFeed(feed.Url)
+	feedItems, err := ac.scrapeFeed(ctx, feed.Url)
 	if err != nil {
-		log.Printf("could not scrape feed %s from url %s: %s\n", feed.ID, feed.Url, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.Warn("could not scrape feed", "feed_id", feed.ID, "url", feed.Url, "error", err)
 		return
 	}
 
-	log.Printf("fetched feed %s from url %s with %d items\n", feedItems.Channel.Title, feedItems.Channel.Link, len(feedItems.Channel.Item))
+	slog.Info("fetched feed", "feed_id", feed.ID, "title", feedItems.Channel.Title, "url", feedItems.Channel.Link, "items", len(feedItems.Channel.Item))
 
 	for _, feedItem := range feedItems.Channel.Item {
-		log.Printf("feed %s - item %s with date %s and description %s", feedItem.Title, feedItem.Link, feedItem.PubDate, feedItem.Description)
+		slog.Debug("fetched feed item", "feed_id", feed.ID, "title", feedItem.Title, "link", feedItem.Link, "published", feedItem.PubDate)
+	}
+}
+
+// scrapeFeed will do the actual http call out to the provided URL and parse out the RSS information.
+// The HTTP fetch and the XML parsing are traced as separate spans so that slow feeds can be told apart
+// from large ones.
+func (ac *apiConfig) scrapeFeed(ctx context.Context, feedURL string) (*RSSFeed, error) {
+	ctx, span := scraperTracer.Start(ctx, "scraper.scrapeFeed", trace.WithAttributes(attribute.String("feed.url", feedURL)))
+	defer span.End()
+
+	dat, err := fetchFeedBody(ctx, feedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	_, parseSpan := scraperTracer.Start(ctx, "scraper.parseFeed", trace.WithAttributes(attribute.Int("feed.bytes", len(dat))))
+	defer parseSpan.End()
+
+	var rssFeed RSSFeed
+	err = xml.Unmarshal(dat, &rssFeed)
+	if err != nil {
+		parseSpan.RecordError(err)
+		parseSpan.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
+
+	parseSpan.SetAttributes(attribute.Int("feed.items", len(rssFeed.Channel.Item)))
+	return &rssFeed, nil
 }
 
-// scrapeFeed will do the actual http call out to the provided URL and parse out the RSS information
-func (ac *apiConfig) scrapeFeed(feedURL string) (*RSSFeed, error) {
+// fetchFeedBody performs the HTTP GET for a feed within its own client span
+func fetchFeedBody(ctx context.Context, feedURL string) ([]byte, error) {
+	ctx, span := scraperTracer.Start(ctx, "HTTP GET", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPMethod(http.MethodGet),
+		semconv.HTTPURL(feedURL),
+	))
+	defer span.End()
+
 	httpClient := http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	resp, err := httpClient.Get(feedURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	dat, err := io.ReadAll(resp.Body)
+	resp, err := httpClient.Do(req)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
-	var rssFeed RSSFeed
-	err = xml.Unmarshal(dat, &rssFeed)
+	defer resp.Body.Close()
+
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+
+	dat, err := io.ReadAll(resp.Body)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
-	return &rssFeed, nil
+	return dat, nil
 }
 
 // RSSFeed is made up of the channel descriptions and individual RSSItem items
@@ -28,18 +28,18 @@ func (ac *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 	newUserChk := newUserCheck{}
 
 	if err := decoder.Decode(&newUserChk); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("createUser: could not decode JSON payload: %s", err))
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("createUser: could not decode JSON payload: %s", err))
 		return
 	}
 
 	if newUserChk.Name == "" {
-		respondWithError(w, http.StatusBadRequest, "createUser: did not receive value for `name` field")
+		respondWithError(w, r, http.StatusBadRequest, "createUser: did not receive value for `name` field")
 		return
 	}
 
 	newUUID, err := uuid.NewRandom()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createUser: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createUser: %s", err))
 		return
 	}
 
@@ -53,7 +53,7 @@ func (ac *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 
 	dbUser, err := ac.DB.CreateUser(r.Context(), newUser)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("createUser: %s", err))
+		respondWithError(w, r, http.StatusInternalServerError, fmt.Sprintf("createUser: %s", err))
 		return
 	}
 
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/cors"
+)
+
+// getCORSPolicy builds the CORS policy for the API from CORS_ALLOWED_ORIGINS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS, CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE. Lists are comma-separated, and any
+// origin is allowed unless CORS_ALLOWED_ORIGINS says otherwise.
+func getCORSPolicy() (cors.Policy, error) {
+	policy := cors.Policy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-Request-ID"},
+		ExposedHeaders: []string{"X-Request-ID"},
+		MaxAge:         10 * time.Minute,
+	}
+
+	if val, ok := os.LookupEnv("CORS_ALLOWED_ORIGINS"); ok {
+		policy.AllowedOrigins = cors.ParseList(val)
+	}
+
+	if val, ok := os.LookupEnv("CORS_ALLOWED_HEADERS"); ok {
+		policy.AllowedHeaders = cors.ParseList(val)
+	}
+
+	if val, ok := os.LookupEnv("CORS_EXPOSED_HEADERS"); ok {
+		policy.ExposedHeaders = cors.ParseList(val)
+	}
+
+	if val := os.Getenv("CORS_ALLOW_CREDENTIALS"); val != "" {
+		allow, err := strconv.ParseBool(val)
+		if err != nil {
+			return policy, fmt.Errorf("expected CORS_ALLOW_CREDENTIALS to be true or false, got %s", val)
+		}
+
+		policy.AllowCredentials = allow
+	}
+
+	if val := os.Getenv("CORS_MAX_AGE"); val != "" {
+		maxAge, err := time.ParseDuration(val)
+		if err != nil {
+			return policy, fmt.Errorf("expected CORS_MAX_AGE to be a duration such as 10m, got %s", val)
+		}
+
+		policy.MaxAge = maxAge
+	}
+
+	return policy, policy.Validate()
+}
@@ -7,4 +7,43 @@ require (
 	github.com/google/uuid v1.5.0
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/sebito91/bootdotdev/go/cors v0.0.0
+	github.com/sebito91/bootdotdev/go/httpcache v0.0.0
+	github.com/sebito91/bootdotdev/go/logging v0.0.0
+	github.com/sebito91/bootdotdev/go/tlsserver v0.0.0
+	github.com/sebito91/bootdotdev/go/tracing v0.0.0
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/trace v1.21.0
 )
+
+require (
+	github.com/cenkalti/backoff/v4 v4.2.1 // indirect
+	github.com/go-logr/logr v1.3.0 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.16.0 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.21.0 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.21.0 // indirect
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.21.0 // indirect
+	go.opentelemetry.io/otel/metric v1.21.0 // indirect
+	go.opentelemetry.io/otel/sdk v1.21.0 // indirect
+	go.opentelemetry.io/proto/otlp v1.0.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.14.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/grpc v1.59.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+replace github.com/sebito91/bootdotdev/go/cors v0.0.0 => ../cors
+
+replace github.com/sebito91/bootdotdev/go/httpcache v0.0.0 => ../httpcache
+
+replace github.com/sebito91/bootdotdev/go/logging v0.0.0 => ../logging
+
+replace github.com/sebito91/bootdotdev/go/tlsserver v0.0.0 => ../tlsserver
+
+replace github.com/sebito91/bootdotdev/go/tracing v0.0.0 => ../tracing
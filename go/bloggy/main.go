@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -13,16 +14,37 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/sebito91/bootdotdev/go/bloggy/api"
+	"github.com/sebito91/bootdotdev/go/logging"
+	"github.com/sebito91/bootdotdev/go/tlsserver"
+	"github.com/sebito91/bootdotdev/go/tracing"
 )
 
 func main() {
-	log.Println("Welcome to Bloggy!")
-
 	err := godotenv.Load()
 	if err != nil {
 		panic(err)
 	}
 
+	logger, err := logging.NewLogger(os.Stderr)
+	if err != nil {
+		panic(err)
+	}
+
+	// route the standard library logger and any bare slog calls through the configured logger
+	slog.SetDefault(logger)
+	logger.Info("Welcome to Bloggy!")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "bloggy")
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("could not flush traces", "error", err)
+		}
+	}()
+
 	portVal := os.Getenv("PORT")
 	port, err := strconv.Atoi(portVal)
 	if err != nil {
@@ -34,27 +56,60 @@ func main() {
 
 	flag.Parse()
 
-	apiCfg, err := api.GetAPI(*concurrency, *sleepInterval)
+	corsPolicy, err := getCORSPolicy()
+	if err != nil {
+		panic(err)
+	}
+
+	apiCfg, err := api.GetAPI(*concurrency, *sleepInterval, corsPolicy)
 	if err != nil {
 		panic(err)
 	}
 
-	corsMux := api.MiddlewareCors(apiCfg.Router)
+	tlsCfg, err := getTLSSettings()
+	if err != nil {
+		panic(err)
+	}
 
 	// create the server struct
 	server := &http.Server{
 		Addr:              fmt.Sprintf("localhost:%d", port),
-		Handler:           corsMux,
+		Handler:           tlsserver.MiddlewareHSTS(tlsCfg.hstsMaxAge)(apiCfg.Router),
 		ReadHeaderTimeout: time.Second,
 	}
 
+	serve := server.ListenAndServe
+	if tlsCfg.enabled() {
+		server.TLSConfig, err = tlsserver.NewServerConfig(context.Background(), tlsCfg.options(), logger)
+		if err != nil {
+			panic(err)
+		}
+
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+	}
+
+	if tlsCfg.redirectPort != 0 {
+		redirectServer := &http.Server{
+			Addr:              fmt.Sprintf("localhost:%d", tlsCfg.redirectPort),
+			Handler:           tlsserver.RedirectHandler(server.Addr),
+			ReadHeaderTimeout: time.Second,
+		}
+
+		go func() {
+			logger.Info("starting bloggy HTTPS redirect listener", "addr", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	go apiCfg.StartScraping()
 
-	log.Printf("starting bloggy listener on %s...\n", server.Addr)
+	logger.Info("starting bloggy listener", "addr", server.Addr, "tls", tlsCfg.enabled())
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := serve(); err != nil {
 		panic(err)
 	}
 
-	log.Printf("closing bloggy")
+	logger.Info("closing bloggy")
 }
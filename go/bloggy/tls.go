@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/tlsserver"
+)
+
+// tlsSettings is the HTTPS configuration read from the environment
+type tlsSettings struct {
+	certFile       string
+	keyFile        string
+	selfSigned     bool
+	reloadInterval time.Duration
+	redirectPort   int
+	hstsMaxAge     time.Duration
+}
+
+// enabled reports whether bloggy should listen with HTTPS
+func (s tlsSettings) enabled() bool {
+	return s.certFile != "" || s.selfSigned
+}
+
+// getTLSSettings reads TLS_CERT_FILE, TLS_KEY_FILE, TLS_SELF_SIGNED, TLS_RELOAD_INTERVAL, HTTP_REDIRECT_PORT
+// and HSTS_MAX_AGE from the environment; all of them are optional
+func getTLSSettings() (tlsSettings, error) {
+	settings := tlsSettings{
+		certFile:       os.Getenv("TLS_CERT_FILE"),
+		keyFile:        os.Getenv("TLS_KEY_FILE"),
+		reloadInterval: 10 * time.Second,
+	}
+
+	if val := os.Getenv("TLS_SELF_SIGNED"); val != "" {
+		selfSigned, err := strconv.ParseBool(val)
+		if err != nil {
+			return settings, fmt.Errorf("expected TLS_SELF_SIGNED to be true or false, got %s", val)
+		}
+
+		settings.selfSigned = selfSigned
+	}
+
+	if val := os.Getenv("TLS_RELOAD_INTERVAL"); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil || interval <= 0 {
+			return settings, fmt.Errorf("expected TLS_RELOAD_INTERVAL to be a positive duration, got %s", val)
+		}
+
+		settings.reloadInterval = interval
+	}
+
+	if val := os.Getenv("HTTP_REDIRECT_PORT"); val != "" {
+		port, err := strconv.Atoi(val)
+		if err != nil {
+			return settings, fmt.Errorf("expected HTTP_REDIRECT_PORT to be a port number, got %s", val)
+		}
+
+		settings.redirectPort = port
+	}
+
+	if val := os.Getenv("HSTS_MAX_AGE"); val != "" {
+		maxAge, err := time.ParseDuration(val)
+		if err != nil || maxAge < 0 {
+			return settings, fmt.Errorf("expected HSTS_MAX_AGE to be a duration such as 24h, got %s", val)
+		}
+
+		settings.hstsMaxAge = maxAge
+	}
+
+	switch {
+	case (settings.certFile == "") != (settings.keyFile == ""):
+		return settings, fmt.Errorf("TLS needs both TLS_CERT_FILE and TLS_KEY_FILE")
+	case settings.selfSigned && settings.certFile != "":
+		return settings, fmt.Errorf("TLS_SELF_SIGNED cannot be combined with TLS_CERT_FILE")
+	case !settings.enabled() && (settings.redirectPort != 0 || settings.hstsMaxAge > 0):
+		return settings, fmt.Errorf("HTTP_REDIRECT_PORT and HSTS_MAX_AGE require TLS to be enabled")
+	}
+
+	return settings, nil
+}
+
+// options returns where bloggy takes its certificate from
+func (s tlsSettings) options() tlsserver.Options {
+	return tlsserver.Options{
+		CertFile:       s.certFile,
+		KeyFile:        s.keyFile,
+		SelfSigned:     s.selfSigned,
+		ReloadInterval: s.reloadInterval,
+	}
+}
@@ -2,7 +2,9 @@ package admin
 
 import (
 	"fmt"
+	"html"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/sebito91/bootdotdev/go/chirpy/api"
@@ -10,51 +12,80 @@ import (
 
 // Config is a placeholder for our /admin API section
 type Config struct {
-	API *api.Config
+	API    *api.Config
+	apiKey string
 }
 
-// NewConfig returns an instance of the Config with proper reference to the APIConfig
-func NewConfig(c *api.Config) (*Config, error) {
+// NewConfig returns an instance of the Config with proper reference to the APIConfig. Every admin
+// endpoint, the moderation console included, requires apiKey and is disabled if it is empty.
+func NewConfig(c *api.Config, apiKey string) (*Config, error) {
 	if c == nil {
 		return nil, fmt.Errorf("please make sure to initialize the API Config before the Admin Config")
 	}
 
-	return &Config{c}, nil
+	return &Config{API: c, apiKey: apiKey}, nil
 }
 
 // GetAdminAPI returns the router for the /admin endpoint
 func (c *Config) GetAdminAPI() chi.Router {
 	r := chi.NewRouter()
 
-	r.Get("/metrics", c.metricsEndpoint)
-	r.Get("/reset", c.resetEndpoint)
+	r.With(c.middlewareAPIKey).Get("/metrics", c.metricsEndpoint)
+	r.With(c.middlewareAPIKey).Method(http.MethodGet, "/prometheus", c.API.PrometheusHandler())
+	r.With(c.middlewareAPIKey).Method(http.MethodGet, "/analytics", c.API.AnalyticsHandler())
+	r.With(c.middlewareAPIKey).Post("/reset", c.resetEndpoint)
+
+	// moderation, as JSON for scripts and as a server-rendered console for browsers
+	r.With(c.middlewareAPIKey).Mount("/api", c.API.GetModerationAPI())
+
+	r.Route("/console", func(r chi.Router) {
+		r.Use(c.middlewareBasicAuth)
+
+		r.Get("/", c.consoleUsers)
+		r.Get("/chirps", c.consoleChirps)
+		r.Post("/users/{userID}/{action}", c.consoleUserAction)
+		r.Post("/chirps/{chirpID}/{action}", c.consoleChirpAction)
+	})
 
 	return r
 }
 
 // metricsEndpoint will use a write-enabled middleware to display the number
-// of site visits since the start of the server
+// of site visits since the start of the server, along with a breakdown of requests per route
 func (c *Config) metricsEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 
-	w.Header().Set("Content-Type", "text/html")
 	content := `
 <html>
 	<body>
 		<h1>Welcome, Chirpy Admin</h1>
 		<p>Chirpy has been visited %d times!</p>
+		<h2>Requests</h2>
+		<table>
+			<tr><th>Route</th><th>Method</th><th>Status</th><th>Count</th></tr>
+%s		</table>
+		<p>The full set of metrics is available in Prometheus format at /admin/prometheus.</p>
+		<p>Hourly and daily traffic analytics are available at /admin/analytics.</p>
+		<p>Users and chirps can be moderated from the <a href="/admin/console">moderation console</a>.</p>
 	</body>
 </html>
 `
-	if _, err := fmt.Fprintf(w, content, c.API.GetFileserverHits()); err != nil {
+	var rows strings.Builder
+	for _, sample := range c.API.RequestCounts() {
+		fmt.Fprintf(&rows, "\t\t\t<tr><td>%s</td><td>%s</td><td>%s</td><td>%.0f</td></tr>\n",
+			html.EscapeString(sample.Labels[0]), html.EscapeString(sample.Labels[1]), html.EscapeString(sample.Labels[2]), sample.Value)
+	}
+
+	if _, err := fmt.Fprintf(w, content, c.API.GetFileserverHits(), rows.String()); err != nil {
 		panic(err)
 	}
 }
 
 // resetEndpoint will reset the number of site visits to 0 during a running server
 func (c *Config) resetEndpoint(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	c.API.ResetFileserverHits()
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	c.API.ResetFileserverHits()
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// validKey reports whether key matches the admin API key, in constant time
+func (c *Config) validKey(key string) bool {
+	return c.apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(c.apiKey)) == 1
+}
+
+// middlewareAPIKey only lets through requests carrying `Authorization: ApiKey <ADMIN_API_KEY>`. Browsers
+// never attach this header on their own, so the JSON endpoints cannot be triggered cross-site.
+func (c *Config) middlewareAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.apiKey == "" {
+			http.Error(w, "the admin API is disabled, set ADMIN_API_KEY to enable it", http.StatusForbidden)
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+		if !ok || !c.validKey(key) {
+			http.Error(w, "expected valid admin ApiKey", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareBasicAuth asks the browser for the admin API key as the password of HTTP basic auth, with
+// any user name, so that the console can be used without extra tooling
+func (c *Config) middlewareBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.apiKey == "" {
+			http.Error(w, "the admin API is disabled, set ADMIN_API_KEY to enable it", http.StatusForbidden)
+			return
+		}
+
+		_, key, ok := r.BasicAuth()
+		if !ok || !c.validKey(key) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy admin", charset="UTF-8"`)
+			http.Error(w, "expected the admin API key as the password", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken is embedded in every console form. Browsers replay basic auth credentials on cross-site form
+// posts too, so each post must also prove that it came from a page rendered by the console.
+func (c *Config) csrfToken() string {
+	mac := hmac.New(sha256.New, []byte(c.apiKey))
+	mac.Write([]byte("chirpy-admin-console"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether the posted form carries the console's CSRF token
+func (c *Config) validCSRFToken(r *http.Request) bool {
+	return hmac.Equal([]byte(r.PostFormValue("csrf_token")), []byte(c.csrfToken()))
+}
@@ -0,0 +1,301 @@
+package admin
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sebito91/bootdotdev/go/chirpy/api"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/logging"
+)
+
+// consoleTemplate renders both pages of the moderation console; every action is a small form posting
+// back to /admin/console, which redirects to the page the form was on
+var consoleTemplate = template.Must(template.New("console").Funcs(template.FuncMap{
+	"formatTime": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>Chirpy moderation</title>
+		<style>
+			body { font-family: sans-serif; margin: 2em; }
+			table { border-collapse: collapse; width: 100%; }
+			th, td { border: 1px solid #ccc; padding: 0.3em 0.5em; text-align: left; vertical-align: top; }
+			form { display: inline; }
+			.notice { background: #e6f4ea; padding: 0.5em; }
+			.hidden { color: #888; }
+		</style>
+	</head>
+	<body>
+		<h1>Chirpy moderation</h1>
+		<p><a href="/admin/console">Users</a> | <a href="/admin/console/chirps">Chirps</a></p>
+		{{with .Notice}}<p class="notice">{{.}}</p>{{end}}
+		<form method="get">
+			<input type="search" name="q" value="{{.Query}}" placeholder="Search">
+			{{if .Chirps}}<input type="number" name="author_id" value="{{if .AuthorID}}{{.AuthorID}}{{end}}" placeholder="Author ID" min="1">{{end}}
+			<button type="submit">Search</button>
+		</form>
+		{{$csrf := .CSRFToken}}{{$return := .ReturnTo}}
+		{{if .Chirps}}
+		<h2>Chirps</h2>
+		<table>
+			<tr><th>ID</th><th>Author</th><th>Body</th><th>Visibility</th><th>Actions</th></tr>
+			{{range .ChirpRows}}
+			<tr{{if .Hidden}} class="hidden"{{end}}>
+				<td>{{.ID}}</td>
+				<td><a href="/admin/console/chirps?author_id={{.AuthorID}}">{{.AuthorID}}</a></td>
+				<td>{{.Body}}</td>
+				<td>{{if .Hidden}}hidden{{else}}public{{end}}</td>
+				<td>
+					<form method="post" action="/admin/console/chirps/{{.ID}}/{{if .Hidden}}unhide{{else}}hide{{end}}">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<button type="submit">{{if .Hidden}}Unhide{{else}}Hide{{end}}</button>
+					</form>
+					<form method="post" action="/admin/console/chirps/{{.ID}}/delete" onsubmit="return confirm('Delete chirp {{.ID}} for good?')">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<button type="submit">Delete</button>
+					</form>
+				</td>
+			</tr>
+			{{else}}
+			<tr><td colspan="5">No chirps found.</td></tr>
+			{{end}}
+		</table>
+		{{else}}
+		<h2>Users</h2>
+		<table>
+			<tr><th>ID</th><th>Email</th><th>Handle</th><th>Chirps</th><th>Chirpy Red</th><th>Status</th><th>Actions</th></tr>
+			{{range .UserRows}}
+			<tr>
+				<td>{{.ID}}</td>
+				<td>{{.Email}}</td>
+				<td>{{.Handle}}</td>
+				<td><a href="/admin/console/chirps?author_id={{.ID}}">{{.Chirps}}</a></td>
+				<td>{{if .IsChirpyRed}}yes{{else}}
+					<form method="post" action="/admin/console/users/{{.ID}}/chirpy-red">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<button type="submit">Grant</button>
+					</form>{{end}}
+				</td>
+				<td>{{.Status}}{{with formatTime .SuspendedUntil}} until {{.}}{{end}}{{with .Reason}}<br><small>{{.}}</small>{{end}}</td>
+				<td>
+					{{if eq .Status "active"}}
+					<form method="post" action="/admin/console/users/{{.ID}}/suspend">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<input type="text" name="duration" placeholder="72h (empty: until lifted)" size="14">
+						<input type="text" name="reason" placeholder="Reason" size="14">
+						<button type="submit">Suspend</button>
+					</form>
+					<form method="post" action="/admin/console/users/{{.ID}}/ban" onsubmit="return confirm('Ban user {{.ID}}?')">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<input type="text" name="reason" placeholder="Reason" size="14">
+						<button type="submit">Ban</button>
+					</form>
+					{{else}}
+					<form method="post" action="/admin/console/users/{{.ID}}/reinstate">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<button type="submit">Reinstate</button>
+					</form>
+					{{end}}
+					<form method="post" action="/admin/console/users/{{.ID}}/revoke-sessions">
+						<input type="hidden" name="csrf_token" value="{{$csrf}}"><input type="hidden" name="return_to" value="{{$return}}">
+						<button type="submit">Revoke sessions</button>
+					</form>
+				</td>
+			</tr>
+			{{else}}
+			<tr><td colspan="7">No users found.</td></tr>
+			{{end}}
+		</table>
+		{{end}}
+	</body>
+</html>
+`))
+
+// consolePage is the data rendered by consoleTemplate
+type consolePage struct {
+	Chirps    bool
+	Query     string
+	AuthorID  int
+	Notice    string
+	CSRFToken string
+	ReturnTo  string
+	UserRows  []api.ModeratedUser
+	ChirpRows []database.Chirp
+}
+
+// renderConsole writes the given console page
+func (c *Config) renderConsole(w http.ResponseWriter, r *http.Request, page consolePage) {
+	page.Query = r.URL.Query().Get("q")
+	page.Notice = r.URL.Query().Get("notice")
+	page.CSRFToken = c.csrfToken()
+	page.ReturnTo = r.URL.RequestURI()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := consoleTemplate.Execute(w, page); err != nil {
+		slog.LogAttrs(r.Context(), slog.LevelError, "could not render the moderation console",
+			append(logging.RequestAttrs(r), slog.String("error", err.Error()))...)
+	}
+}
+
+// consoleUsers lists the users matching the `q` search parameter, with their moderation actions
+func (c *Config) consoleUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := c.API.SearchUsers(r.Context(), r.URL.Query().Get("q"))
+	if err != nil {
+		consoleError(w, r, err)
+		return
+	}
+
+	c.renderConsole(w, r, consolePage{UserRows: users})
+}
+
+// consoleChirps lists the chirps, hidden ones included, matching the `q` and `author_id` parameters
+func (c *Config) consoleChirps(w http.ResponseWriter, r *http.Request) {
+	authorID, _ := strconv.Atoi(r.URL.Query().Get("author_id"))
+
+	chirps, err := c.API.SearchChirps(r.Context(), r.URL.Query().Get("q"), authorID)
+	if err != nil {
+		consoleError(w, r, err)
+		return
+	}
+
+	c.renderConsole(w, r, consolePage{Chirps: true, AuthorID: authorID, ChirpRows: chirps})
+}
+
+// consoleUserAction applies the moderation action named in the path to the user and redirects back
+func (c *Config) consoleUserAction(w http.ResponseWriter, r *http.Request) {
+	if !c.validCSRFToken(r) {
+		http.Error(w, "missing or invalid CSRF token, please reload the console", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "expected valid userID (>0)", http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+
+	var notice string
+	switch action := chi.URLParam(r, "action"); action {
+	case "suspend":
+		var until *time.Time
+		if val := strings.TrimSpace(r.PostFormValue("duration")); val != "" {
+			duration, parseErr := time.ParseDuration(val)
+			if parseErr != nil || duration <= 0 {
+				http.Error(w, "expected positive suspension duration such as 72h, got "+val, http.StatusBadRequest)
+				return
+			}
+
+			end := time.Now().UTC().Add(duration)
+			until = &end
+		}
+
+		notice = "suspended"
+		err = c.API.SuspendUser(r.Context(), userID, until, reason)
+	case "ban":
+		notice = "banned"
+		err = c.API.BanUser(r.Context(), userID, reason)
+	case "reinstate":
+		notice = "reinstated"
+		err = c.API.ReinstateUser(r.Context(), userID)
+	case "revoke-sessions":
+		notice = "logged out everywhere"
+		err = c.API.RevokeUserSessions(r.Context(), userID)
+	case "chirpy-red":
+		notice = "upgraded to Chirpy Red"
+		err = c.API.GrantChirpyRed(r.Context(), userID)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		consoleError(w, r, err)
+		return
+	}
+
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "moderation action",
+		append(logging.RequestAttrs(r), slog.String("action", chi.URLParam(r, "action")), slog.Int("user_id", userID))...)
+	redirectBack(w, r, "User "+strconv.Itoa(userID)+" "+notice)
+}
+
+// consoleChirpAction applies the moderation action named in the path to the chirp and redirects back
+func (c *Config) consoleChirpAction(w http.ResponseWriter, r *http.Request) {
+	if !c.validCSRFToken(r) {
+		http.Error(w, "missing or invalid CSRF token, please reload the console", http.StatusForbidden)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil || chirpID <= 0 {
+		http.Error(w, "expected valid chirpID (>0)", http.StatusBadRequest)
+		return
+	}
+
+	var notice string
+	switch action := chi.URLParam(r, "action"); action {
+	case "hide":
+		notice = "hidden"
+		err = c.API.SetChirpHidden(r.Context(), chirpID, true)
+	case "unhide":
+		notice = "visible again"
+		err = c.API.SetChirpHidden(r.Context(), chirpID, false)
+	case "delete":
+		notice = "deleted"
+		err = c.API.RemoveChirp(r.Context(), chirpID)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		consoleError(w, r, err)
+		return
+	}
+
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "moderation action",
+		append(logging.RequestAttrs(r), slog.String("action", chi.URLParam(r, "action")), slog.Int("chirp_id", chirpID))...)
+	redirectBack(w, r, "Chirp "+strconv.Itoa(chirpID)+" "+notice)
+}
+
+// redirectBack sends the browser back to the console page the form was posted from, showing notice
+func redirectBack(w http.ResponseWriter, r *http.Request, notice string) {
+	target, err := url.Parse(r.PostFormValue("return_to"))
+	if err != nil || target.Host != "" || !strings.HasPrefix(target.Path, "/admin/console") {
+		target = &url.URL{Path: "/admin/console"}
+	}
+
+	query := target.Query()
+	query.Set("notice", notice)
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// consoleError reports a failed lookup or action as a plain text error page
+func consoleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	slog.LogAttrs(r.Context(), slog.LevelError, "moderation console request failed",
+		append(logging.RequestAttrs(r), slog.String("error", err.Error()))...)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
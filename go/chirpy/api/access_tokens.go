@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+)
+
+// patPrefix marks a bearer token as a personal access token rather than a JWT
+const patPrefix = "chirpy_pat_"
+
+// patTouchInterval is how stale the recorded last use of a personal access token may get. Recording it
+// rewrites the database, so it is not done on every request.
+const patTouchInterval = time.Minute
+
+// scopes that can be granted to a personal access token
+const (
+	scopeChirpsWrite = "chirps:write"
+	scopeChirpsRead  = "chirps:read"
+	scopeUsersRead   = "users:read"
+)
+
+var validScopes = map[string]bool{
+	scopeChirpsWrite: true,
+	scopeChirpsRead:  true,
+	scopeUsersRead:   true,
+}
+
+// hashPAT is a helper function to hash a raw personal access token for storage and lookup. The tokens
+// are 256 bits of random data, so a fast hash is sufficient here unlike for user passwords.
+func hashPAT(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// patExpired reports whether the personal access token is past its expiry, if it has one
+func patExpired(pat database.PersonalAccessToken) bool {
+	return pat.ExpiresAt != nil && time.Now().UTC().After(*pat.ExpiresAt)
+}
+
+// requirePATScope checks, for the public routes, that a request made with a personal access token uses
+// an active token granted the given scope. Anonymous requests and access tokens are let through.
+func (c *Config) requirePATScope(r *http.Request, scope string) *errorBody {
+	bearer, err := fetchToken(r)
+	if err != nil || !strings.HasPrefix(bearer, patPrefix) {
+		return nil
+	}
+
+	_, errBody := c.fetchUserID(r, scope)
+	return errBody
+}
+
+// fetchPATUserID validates the given personal access token and returns the ID of the user that owns it,
+// provided the token is active and was granted the requested scope
+func (c *Config) fetchPATUserID(ctx context.Context, token, scope string) (int, *errorBody) {
+	if scope == "" {
+		return -1, &errorBody{
+			Error:     "personal access tokens cannot be used for this request, please provide valid access token",
+			Code:      codeForbidden,
+			errorCode: http.StatusForbidden,
+		}
+	}
+
+	hash := hashPAT(token)
+	pat, err := c.db.GetPersonalAccessTokenByHash(ctx, hash)
+	if err != nil {
+		c.rateLimitUsers.forgetPAT(hash)
+		return -1, &errorBody{
+			Error:     "invalid personal access token",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	if pat.RevokedAt != nil {
+		c.rateLimitUsers.forgetPAT(hash)
+		return -1, &errorBody{
+			Error:     fmt.Sprintf("personal access token was revoked at: %s", pat.RevokedAt),
+			Code:      codeTokenRevoked,
+			errorCode: http.StatusUnauthorized,
+		}
+	} else if patExpired(pat) {
+		c.rateLimitUsers.forgetPAT(hash)
+		return -1, &errorBody{
+			Error:     fmt.Sprintf("personal access token expired at: %s", pat.ExpiresAt),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	granted := false
+	for _, s := range pat.Scopes {
+		if s == scope {
+			granted = true
+			break
+		}
+	}
+
+	if !granted {
+		return -1, &errorBody{
+			Error:     fmt.Sprintf("personal access token is missing required scope %s", scope),
+			Code:      codeInsufficientScope,
+			errorCode: http.StatusForbidden,
+		}
+	}
+
+	if pat.LastUsedAt == nil || time.Since(*pat.LastUsedAt) >= patTouchInterval {
+		if err := c.db.TouchPersonalAccessToken(ctx, pat.ID); err != nil {
+			return -1, internalError(err)
+		}
+	}
+
+	return pat.UserID, nil
+}
+
+// createAccessToken will generate a new personal access token for the authenticated user with the requested
+// scopes. The raw token is only ever returned in this response.
+func (c *Config) createAccessToken(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if bodyChk.Name == "" || len(bodyChk.Scopes) == 0 {
+		errBody := errorBody{
+			Error:     "personal access token requires a name and at least one scope",
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	for _, scope := range bodyChk.Scopes {
+		if !validScopes[scope] {
+			errBody := errorBody{
+				Error:     fmt.Sprintf("unknown scope %s", scope),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+	}
+
+	if bodyChk.ExpiresInDays < 0 {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("expected valid expires_in_days (>=0), got %d", bodyChk.ExpiresInDays),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		internalError(fmt.Errorf("token generate: %s", err)).writeErrorToPage(w, r)
+		return
+	}
+
+	token := patPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	// a zero value means the token never expires
+	var expiresAt *time.Time
+	if bodyChk.ExpiresInDays > 0 {
+		expiry := time.Now().UTC().Add(time.Hour * 24 * time.Duration(bodyChk.ExpiresInDays))
+		expiresAt = &expiry
+	}
+
+	pat, err := c.db.CreatePersonalAccessToken(r.Context(), id, bodyChk.Name, bodyChk.Scopes, hashPAT(token), expiresAt)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusCreated, struct {
+		ID        int        `json:"id"`
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		Token     string     `json:"token"`
+		CreatedAt time.Time  `json:"created_at"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{
+		ID: pat.ID, Name: pat.Name, Scopes: pat.Scopes, Token: token, CreatedAt: pat.CreatedAt, ExpiresAt: pat.ExpiresAt})
+}
+
+// getAccessTokens will list the active personal access tokens for the authenticated user, without their values
+func (c *Config) getAccessTokens(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	pats, err := c.db.GetActivePersonalAccessTokensByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	type patView struct {
+		ID         int        `json:"id"`
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	}
+
+	views := make([]patView, 0, len(pats))
+	for _, pat := range pats {
+		views = append(views, patView{
+			ID:         pat.ID,
+			Name:       pat.Name,
+			Scopes:     pat.Scopes,
+			CreatedAt:  pat.CreatedAt,
+			LastUsedAt: pat.LastUsedAt,
+			ExpiresAt:  pat.ExpiresAt,
+		})
+	}
+
+	writeSuccessToPage(w, http.StatusOK, views)
+}
+
+// deleteAccessTokenByID will revoke a personal access token belonging to the authenticated user
+func (c *Config) deleteAccessTokenByID(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	patID, errBody := pathID(r, "tokenID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	pats, err := c.db.GetActivePersonalAccessTokensByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	for _, pat := range pats {
+		if pat.ID == patID {
+			if err := c.db.RevokePersonalAccessToken(r.Context(), pat.ID); err != nil {
+				internalError(err).writeErrorToPage(w, r)
+				return
+			}
+
+			writeSuccessToPage(w, http.StatusOK, nil)
+			return
+		}
+	}
+
+	errBody = &errorBody{
+		Error:     fmt.Sprintf("could not find active personal access tokenID %d", patID),
+		Code:      codeNotFound,
+		errorCode: http.StatusNotFound,
+	}
+
+	errBody.writeErrorToPage(w, r)
+}
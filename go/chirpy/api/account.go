@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+)
+
+// deleteUser will permanently remove the authenticated user from the database. The current password is
+// required to confirm the deletion. Depending on ACCOUNT_DELETION_MODE their chirps and revoked tokens are
+// either deleted alongside the account or kept and anonymized.
+func (c *Config) deleteUser(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	user, err := c.db.GetUserFullByID(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if match, _, err := c.passwords.Verify(bodyChk.Password, user.PasswordHash); err != nil || !match {
+		errBody := errorBody{
+			Error:     "account deletion requires the current password",
+			Code:      codeInvalidCredentials,
+			errorCode: http.StatusUnauthorized,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	// unless they are anonymized, the user's chirps go with them
+	var removedChirps []database.Chirp
+	if !c.anonymizeDeletions {
+		chirps, err := c.db.GetChirpsByAuthorID(r.Context(), id)
+		if err != nil {
+			internalError(err).writeErrorToPage(w, r)
+			return
+		}
+
+		removedChirps = visibleChirps(chirps)
+	}
+
+	if err := c.db.DeleteUser(r.Context(), id, c.anonymizeDeletions); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	for _, chirp := range removedChirps {
+		c.stream.publish(streamEventDeleted, chirp)
+	}
+
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// exportUser will produce a downloadable JSON archive with the authenticated user's profile, chirps,
+// sessions and personal access tokens. Secrets such as password hashes or token hashes are not included.
+func (c *Config) exportUser(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, scopeUsersRead)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	user, err := c.db.GetUserFullByID(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	chirps, err := c.db.GetChirpsByAuthorID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	// sort the IDs in ascending order
+	sort.Slice(chirps, func(a, b int) bool {
+		return chirps[a].ID < chirps[b].ID
+	})
+
+	sessions, err := c.db.GetActiveSessionsByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	pats, err := c.db.GetActivePersonalAccessTokensByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	type patExport struct {
+		ID         int        `json:"id"`
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+		ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	}
+
+	patExports := make([]patExport, 0, len(pats))
+	for _, pat := range pats {
+		patExports = append(patExports, patExport{
+			ID:         pat.ID,
+			Name:       pat.Name,
+			Scopes:     pat.Scopes,
+			CreatedAt:  pat.CreatedAt,
+			LastUsedAt: pat.LastUsedAt,
+			ExpiresAt:  pat.ExpiresAt,
+		})
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"chirpy-export-%d.json\"", id))
+	writeSuccessToPage(w, http.StatusOK, struct {
+		ExportedAt           time.Time          `json:"exported_at"`
+		Profile              database.User      `json:"profile"`
+		TwoFactorEnabled     bool               `json:"two_factor_enabled"`
+		Chirps               []database.Chirp   `json:"chirps"`
+		Sessions             []database.Session `json:"sessions"`
+		PersonalAccessTokens []patExport        `json:"personal_access_tokens"`
+	}{
+		ExportedAt:           time.Now().UTC(),
+		Profile:              user.User,
+		TwoFactorEnabled:     user.TwoFactor.Enabled,
+		Chirps:               chirps,
+		Sessions:             sessions,
+		PersonalAccessTokens: patExports,
+	})
+}
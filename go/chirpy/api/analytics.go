@@ -0,0 +1,372 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/chirpy/web"
+	"github.com/sebito91/bootdotdev/go/logging"
+)
+
+// the largest range that can be requested from /admin/analytics for each granularity
+var analyticsMaxRange = map[string]time.Duration{
+	database.AnalyticsHourly: 31 * 24 * time.Hour,
+	database.AnalyticsDaily:  400 * 24 * time.Hour,
+}
+
+// analyticsRecorder counts the traffic in memory and flushes it to the database every interval, so that
+// requests never wait for the database file to be written
+type analyticsRecorder struct {
+	db      *database.DB
+	salt    []byte
+	mux     sync.Mutex
+	pending map[string]map[int64]*database.AnalyticsBucket
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newAnalyticsRecorder starts a recorder flushing to db every interval. Visitor IDs are derived with salt
+// so that they are stable across restarts without storing IP addresses.
+func newAnalyticsRecorder(db *database.DB, salt string, interval time.Duration) *analyticsRecorder {
+	a := &analyticsRecorder{
+		db:      db,
+		salt:    []byte(salt),
+		pending: newPendingBuckets(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(a.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				if err := a.flush(context.Background()); err != nil {
+					slog.Error("could not flush analytics to the database", "error", err)
+				}
+			}
+		}
+	}()
+
+	return a
+}
+
+func newPendingBuckets() map[string]map[int64]*database.AnalyticsBucket {
+	return map[string]map[int64]*database.AnalyticsBucket{
+		database.AnalyticsHourly: make(map[int64]*database.AnalyticsBucket),
+		database.AnalyticsDaily:  make(map[int64]*database.AnalyticsBucket),
+	}
+}
+
+// bucketStart returns the start of the hour or day (UTC) that t falls in
+func bucketStart(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	if granularity == database.AnalyticsDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return t.Truncate(time.Hour)
+}
+
+// visitorID derives a pseudonymous ID for the client from its IP address and user agent
+func (a *analyticsRecorder) visitorID(r *http.Request) uint64 {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(clientIP(r) + "|" + r.UserAgent()))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// record counts one request in the current hourly and daily buckets
+func (a *analyticsRecorder) record(at time.Time, path string, status int, pageView, apiCall bool, visitor uint64) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for granularity, buckets := range a.pending {
+		start := bucketStart(granularity, at)
+
+		bucket, ok := buckets[start.Unix()]
+		if !ok {
+			bucket = &database.AnalyticsBucket{
+				Start:    start,
+				Paths:    make(map[string]int),
+				Statuses: make(map[string]int),
+			}
+			buckets[start.Unix()] = bucket
+		}
+
+		bucket.Requests++
+		bucket.Paths[path]++
+		bucket.Statuses[strconv.Itoa(status)]++
+		bucket.Visitors.Add(visitor)
+
+		if pageView {
+			bucket.PageViews++
+		}
+
+		if apiCall {
+			bucket.APICalls++
+		}
+	}
+}
+
+// flush writes the buckets counted so far to the database. If the write fails they are kept in memory
+// and retried on the next flush.
+func (a *analyticsRecorder) flush(ctx context.Context) error {
+	a.mux.Lock()
+	pending := a.pending
+	a.pending = newPendingBuckets()
+	a.mux.Unlock()
+
+	updates := make(map[string]map[int64]database.AnalyticsBucket, len(pending))
+	empty := true
+	for granularity, buckets := range pending {
+		updates[granularity] = make(map[int64]database.AnalyticsBucket, len(buckets))
+		for start, bucket := range buckets {
+			updates[granularity][start] = *bucket
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil
+	}
+
+	err := a.db.RecordAnalytics(ctx, updates[database.AnalyticsHourly], updates[database.AnalyticsDaily])
+	if err != nil {
+		// put the counts back so that nothing is lost
+		a.mux.Lock()
+		for granularity, buckets := range pending {
+			for start, bucket := range buckets {
+				if current, ok := a.pending[granularity][start]; ok {
+					current.Merge(*bucket)
+				} else {
+					a.pending[granularity][start] = bucket
+				}
+			}
+		}
+		a.mux.Unlock()
+	}
+
+	return err
+}
+
+// close stops the periodic flush and writes out whatever is left
+func (a *analyticsRecorder) close(ctx context.Context) error {
+	close(a.stop)
+	<-a.done
+
+	return a.flush(ctx)
+}
+
+// MiddlewareAnalytics counts every request outside of /admin towards the traffic analytics. Calls under
+// /api are counted as API calls by route; successful GETs of anything else are counted as page views by
+// web asset. It must run inside the chi router so that the route is known.
+func (c *Config) MiddlewareAnalytics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := logging.NewResponseRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		// the admins' own traffic is not what the analytics are about
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			return
+		}
+
+		status := rec.Status()
+
+		apiCall := r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")
+		pageView := !apiCall && r.Method == http.MethodGet && status < http.StatusBadRequest
+
+		// API calls are grouped by route so that IDs do not blow up the number of paths, and page views
+		// by asset for the same reason: the app routes served by the SPA fallback and the failed requests
+		// for files share the route of the file server
+		path := logging.RoutePattern(r)
+		if name, ok := web.Asset(r.URL.Path); pageView && ok {
+			path = "/" + name
+		}
+
+		c.analytics.record(time.Now(), path, status, pageView, apiCall, c.analytics.visitorID(r))
+	})
+}
+
+// analyticsPoint is one bucket of the time series returned by /admin/analytics
+type analyticsPoint struct {
+	Start          time.Time      `json:"start"`
+	Requests       int            `json:"requests"`
+	PageViews      int            `json:"page_views"`
+	APICalls       int            `json:"api_calls"`
+	UniqueVisitors int            `json:"unique_visitors"`
+	Paths          map[string]int `json:"paths"`
+	Statuses       map[string]int `json:"statuses"`
+}
+
+// newAnalyticsPoint summarizes a stored bucket, estimating its unique visitors
+func newAnalyticsPoint(start time.Time, bucket database.AnalyticsBucket) analyticsPoint {
+	point := analyticsPoint{
+		Start:          start,
+		Requests:       bucket.Requests,
+		PageViews:      bucket.PageViews,
+		APICalls:       bucket.APICalls,
+		UniqueVisitors: bucket.Visitors.Count(),
+		Paths:          bucket.Paths,
+		Statuses:       bucket.Statuses,
+	}
+
+	if point.Paths == nil {
+		point.Paths = map[string]int{}
+	}
+
+	if point.Statuses == nil {
+		point.Statuses = map[string]int{}
+	}
+
+	return point
+}
+
+// parseAnalyticsTime accepts either an RFC 3339 timestamp or a plain YYYY-MM-DD date (UTC)
+func parseAnalyticsTime(name, value string) (time.Time, *errorBody) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, &errorBody{
+		Error:     fmt.Sprintf("expected %s as RFC 3339 timestamp or YYYY-MM-DD date, got %q", name, value),
+		Code:      codeValidationFailed,
+		errorCode: http.StatusBadRequest,
+	}
+}
+
+// AnalyticsHandler serves the traffic time series for a range, with one point per hour or day:
+//
+//	GET /admin/analytics?granularity=hour|day&from=<time>&to=<time>
+//
+// granularity defaults to hour; to defaults to now and from to 24 hours (hourly) or 30 days (daily)
+// before it. Periods without traffic are returned as zero points so that the series has no gaps.
+func (c *Config) AnalyticsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		granularity := query.Get("granularity")
+		if granularity == "" {
+			granularity = database.AnalyticsHourly
+		}
+
+		maxRange, ok := analyticsMaxRange[granularity]
+		if !ok {
+			errBody := errorBody{
+				Error:     fmt.Sprintf("expected granularity of %s or %s, got %q", database.AnalyticsHourly, database.AnalyticsDaily, granularity),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+
+		step := time.Hour
+		if granularity == database.AnalyticsDaily {
+			step = 24 * time.Hour
+		}
+
+		to := time.Now().UTC()
+		if val := query.Get("to"); val != "" {
+			t, errBody := parseAnalyticsTime("to", val)
+			if errBody != nil {
+				errBody.writeErrorToPage(w, r)
+				return
+			}
+
+			to = t
+		}
+
+		from := to.Add(-24 * time.Hour)
+		if granularity == database.AnalyticsDaily {
+			from = to.Add(-30 * 24 * time.Hour)
+		}
+
+		if val := query.Get("from"); val != "" {
+			t, errBody := parseAnalyticsTime("from", val)
+			if errBody != nil {
+				errBody.writeErrorToPage(w, r)
+				return
+			}
+
+			from = t
+		}
+
+		// widen the range to whole buckets: from the start of the first one to the end of the last one
+		from = bucketStart(granularity, from)
+		if end := bucketStart(granularity, to); end.Before(to) || end.Equal(from) {
+			to = end.Add(step)
+		}
+
+		if !from.Before(to) || to.Sub(from) > maxRange {
+			errBody := errorBody{
+				Error:     fmt.Sprintf("expected from before to and a range of at most %s for granularity %s", maxRange, granularity),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+
+		// include the traffic that is still only counted in memory
+		if err := c.analytics.flush(r.Context()); err != nil {
+			internalError(err).writeErrorToPage(w, r)
+			return
+		}
+
+		buckets, err := c.db.GetAnalytics(r.Context(), granularity, from, to)
+		if err != nil {
+			internalError(err).writeErrorToPage(w, r)
+			return
+		}
+
+		byStart := make(map[int64]database.AnalyticsBucket, len(buckets))
+		total := database.AnalyticsBucket{}
+		for _, bucket := range buckets {
+			byStart[bucket.Start.Unix()] = bucket
+			total.Merge(bucket)
+		}
+
+		series := make([]analyticsPoint, 0, int(to.Sub(from)/step))
+		for start := from; start.Before(to); start = start.Add(step) {
+			series = append(series, newAnalyticsPoint(start, byStart[start.Unix()]))
+		}
+
+		totals := newAnalyticsPoint(from, total)
+		writeSuccessToPage(w, http.StatusOK, struct {
+			Granularity string           `json:"granularity"`
+			From        time.Time        `json:"from"`
+			To          time.Time        `json:"to"`
+			Totals      analyticsPoint   `json:"totals"`
+			Series      []analyticsPoint `json:"series"`
+		}{
+			Granularity: granularity,
+			From:        from,
+			To:          to,
+			Totals:      totals,
+			Series:      series,
+		})
+	})
+}
@@ -1,75 +1,192 @@
 package api
 
 import (
-	"os"
+	"context"
+	"errors"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/joho/godotenv"
+	"github.com/gorilla/websocket"
+	"github.com/sebito91/bootdotdev/go/chirpy/config"
 	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/chirpy/password"
 )
 
 // Config is a local struct to keep track of site visits
 // NOTE: this value is in-memory only and will persist for the duration of the server
 type Config struct {
-	fileserverHits int
-	jwtSecret      string
-	polkaAPIKey    string
-	db             *database.DB
-	mux            sync.RWMutex
+	metrics            *serverMetrics
+	analytics          *analyticsRecorder
+	jwtSecret          string
+	polkaAPIKey        string
+	accessTokenTTL     time.Duration
+	refreshTokenTTL    time.Duration
+	challengeTokenTTL  time.Duration
+	chirpMaxLength     int
+	anonymizeDeletions bool
+	passwords          *password.Hasher
+	rateLimiters       map[string]*rateLimiter
+	rateLimitUsers     *rateLimitUsers
+	stream             *chirpHub
+	streamUpgrader     *websocket.Upgrader
+	db                 *database.DB
+	shuttingDown       atomic.Bool
+	mux                sync.RWMutex
 }
 
-// errorBody is a struct used for returning a JSON-based error code/string
-type errorBody struct {
-	Error     string `json:"error"`
-	errorCode int
-}
-
-// NewConfig returns a new instance of the Config
-func NewConfig() (*Config, error) {
-	db, err := database.NewDB("")
+// NewConfig returns a new instance of the Config for the given, already validated, server configuration
+func NewConfig(cfg config.Config) (*Config, error) {
+	db, err := database.NewDB(cfg.DBPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := godotenv.Load(); err != nil {
-		return nil, err
+	policy := password.DefaultPolicy
+	policy.MinLength = cfg.PasswordMinLength
+	policy.MinCharClasses = cfg.PasswordMinCharClasses
+
+	rateLimiters := map[string]*rateLimiter{
+		rateLimitAuth:    newRateLimiter(cfg.RateLimitAuth),
+		rateLimitWrite:   newRateLimiter(cfg.RateLimitWrite),
+		rateLimitDefault: newRateLimiter(cfg.RateLimitDefault),
 	}
 
-	return &Config{db: db, jwtSecret: os.Getenv("JWT_SECRET"), polkaAPIKey: os.Getenv("POLKA_API_KEY")}, nil
+	return &Config{
+		db:                 db,
+		metrics:            newServerMetrics(db),
+		analytics:          newAnalyticsRecorder(db, cfg.JWTSecret, cfg.AnalyticsFlushInterval),
+		rateLimiters:       rateLimiters,
+		rateLimitUsers:     newRateLimitUsers(),
+		stream:             newChirpHub(),
+		streamUpgrader:     newStreamUpgrader(cfg.CORSPolicy(cfg.CORSAllowedOrigins, http.MethodGet)),
+		passwords:          password.NewHasher(password.DefaultParams, policy),
+		jwtSecret:          cfg.JWTSecret,
+		polkaAPIKey:        cfg.PolkaAPIKey,
+		accessTokenTTL:     cfg.AccessTokenTTL,
+		refreshTokenTTL:    cfg.RefreshTokenTTL,
+		challengeTokenTTL:  cfg.ChallengeTokenTTL,
+		chirpMaxLength:     cfg.ChirpMaxLength,
+		anonymizeDeletions: cfg.AccountDeletionMode == config.DeletionAnonymize,
+	}, nil
+}
+
+// BeginShutdown flips the readiness check to unhealthy; requests already in flight are unaffected
+func (c *Config) BeginShutdown() {
+	c.shuttingDown.Store(true)
+}
+
+// EndStreams closes every open chirp stream and refuses new ones. Streams never finish on their own, so
+// this has to happen as the server shuts down, e.g. through http.Server.RegisterOnShutdown.
+func (c *Config) EndStreams() {
+	c.stream.close()
+}
+
+// Close releases the resources held by the Config, writing out the pending analytics and waiting for any
+// in-flight database write to finish. It must only be called once the server has stopped serving requests.
+func (c *Config) Close() error {
+	analyticsErr := c.analytics.close(context.Background())
+	return errors.Join(analyticsErr, c.db.Close())
 }
 
 // GetAPI returns the router for the /api endpoint
 func (c *Config) GetAPI() chi.Router {
 	r := chi.NewRouter()
 
-	r.Get("/healthz", readinessEndpoint)
+	// every route shares the default limit; credential checks and writes get a tighter one on top
+	r.Use(c.middlewareRateLimit(rateLimitDefault))
+	authLimit := c.middlewareRateLimit(rateLimitAuth)
+	writeLimit := c.middlewareRateLimit(rateLimitWrite)
+
+	r.Get("/healthz", c.readinessEndpoint)
+
+	// the OpenAPI document describing this router and the admin one, and a page to browse it
+	r.Get("/openapi.json", c.getOpenAPISpec)
+	r.Get("/docs", c.getDocs)
+
+	// live chirp events, as Server-Sent Events or over a WebSocket
+	r.Get("/stream", c.streamChirps)
+	r.Get("/stream/ws", c.streamChirpsWebSocket)
 
 	r.Route("/chirps", func(r chi.Router) {
 		r.Get("/", c.getChirps)
-		r.Post("/", c.writeChirp)
+		r.With(writeLimit).Post("/", c.writeChirp)
 
 		r.Route("/{chirpID}", func(r chi.Router) {
 			r.Get("/", c.getChirpByID)
-			r.Delete("/", c.deleteChirpByID)
+			r.With(writeLimit).Delete("/", c.deleteChirpByID)
 		})
 	})
 
 	r.Route("/users", func(r chi.Router) {
 		r.Get("/", c.getUsers)
-		r.Post("/", c.writeUser)
-		r.Put("/", c.updateUser)
+		r.With(authLimit).Post("/", c.writeUser)
+		r.With(authLimit).Put("/", c.updateUser)
+		r.With(authLimit).Patch("/", c.patchUser)
+		r.With(authLimit).Delete("/", c.deleteUser)
+		r.Get("/export", c.exportUser)
+
+		// two-factor enrollment for the authenticated user
+		r.Route("/2fa", func(r chi.Router) {
+			r.Use(authLimit)
+			r.Post("/enroll", c.enrollTwoFactor)
+			r.Post("/confirm", c.confirmTwoFactor)
+			r.Delete("/", c.disableTwoFactor)
+		})
+
+		// users the authenticated user has blocked from messaging them
+		r.Get("/blocks", c.getBlockedUsers)
 
 		r.Route("/{userID}", func(r chi.Router) {
 			r.Get("/", c.getUserByID)
+			r.With(writeLimit).Put("/block", c.blockUser)
+			r.With(writeLimit).Delete("/block", c.unblockUser)
+		})
+	})
+
+	// direct messages between users, visible to the participants only
+	r.Route("/conversations", func(r chi.Router) {
+		r.Get("/", c.getConversations)
+		r.With(writeLimit).Post("/", c.createConversation)
+
+		r.Route("/{conversationID}", func(r chi.Router) {
+			r.Get("/", c.getConversationByID)
+			r.Get("/messages", c.getMessages)
+			r.With(writeLimit).Post("/messages", c.writeMessage)
+			r.Post("/read", c.markConversationRead)
 		})
 	})
 
 	// token-related exercises
-	r.Post("/login", c.loginUser)
-	r.Post("/refresh", c.refreshToken)
+	r.With(authLimit).Post("/login", c.loginUser)
+	r.With(authLimit).Post("/login/2fa", c.loginTwoFactor)
+	r.With(authLimit).Post("/refresh", c.refreshToken)
 	r.Post("/revoke", c.revokeToken)
 
+	// session management for the authenticated user
+	r.Route("/sessions", func(r chi.Router) {
+		r.Get("/", c.getSessions)
+		r.Delete("/", c.deleteSessions)
+		r.Delete("/{sessionID}", c.deleteSessionByID)
+	})
+
+	// personal access tokens for API automation
+	r.Route("/tokens", func(r chi.Router) {
+		r.Get("/", c.getAccessTokens)
+		r.Post("/", c.createAccessToken)
+		r.Delete("/{tokenID}", c.deleteAccessTokenByID)
+	})
+
+	// notifications for the authenticated user
+	r.Route("/notifications", func(r chi.Router) {
+		r.Get("/", c.getNotifications)
+		r.Get("/unread_count", c.getUnreadNotificationCount)
+		r.Post("/read", c.markNotificationsRead)
+		r.Post("/{notificationID}/read", c.markNotificationRead)
+	})
+
 	// webhooks
 	r.Route("/polka", func(r chi.Router) {
 		r.Post("/webhooks", c.processPolkaUpdate)
@@ -7,23 +7,26 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"unicode/utf8"
 
-	"github.com/go-chi/chi/v5"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
 )
 
 // getChirps will fetch the chirps from the DB and write to the page
 func (c *Config) getChirps(w http.ResponseWriter, r *http.Request) {
-	chirps, err := c.db.GetChirps()
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
+	if errBody := c.requirePATScope(r, scopeChirpsRead); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
 
-		errBody.writeErrorToPage(w)
+	chirps, err := c.db.GetChirps(r.Context())
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
+	chirps = visibleChirps(chirps)
+
 	sortOrder := r.URL.Query().Get("sort")
 	if sortOrder == "desc" {
 		// sort the IDs in descending order
@@ -44,27 +47,19 @@ func (c *Config) getChirps(w http.ResponseWriter, r *http.Request) {
 	}
 
 	authorID, err := strconv.Atoi(authorIDParam)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+	if err != nil || authorID <= 0 {
+		invalidIDError("author_id", authorIDParam).writeErrorToPage(w, r)
 		return
 	}
 
-	chirpsByAuthor, err := c.db.GetChirpsByAuthorID(authorID)
+	chirpsByAuthor, err := c.db.GetChirpsByAuthorID(r.Context(), authorID)
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
+	chirpsByAuthor = visibleChirps(chirpsByAuthor)
+
 	if sortOrder == "desc" {
 		// sort the IDs in descending order
 		sort.Slice(chirpsByAuthor, func(a, b int) bool {
@@ -82,171 +77,93 @@ func (c *Config) getChirps(w http.ResponseWriter, r *http.Request) {
 
 // getChirpByID will fetch a specific chirp from the database
 func (c *Config) getChirpByID(w http.ResponseWriter, r *http.Request) {
-	chirps, err := c.db.GetChirps()
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+	if errBody := c.requirePATScope(r, scopeChirpsRead); errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	chirps, err := c.db.GetChirps(r.Context())
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	if chirpID <= 0 {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("expected valid chirpID (>0), got %d", chirpID),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+	chirpID, errBody := pathID(r, "chirpID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
 	for _, chirp := range chirps {
-		if chirp.ID == chirpID {
+		if chirp.ID == chirpID && !chirp.Hidden {
 			writeSuccessToPage(w, http.StatusOK, chirp)
 			return
 		}
 	}
 
-	errBody := errorBody{
+	errBody = &errorBody{
 		Error:     fmt.Sprintf("could not find chirpID %d", chirpID),
+		Code:      codeNotFound,
 		errorCode: http.StatusNotFound,
 	}
 
-	errBody.writeErrorToPage(w)
+	errBody.writeErrorToPage(w, r)
 }
 
 // deleteChirpByID will delete a specific chirp from the database if the user is authorized to do so
 // the JWT from the request is validated, and if the authenticated user matches the author_id of the given
 // chirp, then the system will remove the chirp from the database.
 func (c *Config) deleteChirpByID(w http.ResponseWriter, r *http.Request) {
-	chirps, err := c.db.GetChirps()
+	chirps, err := c.db.GetChirps(r.Context())
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	}
-
-	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	}
-
-	if chirpID <= 0 {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("expected valid chirpID (>0), got %d", chirpID),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	}
-
-	claims, respCode, err := c.fetchClaims(r)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: respCode,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	}
-
-	if issuer, claimErr := claims.GetIssuer(); claimErr != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", claimErr),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	} else if issuer == chirpyRefresh {
-		errBody := errorBody{
-			Error:     "cannot use refresh token for delete chirp request, please provide valid access token",
-			errorCode: http.StatusUnauthorized,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	idString, err := claims.GetSubject()
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+	chirpID, errBody := pathID(r, "chirpID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	authorID, err := strconv.Atoi(idString)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("could not convert userID to string: %s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+	authorID, errBody := c.fetchUserID(r, scopeChirpsWrite)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
 	for _, chirp := range chirps {
 		if chirp.ID == chirpID && chirp.AuthorID == authorID {
-			if err := c.db.DeleteChirp(chirp); err != nil {
-				errBody := errorBody{
-					Error:     fmt.Sprintf("could not delete chirpID %d: %s", chirpID, err),
-					errorCode: http.StatusInternalServerError,
-				}
-
-				errBody.writeErrorToPage(w)
+			if err := c.db.DeleteChirp(r.Context(), chirp); err != nil {
+				internalError(fmt.Errorf("could not delete chirpID %d: %s", chirpID, err)).writeErrorToPage(w, r)
 				return
 			}
 
+			if !chirp.Hidden {
+				c.stream.publish(streamEventDeleted, chirp)
+			}
+
 			writeSuccessToPage(w, http.StatusOK, nil)
 			return
 		} else if chirp.ID == chirpID && chirp.AuthorID != authorID {
 			errBody := errorBody{
 				Error:     fmt.Sprintf("cannot delete chirpID %d by authorID %d, unauthorized", chirpID, authorID),
+				Code:      codeForbidden,
 				errorCode: http.StatusForbidden,
 			}
 
-			errBody.writeErrorToPage(w)
+			errBody.writeErrorToPage(w, r)
 			return
 		}
 	}
 
-	errBody := errorBody{
+	errBody = &errorBody{
 		Error:     fmt.Sprintf("could not find chirpID %d by author %d", chirpID, authorID),
+		Code:      codeNotFound,
 		errorCode: http.StatusNotFound,
 	}
 
-	errBody.writeErrorToPage(w)
+	errBody.writeErrorToPage(w, r)
 }
 
 // writeChirp will validate the chirp first, and if successful commit to the db
@@ -260,89 +177,50 @@ func (c *Config) writeChirp(w http.ResponseWriter, r *http.Request) {
 
 	// handle a decode error
 	if err := decoder.Decode(&bodyChk); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		invalidJSONError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	// if chirp is too long (>140 chars), send a 400 error
-	if len(bodyChk.Body) > 140 {
+	// if chirp is too long, send a 400 error
+	if utf8.RuneCountInString(bodyChk.Body) > c.chirpMaxLength {
 		errBody := errorBody{
-			Error:     "Chirp is too long",
+			Error:     fmt.Sprintf("Chirp is too long, the limit is %d characters", c.chirpMaxLength),
+			Code:      codeChirpTooLong,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	claims, respCode, err := c.fetchClaims(r)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: respCode,
-		}
-
-		errBody.writeErrorToPage(w)
+	authorID, errBody := c.fetchUserID(r, scopeChirpsWrite)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	if issuer, claimErr := claims.GetIssuer(); claimErr != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", claimErr),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	} else if issuer == chirpyRefresh {
-		errBody := errorBody{
-			Error:     "cannot use refresh token for chirp request, please provide valid access token",
-			errorCode: http.StatusUnauthorized,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	}
-
-	idString, err := claims.GetSubject()
+	chirp, err := c.db.CreateChirp(r.Context(), authorID, cleanedBody(bodyChk.Body))
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	authorID, err := strconv.Atoi(idString)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("could not convert userID to string: %s", err),
-			errorCode: http.StatusInternalServerError,
-		}
+	c.stream.publish(streamEventCreated, chirp)
+	c.notifyMentions(r, chirp)
 
-		errBody.writeErrorToPage(w)
-		return
-	}
+	writeSuccessToPage(w, http.StatusCreated, chirp)
+}
 
-	chirp, err := c.db.CreateChirp(authorID, cleanedBody(bodyChk.Body))
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
+// visibleChirps filters out the chirps hidden by a moderator
+func visibleChirps(chirps []database.Chirp) []database.Chirp {
+	visible := make([]database.Chirp, 0, len(chirps))
+	for _, chirp := range chirps {
+		if !chirp.Hidden {
+			visible = append(visible, chirp)
 		}
-
-		errBody.writeErrorToPage(w)
-		return
 	}
 
-	writeSuccessToPage(w, http.StatusCreated, chirp)
+	return visible
 }
 
 func cleanedBody(body string) string {
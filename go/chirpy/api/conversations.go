@@ -0,0 +1,366 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+)
+
+// limits for direct messages, which are private and so are not bound by the chirp length
+const (
+	// maxConversationParticipants counts the creator, so a group has at most this many members
+	maxConversationParticipants = 8
+	messageMaxLength            = 1000
+	defaultMessagesLimit        = 50
+	maxMessagesLimit            = 200
+)
+
+// conversationView is a conversation as returned to one of its participants; the read markers of the
+// other participants are left out
+type conversationView struct {
+	ID             int               `json:"id"`
+	ParticipantIDs []int             `json:"participant_ids"`
+	CreatedBy      int               `json:"created_by"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LastMessageAt  time.Time         `json:"last_message_at"`
+	LastMessage    *database.Message `json:"last_message"`
+	UnreadCount    int               `json:"unread_count"`
+}
+
+func newConversationView(summary database.ConversationSummary) conversationView {
+	return conversationView{
+		ID:             summary.ID,
+		ParticipantIDs: summary.ParticipantIDs,
+		CreatedBy:      summary.CreatedBy,
+		CreatedAt:      summary.CreatedAt,
+		LastMessageAt:  summary.LastMessageAt,
+		LastMessage:    summary.LastMessage,
+		UnreadCount:    summary.UnreadCount,
+	}
+}
+
+// validateMessageBody checks that a direct message is neither blank nor too long
+func validateMessageBody(body string) *errorBody {
+	switch {
+	case strings.TrimSpace(body) == "":
+		return &errorBody{
+			Error:     "message body cannot be empty",
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+	case utf8.RuneCountInString(body) > messageMaxLength:
+		return &errorBody{
+			Error:     fmt.Sprintf("message is too long, the limit is %d characters", messageMaxLength),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+	}
+
+	return nil
+}
+
+// getConversations will list the conversations of the authenticated user, most recently active first,
+// each with its latest message and the number of messages the user has not read yet
+func (c *Config) getConversations(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	summaries, err := c.db.GetConversationsByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	views := make([]conversationView, 0, len(summaries))
+	for _, summary := range summaries {
+		views = append(views, newConversationView(summary))
+	}
+
+	writeSuccessToPage(w, http.StatusOK, views)
+}
+
+// createConversation will start a conversation between the authenticated user and the given participants,
+// optionally sending its first message. Asking for a one-to-one conversation that already exists returns
+// it with a 200 rather than creating a second one.
+func (c *Config) createConversation(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		ParticipantIDs []int  `json:"participant_ids"`
+		Body           string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	others := make(map[int]bool)
+	for _, participantID := range bodyChk.ParticipantIDs {
+		if participantID <= 0 {
+			invalidIDError("participant_ids", strconv.Itoa(participantID)).writeErrorToPage(w, r)
+			return
+		}
+
+		if participantID != id {
+			others[participantID] = true
+		}
+	}
+
+	if len(others) == 0 || len(others) >= maxConversationParticipants {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("conversation requires between 1 and %d other participants", maxConversationParticipants-1),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if bodyChk.Body != "" {
+		if errBody := validateMessageBody(bodyChk.Body); errBody != nil {
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+	}
+
+	conversation, created, err := c.db.CreateConversation(r.Context(), id, bodyChk.ParticipantIDs, bodyChk.Body)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	summary, err := c.db.GetConversation(r.Context(), conversation.ID, id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	writeSuccessToPage(w, status, newConversationView(summary))
+}
+
+// getConversationByID will return a single conversation of the authenticated user; conversations they
+// don't take part in are reported as not found
+func (c *Config) getConversationByID(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	convID, errBody := pathID(r, "conversationID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	summary, err := c.db.GetConversation(r.Context(), convID, id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, newConversationView(summary))
+}
+
+// getMessages will return a page of the conversation's messages, newest first. The next page is requested
+// with before_id set to the ID of the last message returned.
+func (c *Config) getMessages(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	convID, errBody := pathID(r, "conversationID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	beforeID, limit, errBody := parsePage(r, defaultMessagesLimit, maxMessagesLimit)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	messages, err := c.db.GetMessages(r.Context(), convID, id, beforeID, limit)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, messages)
+}
+
+// writeMessage will send a message to the conversation as the authenticated user
+func (c *Config) writeMessage(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Body string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if errBody := validateMessageBody(bodyChk.Body); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	convID, errBody := pathID(r, "conversationID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	message, err := c.db.CreateMessage(r.Context(), convID, id, bodyChk.Body)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusCreated, message)
+}
+
+// markConversationRead will mark the conversation as read by the authenticated user, up to the given
+// message_id or up to its latest message if the body is empty
+func (c *Config) markConversationRead(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		MessageID int `json:"message_id"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// an empty body marks everything as read
+	if err := decoder.Decode(&bodyChk); err != nil && !errors.Is(err, io.EOF) {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if bodyChk.MessageID < 0 {
+		invalidIDError("message_id", strconv.Itoa(bodyChk.MessageID)).writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	convID, errBody := pathID(r, "conversationID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.MarkConversationRead(r.Context(), convID, id, bodyChk.MessageID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	summary, err := c.db.GetConversation(r.Context(), convID, id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, newConversationView(summary))
+}
+
+// getBlockedUsers will list the IDs of the users the authenticated user has blocked
+func (c *Config) getBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	blocked, err := c.db.GetBlockedUserIDs(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, blocked)
+}
+
+// blockUser will block the user in the path for the authenticated user, see database.DB.SetUserBlocked
+func (c *Config) blockUser(w http.ResponseWriter, r *http.Request) {
+	c.setUserBlocked(w, r, true)
+}
+
+// unblockUser will lift a block set with blockUser
+func (c *Config) unblockUser(w http.ResponseWriter, r *http.Request) {
+	c.setUserBlocked(w, r, false)
+}
+
+func (c *Config) setUserBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if userID == id {
+		errBody := errorBody{
+			Error:     "users cannot block themselves",
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.SetUserBlocked(r.Context(), id, userID, blocked); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+)
+
+// problemCode is a stable, machine-readable identifier for the kind of error returned to a client.
+// Clients should branch on these rather than on the human-readable detail, which may change.
+type problemCode string
+
+const (
+	codeInvalidJSON        problemCode = "invalid_json"
+	codeValidationFailed   problemCode = "validation_failed"
+	codeInvalidID          problemCode = "invalid_id"
+	codeChirpTooLong       problemCode = "chirp_too_long"
+	codeUnauthenticated    problemCode = "unauthenticated"
+	codeInvalidCredentials problemCode = "invalid_credentials"
+	codeTokenRevoked       problemCode = "token_revoked"
+	codeInvalidTwoFactor   problemCode = "invalid_two_factor_code"
+	codeForbidden          problemCode = "forbidden"
+	codeAccountSuspended   problemCode = "account_suspended"
+	codeAccountBanned      problemCode = "account_banned"
+	codeInsufficientScope  problemCode = "insufficient_scope"
+	codeNotFound           problemCode = "not_found"
+	codeConflict           problemCode = "conflict"
+	codeRateLimited        problemCode = "rate_limited"
+	codeUnavailable        problemCode = "unavailable"
+	codeInternal           problemCode = "internal_error"
+)
+
+// problemTypePrefix is prepended to the code to build the RFC 7807 `type` URI of each problem
+const problemTypePrefix = "urn:chirpy:problem:"
+
+// errorBody is an RFC 7807 problem details object, written as application/problem+json. The `error`
+// member mirrors the detail for clients written against the original {"error": "..."} body.
+//
+// Only Error, Code and errorCode need to be set by handlers; cause carries the internal error, which is
+// logged server-side and never sent to the client.
+type errorBody struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Code     problemCode `json:"code"`
+	Detail   string      `json:"detail"`
+	Instance string      `json:"instance,omitempty"`
+	Error    string      `json:"error"`
+
+	errorCode int
+	cause     error
+}
+
+// internalError returns a generic 500 problem that hides the underlying cause from the client
+func internalError(cause error) *errorBody {
+	return &errorBody{
+		Error:     "internal server error",
+		Code:      codeInternal,
+		errorCode: http.StatusInternalServerError,
+		cause:     cause,
+	}
+}
+
+// invalidJSONError returns the problem for a request body that could not be decoded
+func invalidJSONError(cause error) *errorBody {
+	return &errorBody{
+		Error:     "request body must be valid JSON",
+		Code:      codeInvalidJSON,
+		errorCode: http.StatusBadRequest,
+		cause:     cause,
+	}
+}
+
+// invalidIDError returns the problem for a path parameter that is not a valid ID
+func invalidIDError(name, value string) *errorBody {
+	return &errorBody{
+		Error:     fmt.Sprintf("expected valid %s (>0), got %q", name, value),
+		Code:      codeInvalidID,
+		errorCode: http.StatusBadRequest,
+	}
+}
+
+// databaseError classifies an error from the database package: missing records become a 404 and
+// uniqueness violations a 409, while anything else is treated as an internal error
+func databaseError(err error) *errorBody {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return &errorBody{
+			Error:     err.Error(),
+			Code:      codeNotFound,
+			errorCode: http.StatusNotFound,
+		}
+	case errors.Is(err, database.ErrDuplicate):
+		return &errorBody{
+			Error:     err.Error(),
+			Code:      codeConflict,
+			errorCode: http.StatusConflict,
+		}
+	case errors.Is(err, database.ErrBlocked):
+		return &errorBody{
+			Error:     err.Error(),
+			Code:      codeForbidden,
+			errorCode: http.StatusForbidden,
+		}
+	default:
+		return internalError(err)
+	}
+}
@@ -1,38 +1,120 @@
 package api
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/chirpy/metrics"
+	"github.com/sebito91/bootdotdev/go/logging"
+)
+
+// serverMetrics is the set of metrics collected by the server, exposed in the Prometheus text format
+// at /admin/prometheus and summarized on the /admin/metrics page
+type serverMetrics struct {
+	registry        *metrics.Registry
+	fileserverHits  *metrics.CounterVec
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	dbOpDuration    *metrics.HistogramVec
+}
+
+// newServerMetrics registers the server metrics, including the gauges computed from the given database
+func newServerMetrics(db *database.DB) *serverMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &serverMetrics{
+		registry:       registry,
+		fileserverHits: registry.NewCounterVec("chirpy_fileserver_hits_total", "Number of site visits since the counter was last reset."),
+		requests: registry.NewCounterVec("chirpy_http_requests_total", "Number of HTTP requests by route, method and status code.",
+			"route", "method", "code"),
+		requestDuration: registry.NewHistogramVec("chirpy_http_request_duration_seconds", "Latency of HTTP requests by route and method.",
+			metrics.DefaultBuckets, "route", "method"),
+		dbOpDuration: registry.NewHistogramVec("chirpy_db_operation_duration_seconds", "Latency of database file operations by operation and result.",
+			metrics.DefaultBuckets, "op", "result"),
+	}
+
+	registry.NewGaugeFunc("chirpy_users", "Number of registered users.", func() (float64, error) {
+		users, err := db.GetUsers(context.Background())
+		return float64(len(users)), err
+	})
+
+	registry.NewGaugeFunc("chirpy_chirps", "Number of chirps.", func() (float64, error) {
+		chirps, err := db.GetChirps(context.Background())
+		return float64(len(chirps)), err
+	})
+
+	db.SetObserver(func(op string, elapsed time.Duration, err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+
+		m.dbOpDuration.Observe(elapsed.Seconds(), op, result)
+	})
+
+	return m
+}
+
+// MiddlewareMetrics records the count, status code and latency of every request, labelled by the chi route
+// pattern rather than the raw path so that IDs do not blow up the number of series
+func (c *Config) MiddlewareMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := logging.NewResponseRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		route := logging.RoutePattern(r)
+
+		c.metrics.requests.Inc(route, r.Method, strconv.Itoa(rec.Status()))
+		c.metrics.requestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
 
 // MiddlewareMetricsInc will use a middleware to increment an in-memory counter
 // of the number of site visits during server operation
 func (c *Config) MiddlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c.mux.Lock()
-		c.fileserverHits++
-		c.mux.Unlock()
+		c.metrics.fileserverHits.Inc()
 		next.ServeHTTP(w, r)
 	})
 }
 
 // GetFileserverHits returns the current number of site visits since the start of the server
 func (c *Config) GetFileserverHits() int {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	return c.fileserverHits
+	return int(c.metrics.fileserverHits.Sum())
 }
 
 // ResetFileserverHits will reset the fileserverHits counter as if the server restarted
 func (c *Config) ResetFileserverHits() {
-	c.mux.Lock()
-	c.fileserverHits = 0
-	c.mux.Unlock()
+	c.metrics.fileserverHits.Reset()
+}
+
+// RequestCounts returns the number of requests per route, method and status code, ordered by route
+func (c *Config) RequestCounts() []metrics.Sample {
+	return c.metrics.requests.Snapshot()
 }
 
-// readinessEndpoint yields the status and information for the /healthz endpoint
-func readinessEndpoint(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// PrometheusHandler serves every server metric in the Prometheus text exposition format
+func (c *Config) PrometheusHandler() http.Handler {
+	return c.metrics.registry.Handler()
+}
 
+// readinessEndpoint yields the status and information for the /healthz endpoint. Once the server has
+// started shutting down it reports 503 so that load balancers stop sending new requests.
+func (c *Config) readinessEndpoint(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	if _, err := w.Write([]byte("OK")); err != nil {
+
+	status, body := http.StatusOK, "OK"
+	if c.shuttingDown.Load() {
+		status, body = http.StatusServiceUnavailable, "Shutting down"
+	}
+
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(body)); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,445 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/logging"
+)
+
+// ModeratedUser is a user as seen by moderators, along with their moderation status and chirp count
+type ModeratedUser struct {
+	database.User
+	Status         string     `json:"status"`
+	Reason         string     `json:"reason,omitempty"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	Chirps         int        `json:"chirps"`
+}
+
+// SearchUsers returns the users whose email, handle or display name contains query, ignoring case, ordered
+// by ID. An empty query returns every user.
+func (c *Config) SearchUsers(ctx context.Context, query string) ([]ModeratedUser, error) {
+	users, err := c.db.GetUsersFull(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chirps, err := c.db.GetChirps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chirpCounts := make(map[int]int)
+	for _, chirp := range chirps {
+		chirpCounts[chirp.AuthorID]++
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	now := time.Now().UTC()
+
+	matches := make([]ModeratedUser, 0, len(users))
+	for _, user := range users {
+		if query != "" && !strings.Contains(strings.ToLower(user.Email), query) &&
+			!strings.Contains(strings.ToLower(user.Handle), query) &&
+			!strings.Contains(strings.ToLower(user.DisplayName), query) {
+			continue
+		}
+
+		moderated := ModeratedUser{
+			User:   user.User,
+			Status: user.Moderation.EffectiveStatus(now),
+			Chirps: chirpCounts[user.ID],
+		}
+
+		if moderated.Status != database.StatusActive {
+			moderated.Reason = user.Moderation.Reason
+			moderated.SuspendedUntil = user.Moderation.SuspendedUntil
+		}
+
+		matches = append(matches, moderated)
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		return matches[a].ID < matches[b].ID
+	})
+
+	return matches, nil
+}
+
+// SearchChirps returns the chirps whose body contains query, ignoring case, ordered by ID. Hidden chirps
+// are included. If authorID is positive only the chirps by that user are returned.
+func (c *Config) SearchChirps(ctx context.Context, query string, authorID int) ([]database.Chirp, error) {
+	chirps, err := c.db.GetChirps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	matches := make([]database.Chirp, 0, len(chirps))
+	for _, chirp := range chirps {
+		if authorID > 0 && chirp.AuthorID != authorID {
+			continue
+		}
+
+		if query != "" && !strings.Contains(strings.ToLower(chirp.Body), query) {
+			continue
+		}
+
+		matches = append(matches, chirp)
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		return matches[a].ID < matches[b].ID
+	})
+
+	return matches, nil
+}
+
+// SuspendUser locks the user out of the API until the given time, or until reinstated if until is nil
+func (c *Config) SuspendUser(ctx context.Context, userID int, until *time.Time, reason string) error {
+	now := time.Now().UTC()
+	return c.db.UpdateUserModeration(ctx, userID, database.Moderation{
+		Status:         database.StatusSuspended,
+		Reason:         reason,
+		SuspendedUntil: until,
+		UpdatedAt:      &now,
+	})
+}
+
+// BanUser locks the user out of the API until reinstated
+func (c *Config) BanUser(ctx context.Context, userID int, reason string) error {
+	now := time.Now().UTC()
+	return c.db.UpdateUserModeration(ctx, userID, database.Moderation{
+		Status:    database.StatusBanned,
+		Reason:    reason,
+		UpdatedAt: &now,
+	})
+}
+
+// ReinstateUser lifts any suspension or ban on the user
+func (c *Config) ReinstateUser(ctx context.Context, userID int) error {
+	now := time.Now().UTC()
+	return c.db.UpdateUserModeration(ctx, userID, database.Moderation{
+		Status:    database.StatusActive,
+		UpdatedAt: &now,
+	})
+}
+
+// RevokeUserSessions ends every session of the user, logging them out on every device
+func (c *Config) RevokeUserSessions(ctx context.Context, userID int) error {
+	// make sure the user exists, revoking the sessions of nobody would silently succeed
+	if _, err := c.db.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+
+	return c.db.RevokeSessionsByUserID(ctx, userID)
+}
+
+// GrantChirpyRed upgrades the user to Chirpy Red without going through Polka
+func (c *Config) GrantChirpyRed(ctx context.Context, userID int) error {
+	if err := c.db.UpdateUserToRed(ctx, userID); err != nil {
+		return err
+	}
+
+	c.rateLimitUsers.setChirpyRed(userID, true)
+	return nil
+}
+
+// SetChirpHidden hides the chirp from every public listing, or shows it again. Stream subscribers are
+// only told when the chirp actually changed.
+func (c *Config) SetChirpHidden(ctx context.Context, chirpID int, hidden bool) error {
+	chirp, changed, err := c.db.SetChirpHidden(ctx, chirpID, hidden)
+	if err != nil || !changed {
+		return err
+	}
+
+	if hidden {
+		c.stream.publish(streamEventDeleted, chirp)
+	} else {
+		c.stream.publish(streamEventCreated, chirp)
+	}
+
+	return nil
+}
+
+// RemoveChirp permanently deletes any chirp, regardless of its author
+func (c *Config) RemoveChirp(ctx context.Context, chirpID int) error {
+	chirps, err := c.db.GetChirps(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, chirp := range chirps {
+		if chirp.ID != chirpID {
+			continue
+		}
+
+		if err := c.db.DeleteChirp(ctx, chirp); err != nil {
+			return err
+		}
+
+		if !chirp.Hidden {
+			c.stream.publish(streamEventDeleted, chirp)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("could not find chirpID %d: %w", chirpID, database.ErrNotFound)
+}
+
+// GetModerationAPI returns the router for the moderation endpoints. It performs no authentication of its
+// own and must only be mounted behind the admin authentication.
+func (c *Config) GetModerationAPI() chi.Router {
+	r := chi.NewRouter()
+
+	r.Route("/users", func(r chi.Router) {
+		r.Get("/", c.moderationGetUsers)
+
+		r.Route("/{userID}", func(r chi.Router) {
+			r.Post("/suspend", c.moderationSuspendUser)
+			r.Post("/ban", c.moderationBanUser)
+			r.Post("/reinstate", c.moderationReinstateUser)
+			r.Delete("/sessions", c.moderationRevokeSessions)
+			r.Post("/chirpy-red", c.moderationGrantChirpyRed)
+		})
+	})
+
+	r.Route("/chirps", func(r chi.Router) {
+		r.Get("/", c.moderationGetChirps)
+
+		r.Route("/{chirpID}", func(r chi.Router) {
+			r.Post("/hide", c.moderationHideChirp)
+			r.Post("/unhide", c.moderationUnhideChirp)
+			r.Delete("/", c.moderationDeleteChirp)
+		})
+	})
+
+	return r
+}
+
+// logModeration records a moderation action in the server log, so that there is a trail of who did what
+func logModeration(r *http.Request, action string, target slog.Attr) {
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "moderation action",
+		append(logging.RequestAttrs(r), slog.String("action", action), target)...)
+}
+
+// moderationGetUsers lists the users matching the optional `q` search parameter
+func (c *Config) moderationGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := c.SearchUsers(r.Context(), r.URL.Query().Get("q"))
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, users)
+}
+
+// moderationGetChirps lists the chirps, hidden ones included, matching the optional `q` search and
+// `author_id` parameters
+func (c *Config) moderationGetChirps(w http.ResponseWriter, r *http.Request) {
+	authorID := 0
+	if param := r.URL.Query().Get("author_id"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil || id <= 0 {
+			invalidIDError("author_id", param).writeErrorToPage(w, r)
+			return
+		}
+
+		authorID = id
+	}
+
+	chirps, err := c.SearchChirps(r.Context(), r.URL.Query().Get("q"), authorID)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, chirps)
+}
+
+// moderationSuspendUser suspends the user for the optional `duration` (e.g. "72h"), or until reinstated
+// if none is given, recording the optional `reason`
+func (c *Config) moderationSuspendUser(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	// the body is optional, an empty one suspends indefinitely without a reason
+	bodyChk := bodyCheck{}
+	if err := json.NewDecoder(r.Body).Decode(&bodyChk); err != nil && !errors.Is(err, io.EOF) {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	var until *time.Time
+	if bodyChk.Duration != "" {
+		duration, err := time.ParseDuration(bodyChk.Duration)
+		if err != nil || duration <= 0 {
+			errBody := errorBody{
+				Error:     fmt.Sprintf("expected positive suspension duration such as 72h, got %q", bodyChk.Duration),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+
+		end := time.Now().UTC().Add(duration)
+		until = &end
+	}
+
+	if err := c.SuspendUser(r.Context(), userID, until, bodyChk.Reason); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "suspend_user", slog.Int("user_id", userID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationBanUser bans the user, recording the optional `reason`
+func (c *Config) moderationBanUser(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Reason string `json:"reason"`
+	}
+
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	bodyChk := bodyCheck{}
+	if err := json.NewDecoder(r.Body).Decode(&bodyChk); err != nil && !errors.Is(err, io.EOF) {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.BanUser(r.Context(), userID, bodyChk.Reason); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "ban_user", slog.Int("user_id", userID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationReinstateUser lifts any suspension or ban on the user
+func (c *Config) moderationReinstateUser(w http.ResponseWriter, r *http.Request) {
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.ReinstateUser(r.Context(), userID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "reinstate_user", slog.Int("user_id", userID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationRevokeSessions ends every session of the user
+func (c *Config) moderationRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.RevokeUserSessions(r.Context(), userID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "revoke_sessions", slog.Int("user_id", userID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationGrantChirpyRed upgrades the user to Chirpy Red
+func (c *Config) moderationGrantChirpyRed(w http.ResponseWriter, r *http.Request) {
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.GrantChirpyRed(r.Context(), userID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "grant_chirpy_red", slog.Int("user_id", userID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationHideChirp hides the chirp from the public listings
+func (c *Config) moderationHideChirp(w http.ResponseWriter, r *http.Request) {
+	c.moderationSetChirpHidden(w, r, true)
+}
+
+// moderationUnhideChirp makes a hidden chirp public again
+func (c *Config) moderationUnhideChirp(w http.ResponseWriter, r *http.Request) {
+	c.moderationSetChirpHidden(w, r, false)
+}
+
+func (c *Config) moderationSetChirpHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	chirpID, errBody := pathID(r, "chirpID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.SetChirpHidden(r.Context(), chirpID, hidden); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	action := "unhide_chirp"
+	if hidden {
+		action = "hide_chirp"
+	}
+
+	logModeration(r, action, slog.Int("chirp_id", chirpID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// moderationDeleteChirp permanently deletes the chirp
+func (c *Config) moderationDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	chirpID, errBody := pathID(r, "chirpID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.RemoveChirp(r.Context(), chirpID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	logModeration(r, "delete_chirp", slog.Int("chirp_id", chirpID))
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
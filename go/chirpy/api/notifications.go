@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/logging"
+)
+
+// paging limits for the notification list
+const (
+	defaultNotificationsLimit = 50
+	maxNotificationsLimit     = 200
+)
+
+// mentionRegex matches an @handle that is not part of a word or an email address; see handleRegex
+var mentionRegex = regexp.MustCompile(`(?:^|[^A-Za-z0-9_@.])@([A-Za-z0-9_]{3,30})\b`)
+
+// mentionedHandles returns the handles mentioned in a chirp body
+func mentionedHandles(body string) []string {
+	var handles []string
+	for _, match := range mentionRegex.FindAllStringSubmatch(body, -1) {
+		handles = append(handles, match[1])
+	}
+
+	return handles
+}
+
+// notifyMentions tells the users mentioned in a new chirp about it. The chirp has been stored by then, so
+// a failure is logged rather than returned to its author.
+func (c *Config) notifyMentions(r *http.Request, chirp database.Chirp) {
+	handles := mentionedHandles(chirp.Body)
+	if len(handles) == 0 {
+		return
+	}
+
+	if _, err := c.db.CreateMentionNotifications(r.Context(), chirp, handles); err != nil {
+		slog.LogAttrs(r.Context(), slog.LevelError, "could not create mention notifications",
+			append(logging.RequestAttrs(r), slog.Int("chirp_id", chirp.ID), slog.Any("error", err))...)
+	}
+}
+
+// getNotifications will return a page of the authenticated user's notifications, newest first. Only the
+// unread ones are returned with unread=true, and the next page is requested with before_id set to the ID
+// of the last notification returned.
+func (c *Config) getNotifications(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	unreadOnly := false
+	if param := r.URL.Query().Get("unread"); param != "" {
+		var err error
+		if unreadOnly, err = strconv.ParseBool(param); err != nil {
+			errBody := errorBody{
+				Error:     "expected unread to be true or false, got " + strconv.Quote(param),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+	}
+
+	beforeID, limit, errBody := parsePage(r, defaultNotificationsLimit, maxNotificationsLimit)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	notifications, err := c.db.GetNotificationsByUserID(r.Context(), id, unreadOnly, beforeID, limit)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, notifications)
+}
+
+// getUnreadNotificationCount will return the number of notifications the authenticated user has not read
+func (c *Config) getUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	unread, err := c.db.CountUnreadNotifications(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, struct {
+		UnreadCount int `json:"unread_count"`
+	}{UnreadCount: unread})
+}
+
+// markNotificationsRead will mark the given notification ids of the authenticated user as read, or all of
+// them if the body is empty or has no ids
+func (c *Config) markNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		IDs []int `json:"ids"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// an empty body marks everything as read
+	if err := decoder.Decode(&bodyChk); err != nil && !errors.Is(err, io.EOF) {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	for _, notificationID := range bodyChk.IDs {
+		if notificationID <= 0 {
+			invalidIDError("ids", strconv.Itoa(notificationID)).writeErrorToPage(w, r)
+			return
+		}
+	}
+
+	c.markRead(w, r, bodyChk.IDs)
+}
+
+// markNotificationRead will mark a single notification of the authenticated user as read
+func (c *Config) markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	notificationID, errBody := pathID(r, "notificationID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	c.markRead(w, r, []int{notificationID})
+}
+
+func (c *Config) markRead(w http.ResponseWriter, r *http.Request, ids []int) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if _, err := c.db.MarkNotificationsRead(r.Context(), id, ids); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	unread, err := c.db.CountUnreadNotifications(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, struct {
+		UnreadCount int `json:"unread_count"`
+	}{UnreadCount: unread})
+}
@@ -0,0 +1,109 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sebito91/bootdotdev/go/chirpy/admin"
+	"github.com/sebito91/bootdotdev/go/chirpy/api"
+	"github.com/sebito91/bootdotdev/go/chirpy/config"
+)
+
+// TestOpenAPICoversRoutes fails when a route registered on the /api or /admin router is missing from the
+// OpenAPI document served at /api/openapi.json, or when the document describes a route that does not exist
+func TestOpenAPICoversRoutes(t *testing.T) {
+	cfg := config.Default()
+	cfg.DBPath = filepath.Join(t.TempDir(), "database.json")
+	cfg.JWTSecret = "test"
+	cfg.PolkaAPIKey = "test"
+
+	apiCfg, err := api.NewConfig(cfg)
+	if err != nil {
+		t.Fatalf("could not create API config: %s", err)
+	}
+
+	t.Cleanup(func() {
+		if err := apiCfg.Close(); err != nil {
+			t.Errorf("could not close API config: %s", err)
+		}
+	})
+
+	adminCfg, err := admin.NewConfig(apiCfg, "test")
+	if err != nil {
+		t.Fatalf("could not create admin config: %s", err)
+	}
+
+	apiRouter := apiCfg.GetAPI()
+
+	rec := httptest.NewRecorder()
+	apiRouter.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from /openapi.json, got %d", rec.Code)
+	}
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("could not decode OpenAPI document: %s", err)
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range spec.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	registered := make(map[string]bool)
+	for prefix, router := range map[string]chi.Router{"/api": apiRouter, "/admin": adminCfg.GetAdminAPI()} {
+		err := chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			// sub-routers report their index route with a trailing slash, which chi also serves without it
+			route = strings.ReplaceAll(route, "/*/", "/")
+			if route != "/" {
+				route = strings.TrimSuffix(route, "/")
+			}
+
+			registered[method+" "+prefix+route] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("could not walk %s routes: %s", prefix, err)
+		}
+	}
+
+	var missing, unknown []string
+	for route := range registered {
+		if !documented[route] {
+			missing = append(missing, route)
+		}
+	}
+
+	for route := range documented {
+		if !registered[route] {
+			unknown = append(unknown, route)
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(unknown)
+
+	for _, route := range missing {
+		t.Errorf("route %s is registered but missing from api/openapi.json", route)
+	}
+
+	for _, route := range unknown {
+		t.Errorf("api/openapi.json documents %s, which is not registered", route)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pathID parses the named path parameter as a positive ID
+func pathID(r *http.Request, name string) (int, *errorBody) {
+	id, err := strconv.Atoi(chi.URLParam(r, name))
+	if err != nil || id <= 0 {
+		return -1, invalidIDError(name, chi.URLParam(r, name))
+	}
+
+	return id, nil
+}
+
+// parsePage is a helper function to parse the before_id and limit query parameters of a list sorted by
+// descending ID; beforeID is zero for the first page
+func parsePage(r *http.Request, defaultLimit, maxLimit int) (beforeID, limit int, errBody *errorBody) {
+	if param := r.URL.Query().Get("before_id"); param != "" {
+		var err error
+		if beforeID, err = strconv.Atoi(param); err != nil || beforeID <= 0 {
+			return 0, 0, invalidIDError("before_id", param)
+		}
+	}
+
+	limit = defaultLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 || limit > maxLimit {
+			return 0, 0, &errorBody{
+				Error:     fmt.Sprintf("expected limit between 1 and %d, got %q", maxLimit, param),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+		}
+	}
+
+	return beforeID, limit, nil
+}
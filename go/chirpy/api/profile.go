@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+)
+
+const maxDisplayNameLength = 50
+const maxBioLength = 160
+const maxAvatarURLLength = 2048
+
+// handleRegex restricts handles to 3-30 letters, digits or underscores
+var handleRegex = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// patchUser applies a partial update to the authenticated user's account and profile. Only the fields
+// present in the request body are changed; an empty string clears an optional profile field. Changing the
+// email address or password requires the current password in `current_password`.
+func (c *Config) patchUser(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		CurrentPassword string  `json:"current_password"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		Handle          *string `json:"handle"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarURL       *string `json:"avatar_url"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if err := validateProfile(bodyChk.Handle, bodyChk.DisplayName, bodyChk.Bio, bodyChk.AvatarURL); err != nil {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if bodyChk.Email != nil && *bodyChk.Email == "" {
+		errBody := errorBody{
+			Error:     "email cannot be empty",
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	user, err := c.db.GetUserFullByID(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	update := database.UserUpdate{
+		Email:       bodyChk.Email,
+		Handle:      bodyChk.Handle,
+		DisplayName: bodyChk.DisplayName,
+		Bio:         bodyChk.Bio,
+		AvatarURL:   bodyChk.AvatarURL,
+	}
+
+	if bodyChk.Email != nil || bodyChk.Password != nil {
+		if errBody := c.verifyCurrentPassword(bodyChk.CurrentPassword, user); errBody != nil {
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+	}
+
+	if bodyChk.Password != nil {
+		if err := c.passwords.Validate(*bodyChk.Password); err != nil {
+			errBody := errorBody{
+				Error:     fmt.Sprintf("%s", err),
+				Code:      codeValidationFailed,
+				errorCode: http.StatusBadRequest,
+			}
+
+			errBody.writeErrorToPage(w, r)
+			return
+		}
+
+		passHash, err := c.passwords.Hash(*bodyChk.Password)
+		if err != nil {
+			internalError(fmt.Errorf("could not hash password: %s", err)).writeErrorToPage(w, r)
+			return
+		}
+
+		update.PasswordHash = passHash
+	}
+
+	updatedUser, err := c.db.PatchUser(r.Context(), id, update)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, updatedUser)
+}
+
+// verifyCurrentPassword checks the current password that must accompany a change of email or password, so
+// that a stolen access token is not enough to take over the account
+func (c *Config) verifyCurrentPassword(password string, user database.UserWithPassword) *errorBody {
+	if match, _, err := c.passwords.Verify(password, user.PasswordHash); err != nil || !match {
+		return &errorBody{
+			Error:     "changing email or password requires the current password",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	return nil
+}
+
+// validateProfile checks the optional profile fields of a partial update; nil fields are skipped and an
+// empty string is always accepted since it clears the field
+func validateProfile(handle, displayName, bio, avatarURL *string) error {
+	if handle != nil && *handle != "" && !handleRegex.MatchString(*handle) {
+		return fmt.Errorf("handle must be 3-30 letters, digits or underscores, got %s", *handle)
+	}
+
+	if displayName != nil && utf8.RuneCountInString(*displayName) > maxDisplayNameLength {
+		return fmt.Errorf("display_name must be at most %d characters", maxDisplayNameLength)
+	}
+
+	if bio != nil && utf8.RuneCountInString(*bio) > maxBioLength {
+		return fmt.Errorf("bio must be at most %d characters", maxBioLength)
+	}
+
+	if avatarURL != nil && *avatarURL != "" {
+		if len(*avatarURL) > maxAvatarURLLength {
+			return fmt.Errorf("avatar_url must be at most %d characters", maxAvatarURLLength)
+		}
+
+		u, err := url.Parse(*avatarURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("avatar_url must be an absolute http(s) URL, got %s", *avatarURL)
+		}
+	}
+
+	return nil
+}
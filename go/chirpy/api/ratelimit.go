@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/config"
+)
+
+// route groups that carry their own rate limit
+const (
+	rateLimitAuth    = "auth"
+	rateLimitWrite   = "write"
+	rateLimitDefault = "default"
+)
+
+// rateLimitIdleTimeout is how long a bucket may go unused before it is dropped from memory
+const rateLimitIdleTimeout = 10 * time.Minute
+
+// tokenBucket is the state kept for a single client within a route group
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps the token buckets for every client of a single route group
+type rateLimiter struct {
+	policy    config.RateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mux       sync.Mutex
+}
+
+// newRateLimiter returns a rateLimiter for the given policy
+func newRateLimiter(policy config.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		policy:    policy,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket for the given key if one is available. It returns the limit for the
+// key, the tokens remaining afterwards and how long until the bucket is full (or, when denied, until the
+// next token is available).
+func (rl *rateLimiter) allow(key string, isChirpyRed bool) (bool, int, int, time.Duration) {
+	perMinute, burst := rl.policy.PerMinute, rl.policy.Burst
+	if isChirpyRed {
+		perMinute, burst = rl.policy.RedPerMinute, rl.policy.RedBurst
+	}
+
+	ratePerSecond := float64(perMinute) / 60
+
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for k, b := range rl.buckets {
+			if now.Sub(b.updated) > rateLimitIdleTimeout {
+				delete(rl.buckets, k)
+			}
+		}
+
+		rl.lastSweep = now
+	}
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*ratePerSecond)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / ratePerSecond * float64(time.Second))
+		return false, burst, 0, wait
+	}
+
+	bucket.tokens--
+	untilFull := time.Duration((float64(burst) - bucket.tokens) / ratePerSecond * float64(time.Second))
+	return true, burst, int(bucket.tokens), untilFull
+}
+
+// rateLimitClient is the client a request is rate limited as, resolved once per request and kept in the
+// request context for the nested route group limiters
+type rateLimitClient struct {
+	key         string
+	isChirpyRed bool
+}
+
+// rateLimitClientKey is the context key of the request's rateLimitClient
+type rateLimitClientKey struct{}
+
+// rateLimitUsers remembers what authenticating a client taught us about it, so that the rate limiter can
+// tell who a token belongs to, and whether they are Chirpy Red, without reading the database
+type rateLimitUsers struct {
+	pats      map[string]int
+	chirpyRed map[int]bool
+	mux       sync.RWMutex
+}
+
+// newRateLimitUsers returns an empty rateLimitUsers
+func newRateLimitUsers() *rateLimitUsers {
+	return &rateLimitUsers{
+		pats:      make(map[string]int),
+		chirpyRed: make(map[int]bool),
+	}
+}
+
+// rememberPAT records the owner of a personal access token that was just validated, keyed by its hash
+func (ru *rateLimitUsers) rememberPAT(hash string, userID int) {
+	ru.mux.Lock()
+	defer ru.mux.Unlock()
+
+	ru.pats[hash] = userID
+}
+
+// forgetPAT drops a personal access token that failed validation
+func (ru *rateLimitUsers) forgetPAT(hash string) {
+	ru.mux.Lock()
+	defer ru.mux.Unlock()
+
+	delete(ru.pats, hash)
+}
+
+// setChirpyRed records the Chirpy Red status of a user, as last loaded from the database
+func (ru *rateLimitUsers) setChirpyRed(userID int, isChirpyRed bool) {
+	ru.mux.Lock()
+	defer ru.mux.Unlock()
+
+	ru.chirpyRed[userID] = isChirpyRed
+}
+
+// lookup returns the owner of the personal access token with the given hash, if it was validated before
+func (ru *rateLimitUsers) lookup(hash string) (int, bool) {
+	ru.mux.RLock()
+	defer ru.mux.RUnlock()
+
+	userID, ok := ru.pats[hash]
+	return userID, ok
+}
+
+// isChirpyRed reports whether the user was Chirpy Red when last seen
+func (ru *rateLimitUsers) isChirpyRed(userID int) bool {
+	ru.mux.RLock()
+	defer ru.mux.RUnlock()
+
+	return ru.chirpyRed[userID]
+}
+
+// rateLimitKey identifies the client for rate limiting from its token alone: the subject of a validly
+// signed access token, or the owner of a personal access token that passed validation earlier. Any other
+// request is limited by client IP address, so made-up tokens cannot be used to get a fresh bucket.
+func (c *Config) rateLimitKey(r *http.Request) (string, bool) {
+	bearer, err := fetchToken(r)
+	if err != nil {
+		return "ip:" + clientIP(r), false
+	}
+
+	userID := -1
+	if strings.HasPrefix(bearer, patPrefix) {
+		if id, ok := c.rateLimitUsers.lookup(hashPAT(bearer)); ok {
+			userID = id
+		}
+	} else if claims, errBody := c.fetchClaims(r); errBody == nil && claims.Issuer == chirpyAccess {
+		if id, err := strconv.Atoi(claims.Subject); err == nil {
+			userID = id
+		}
+	}
+
+	if userID < 0 {
+		return "ip:" + clientIP(r), false
+	}
+
+	return fmt.Sprintf("user:%d", userID), c.rateLimitUsers.isChirpyRed(userID)
+}
+
+// middlewareRateLimit returns a middleware that enforces the rate limit for the given route group. Every
+// response carries the RateLimit-* headers, and requests over the limit get a 429 with Retry-After.
+func (c *Config) middlewareRateLimit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter, ok := c.rateLimiters[group]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client, ok := r.Context().Value(rateLimitClientKey{}).(rateLimitClient)
+			if !ok {
+				client.key, client.isChirpyRed = c.rateLimitKey(r)
+				r = r.WithContext(context.WithValue(r.Context(), rateLimitClientKey{}, client))
+			}
+
+			allowed, limit, remaining, reset := limiter.allow(client.key, client.isChirpyRed)
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+				errBody := errorBody{
+					Error:     fmt.Sprintf("rate limit exceeded, retry in %d seconds", int(math.Ceil(reset.Seconds()))),
+					Code:      codeRateLimited,
+					errorCode: http.StatusTooManyRequests,
+				}
+
+				errBody.writeErrorToPage(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -2,22 +2,49 @@ package api
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+
+	"github.com/sebito91/bootdotdev/go/logging"
 )
 
-// writeErrorToPage is a helper function that reuses a JSON-posting for error messages
-func (e *errorBody) writeErrorToPage(w http.ResponseWriter) {
-	w.WriteHeader(e.errorCode)
+// writeErrorToPage is a helper function that writes the error as an application/problem+json document.
+// The error is logged with the request ID, route and user, and the underlying cause, if any, is only
+// logged here rather than sent to the client.
+func (e *errorBody) writeErrorToPage(w http.ResponseWriter, r *http.Request) {
+	e.Status = e.errorCode
+	e.Title = http.StatusText(e.errorCode)
+	e.Type = problemTypePrefix + string(e.Code)
+	e.Detail = e.Error
+	e.Instance = r.URL.Path
+
+	// every error is logged against its request; server errors at a higher level than client errors
+	level := slog.LevelWarn
+	if e.errorCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	attrs := append(logging.RequestAttrs(r),
+		slog.Int("status", e.errorCode),
+		slog.String("code", string(e.Code)),
+		slog.String("detail", e.Error))
+	if e.cause != nil {
+		attrs = append(attrs, slog.String("cause", e.cause.Error()))
+	}
+
+	slog.LogAttrs(r.Context(), level, "request failed", attrs...)
+
 	dat, datErr := json.Marshal(e)
 	if datErr != nil {
-		log.Printf("Error marshaling error JSON: %s", datErr)
+		slog.Error("could not marshal error JSON", "error", datErr)
+		w.WriteHeader(e.errorCode)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(e.errorCode)
 	if _, wErr := w.Write(dat); wErr != nil {
-		log.Printf("Error writing error JSON to page: %s", wErr)
+		slog.Error("could not write error JSON to page", "error", wErr)
 		return
 	}
 }
@@ -26,14 +53,14 @@ func (e *errorBody) writeErrorToPage(w http.ResponseWriter) {
 func writeSuccessToPage(w http.ResponseWriter, statusCode int, payload interface{}) {
 	dat, datErr := json.Marshal(payload)
 	if datErr != nil {
-		log.Printf("Error marshaling success JSON: %s", datErr)
+		slog.Error("could not marshal success JSON", "error", datErr)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	if _, wErr := w.Write(dat); wErr != nil {
-		log.Printf("Error writing success JSON to page: %s", wErr)
+		slog.Error("could not write success JSON to page", "error", wErr)
 		return
 	}
 }
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// clientIP is a helper function to extract the remote IP address of the client from the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// getSessions will list all of the active sessions (i.e. unrevoked refresh tokens) for the authenticated user.
+// The session that the access token was issued from is flagged as the current one.
+func (c *Config) getSessions(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	sessions, err := c.db.GetActiveSessionsByUserID(r.Context(), id)
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	// the claims were already validated by fetchUserID, so we only need the token ID here
+	currentID := -1
+	if claims, errBody := c.fetchClaims(r); errBody == nil {
+		if sessionID, err := strconv.Atoi(claims.ID); err == nil {
+			currentID = sessionID
+		}
+	}
+
+	type sessionView struct {
+		ID         int       `json:"id"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		UserAgent  string    `json:"user_agent"`
+		IP         string    `json:"ip"`
+		Current    bool      `json:"current"`
+	}
+
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			Current:    session.ID == currentID,
+		})
+	}
+
+	writeSuccessToPage(w, http.StatusOK, views)
+}
+
+// deleteSessionByID will revoke a single session belonging to the authenticated user; its refresh token
+// can no longer be used to mint access tokens, and the access tokens already issued from it stop working.
+func (c *Config) deleteSessionByID(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	sessionID, errBody := pathID(r, "sessionID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	session, err := c.db.GetSessionByID(r.Context(), sessionID)
+	if err != nil || session.UserID != id || session.RevokedAt != nil {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("could not find active sessionID %d", sessionID),
+			Code:      codeNotFound,
+			errorCode: http.StatusNotFound,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.RevokeSession(r.Context(), session.ID); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// deleteSessions will revoke every session belonging to the authenticated user, logging them out everywhere
+func (c *Config) deleteSessions(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.RevokeSessionsByUserID(r.Context(), id); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
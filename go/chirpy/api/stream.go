@@ -0,0 +1,470 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/cors"
+)
+
+// the events published on the chirp stream; hiding a chirp is published as a deletion and unhiding it as
+// a creation, since that is what the subscribers can observe
+const (
+	streamEventCreated = "chirp.created"
+	streamEventDeleted = "chirp.deleted"
+	// streamEventReset tells a resuming subscriber that events were missed and it has to refetch
+	streamEventReset = "stream.reset"
+	// streamEventLagged is the last event sent to a subscriber dropped for falling behind
+	streamEventLagged = "stream.lagged"
+)
+
+const (
+	// streamHistorySize is the least number of past events kept to resume from
+	streamHistorySize = 1024
+	// streamBufferSize is how many events a subscriber may fall behind before it is dropped
+	streamBufferSize = 64
+	// streamMaxSubscribers caps the number of open streams
+	streamMaxSubscribers = 1024
+	// streamHeartbeat is how often an idle stream is pinged, so that proxies keep it open
+	streamHeartbeat = 15 * time.Second
+	// streamRetry is the reconnection delay suggested to EventSource clients
+	streamRetry = 3 * time.Second
+)
+
+var (
+	errStreamClosed = errors.New("the chirp stream is shutting down")
+	errStreamFull   = errors.New("too many open chirp streams")
+)
+
+// streamChirp is the chirp sent with an event; deletions leave out the body
+type streamChirp struct {
+	ID       int    `json:"id"`
+	AuthorID int    `json:"author_id"`
+	Body     string `json:"body,omitempty"`
+}
+
+// streamEvent is a single change to the public chirps
+type streamEvent struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	Chirp streamChirp `json:"chirp"`
+}
+
+// streamFilter selects the events sent to a subscriber
+type streamFilter struct {
+	authorIDs map[int]bool
+}
+
+// match reports whether the subscriber wants the event
+func (f streamFilter) match(event streamEvent) bool {
+	return len(f.authorIDs) == 0 || f.authorIDs[event.Chirp.AuthorID]
+}
+
+// streamSubscriber receives the matching events on a bounded channel, which the hub closes when it drops
+// the subscriber
+type streamSubscriber struct {
+	filter streamFilter
+	events chan streamEvent
+	// lagged is set by the hub before closing events if the subscriber could not keep up
+	lagged bool
+}
+
+// chirpHub fans the chirp events out to the open streams and keeps a window of recent events for
+// subscribers resuming with Last-Event-ID. Publishing never blocks: a subscriber whose buffer is full is
+// dropped and has to resume.
+type chirpHub struct {
+	mux         sync.Mutex
+	lastID      uint64
+	history     []streamEvent
+	subscribers map[*streamSubscriber]struct{}
+	closed      bool
+}
+
+// newChirpHub returns an empty hub. Event IDs start at the current time in microseconds so that they keep
+// increasing across restarts, and an ID from before a restart is recognized as too old to resume from.
+func newChirpHub() *chirpHub {
+	return &chirpHub{
+		lastID:      uint64(time.Now().UnixMicro()),
+		subscribers: make(map[*streamSubscriber]struct{}),
+	}
+}
+
+// publish sends the event to every matching subscriber
+func (h *chirpHub) publish(eventType string, chirp database.Chirp) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.lastID++
+	event := streamEvent{
+		ID:    h.lastID,
+		Type:  eventType,
+		Chirp: streamChirp{ID: chirp.ID, AuthorID: chirp.AuthorID},
+	}
+
+	if eventType == streamEventCreated {
+		event.Chirp.Body = chirp.Body
+	}
+
+	// keep between streamHistorySize and twice that many events, rather than shifting on every publish
+	h.history = append(h.history, event)
+	if len(h.history) >= 2*streamHistorySize {
+		h.history = append([]streamEvent(nil), h.history[len(h.history)-streamHistorySize:]...)
+	}
+
+	for sub := range h.subscribers {
+		if !sub.filter.match(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.lagged = true
+			h.remove(sub)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the matching events published after lastEventID, if any.
+// complete is false if some of those events are no longer kept, in which case none are returned.
+func (h *chirpHub) subscribe(lastEventID uint64, filter streamFilter) (sub *streamSubscriber, replay []streamEvent, complete bool, err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		return nil, nil, false, errStreamClosed
+	}
+
+	if len(h.subscribers) >= streamMaxSubscribers {
+		return nil, nil, false, errStreamFull
+	}
+
+	// the IDs in the history are consecutive, ending at lastID
+	complete = true
+	if lastEventID != 0 {
+		oldest := h.lastID - uint64(len(h.history)) + 1
+		complete = lastEventID+1 >= oldest && lastEventID <= h.lastID
+	}
+
+	if lastEventID != 0 && complete {
+		for _, event := range h.history {
+			if event.ID > lastEventID && filter.match(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	sub = &streamSubscriber{filter: filter, events: make(chan streamEvent, streamBufferSize)}
+	h.subscribers[sub] = struct{}{}
+
+	return sub, replay, complete, nil
+}
+
+// unsubscribe drops the subscriber, if the hub hasn't already
+func (h *chirpHub) unsubscribe(sub *streamSubscriber) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.remove(sub)
+}
+
+// remove drops the subscriber and closes its channel; h.mux must be held
+func (h *chirpHub) remove(sub *streamSubscriber) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// close ends every open stream and refuses new ones, so that the server can shut down without waiting
+// for streams that never finish on their own
+func (h *chirpHub) close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+}
+
+// parseStream reads the filter and the ID of the last event seen from the request. EventSource sends the
+// latter as Last-Event-ID when it reconnects; last_event_id is accepted for the first connection and for
+// WebSockets.
+func parseStream(r *http.Request) (streamFilter, uint64, *errorBody) {
+	filter := streamFilter{}
+	for _, param := range r.URL.Query()["author_id"] {
+		for _, value := range strings.Split(param, ",") {
+			authorID, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || authorID <= 0 {
+				return streamFilter{}, 0, invalidIDError("author_id", value)
+			}
+
+			if filter.authorIDs == nil {
+				filter.authorIDs = make(map[int]bool)
+			}
+
+			filter.authorIDs[authorID] = true
+		}
+	}
+
+	lastEventIDParam := r.Header.Get("Last-Event-ID")
+	if lastEventIDParam == "" {
+		lastEventIDParam = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastEventID uint64
+	if lastEventIDParam != "" {
+		var err error
+		if lastEventID, err = strconv.ParseUint(lastEventIDParam, 10, 64); err != nil {
+			return streamFilter{}, 0, invalidIDError("last_event_id", lastEventIDParam)
+		}
+	}
+
+	return filter, lastEventID, nil
+}
+
+// subscribeStream parses the request and subscribes to the hub, reporting any problem to the client. The
+// caller must unsubscribe once done.
+func (c *Config) subscribeStream(w http.ResponseWriter, r *http.Request) (*streamSubscriber, []streamEvent, bool, bool) {
+	if errBody := c.requirePATScope(r, scopeChirpsRead); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return nil, nil, false, false
+	}
+
+	filter, lastEventID, errBody := parseStream(r)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return nil, nil, false, false
+	}
+
+	sub, replay, complete, err := c.stream.subscribe(lastEventID, filter)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(streamRetry.Seconds())))
+		errBody := errorBody{
+			Error:     err.Error(),
+			Code:      codeUnavailable,
+			errorCode: http.StatusServiceUnavailable,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return nil, nil, false, false
+	}
+
+	return sub, replay, complete, true
+}
+
+// streamChirps sends the chirp events as Server-Sent Events until the client goes away
+func (c *Config) streamChirps(w http.ResponseWriter, r *http.Request) {
+	sub, replay, complete, ok := c.subscribeStream(w, r)
+	if !ok {
+		return
+	}
+	defer c.stream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// ask nginx and the like not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(format string, args ...any) bool {
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+
+		if err := rc.Flush(); err != nil {
+			slog.Warn("could not flush the chirp stream", "error", err)
+			return false
+		}
+
+		return true
+	}
+
+	sendEvent := func(event streamEvent) bool {
+		dat, err := json.Marshal(event.Chirp)
+		if err != nil {
+			slog.Error("could not marshal chirp event JSON", "error", err)
+			return false
+		}
+
+		return send("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, dat)
+	}
+
+	if !send("retry: %d\n\n", streamRetry.Milliseconds()) {
+		return
+	}
+
+	if !complete && !send("event: %s\ndata: {}\n\n", streamEventReset) {
+		return
+	}
+
+	for _, event := range replay {
+		if !sendEvent(event) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if !send(": ping\n\n") {
+				return
+			}
+		case event, ok := <-sub.events:
+			if !ok {
+				if sub.lagged {
+					send("event: %s\ndata: {}\n\n", streamEventLagged)
+				}
+
+				return
+			}
+
+			if !sendEvent(event) {
+				return
+			}
+		}
+	}
+}
+
+// streamWebSocketMessage is a message sent over the chirp WebSocket; Chirp is unset for the stream.*
+// events
+type streamWebSocketMessage struct {
+	ID    uint64       `json:"id,omitempty"`
+	Type  string       `json:"type"`
+	Chirp *streamChirp `json:"chirp,omitempty"`
+}
+
+// newStreamUpgrader returns the WebSocket upgrader for the chirp stream. Browsers don't preflight
+// WebSocket upgrades, so the origin is checked here against the API's CORS policy.
+func newStreamUpgrader(policy cors.Policy) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+
+			if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+
+			return policy.AllowsOrigin(origin)
+		},
+	}
+}
+
+// hijackableWriter implements http.Hijacker for the WebSocket upgrader, which asserts the interface
+// directly, while the middleware wrapping the response writer only offers it through Unwrap
+type hijackableWriter struct {
+	http.ResponseWriter
+}
+
+// Hijack takes over the connection through the first writer in the chain that supports it
+func (hw hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(hw.ResponseWriter).Hijack()
+}
+
+// streamChirpsWebSocket sends the chirp events over a WebSocket until either side closes it. Messages
+// from the client are read, so that pings and the close handshake are handled, and otherwise ignored.
+func (c *Config) streamChirpsWebSocket(w http.ResponseWriter, r *http.Request) {
+	sub, replay, complete, ok := c.subscribeStream(w, r)
+	if !ok {
+		return
+	}
+	defer c.stream.unsubscribe(sub)
+
+	// the upgrader writes its own error response
+	conn, err := c.streamUpgrader.Upgrade(hijackableWriter{w}, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// reading is needed to notice the client going away; it ends the stream by unsubscribing
+	conn.SetReadLimit(1024)
+	go func() {
+		defer c.stream.unsubscribe(sub)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(msg streamWebSocketMessage) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamHeartbeat))
+		return conn.WriteJSON(msg) == nil
+	}
+
+	writeEvent := func(event streamEvent) bool {
+		return write(streamWebSocketMessage{ID: event.ID, Type: event.Type, Chirp: &event.Chirp})
+	}
+
+	closeWith := func(code int, reason string) {
+		deadline := time.Now().Add(time.Second)
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	}
+
+	if !complete && !write(streamWebSocketMessage{Type: streamEventReset}) {
+		return
+	}
+
+	for _, event := range replay {
+		if !writeEvent(event) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamHeartbeat)); err != nil {
+				return
+			}
+		case event, ok := <-sub.events:
+			if !ok {
+				switch {
+				case sub.lagged:
+					write(streamWebSocketMessage{Type: streamEventLagged})
+					closeWith(websocket.CloseTryAgainLater, "subscriber fell behind, resume with last_event_id")
+				default:
+					closeWith(websocket.CloseGoingAway, "")
+				}
+
+				return
+			}
+
+			if !writeEvent(event) {
+				return
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -8,19 +10,29 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/logging"
 )
 
 const chirpyAccess = "chirpy-access"
 const chirpyRefresh = "chirpy-refresh"
+const chirpyChallenge = "chirpy-2fa-challenge"
 
-// generateJWT is a helper function to generate a JWT based on the ID of the user and an expiration timeout (in seconds)
-func (c *Config) generateJWT(issuer string, expiresInSeconds, id int) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.RegisteredClaims{
+// generateJWT is a helper function to generate a JWT based on the ID of the user and an expiration timeout.
+// If sessionID is non-zero it is embedded as the token ID so the token can be tied back to its session.
+func (c *Config) generateJWT(issuer string, expiresIn time.Duration, id, sessionID int) (string, error) {
+	claims := &jwt.RegisteredClaims{
 		Issuer:    issuer,
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Second * time.Duration(expiresInSeconds))),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   fmt.Sprintf("%d", id),
-	})
+	}
+
+	if sessionID > 0 {
+		claims.ID = fmt.Sprintf("%d", sessionID)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	return token.SignedString([]byte(c.jwtSecret))
 }
@@ -62,6 +74,129 @@ func (c *Config) decodeJWT(bearer string) (*jwt.Token, error) {
 	return token, nil
 }
 
+// fetchUserID validates that the request carries a valid access token and returns the ID of the
+// authenticated user. Refresh and two-factor challenge tokens are rejected. Personal access tokens are
+// accepted only if they were granted the given scope; an empty scope means the endpoint is reserved for
+// interactive access tokens.
+func (c *Config) fetchUserID(r *http.Request, scope string) (int, *errorBody) {
+	bearer, err := fetchToken(r)
+	if err != nil {
+		return -1, &errorBody{
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	if strings.HasPrefix(bearer, patPrefix) {
+		id, errBody := c.fetchPATUserID(r.Context(), bearer, scope)
+		if errBody != nil {
+			return -1, errBody
+		}
+
+		if errBody := c.checkAccount(r.Context(), id); errBody != nil {
+			return -1, errBody
+		}
+
+		c.rateLimitUsers.rememberPAT(hashPAT(bearer), id)
+		logging.SetUser(r.Context(), strconv.Itoa(id))
+		return id, nil
+	}
+
+	claims, errBody := c.fetchClaims(r)
+	if errBody != nil {
+		return -1, errBody
+	}
+
+	if claims.Issuer != chirpyAccess {
+		return -1, &errorBody{
+			Error:     fmt.Sprintf("expected access token, got %s", claims.Issuer),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return -1, &errorBody{
+			Error:     "token subject is not a valid userID",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+			cause:     err,
+		}
+	}
+
+	if errBody := c.checkAccount(r.Context(), id); errBody != nil {
+		return -1, errBody
+	}
+
+	// an access token dies with its session, so that revoking a session logs the device out right away
+	if sessionID, err := strconv.Atoi(claims.ID); err == nil {
+		session, err := c.db.GetSessionByID(r.Context(), sessionID)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return -1, internalError(err)
+		} else if err != nil || session.RevokedAt != nil {
+			return -1, &errorBody{
+				Error:     fmt.Sprintf("session %d has been revoked, please log in again", sessionID),
+				Code:      codeTokenRevoked,
+				errorCode: http.StatusUnauthorized,
+			}
+		}
+	}
+
+	logging.SetUser(r.Context(), strconv.Itoa(id))
+	return id, nil
+}
+
+// checkAccount makes sure the given user still exists and is allowed to use the API. Tokens may outlive
+// their user if the account was deleted, and suspended or banned users are locked out until reinstated.
+func (c *Config) checkAccount(ctx context.Context, id int) *errorBody {
+	user, err := c.db.GetUserFullByID(ctx, id)
+	if errors.Is(err, database.ErrNotFound) {
+		return &errorBody{
+			Error:     fmt.Sprintf("userID %d no longer exists", id),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+	} else if err != nil {
+		return internalError(err)
+	}
+
+	c.rateLimitUsers.setChirpyRed(id, user.IsChirpyRed)
+
+	moderation := user.Moderation
+	switch moderation.EffectiveStatus(time.Now().UTC()) {
+	case database.StatusBanned:
+		return &errorBody{
+			Error:     fmt.Sprintf("userID %d has been banned%s", id, reasonSuffix(moderation.Reason)),
+			Code:      codeAccountBanned,
+			errorCode: http.StatusForbidden,
+		}
+	case database.StatusSuspended:
+		until := ""
+		if moderation.SuspendedUntil != nil {
+			until = " until " + moderation.SuspendedUntil.Format(time.RFC3339)
+		}
+
+		return &errorBody{
+			Error:     fmt.Sprintf("userID %d is suspended%s%s", id, until, reasonSuffix(moderation.Reason)),
+			Code:      codeAccountSuspended,
+			errorCode: http.StatusForbidden,
+		}
+	}
+
+	return nil
+}
+
+// reasonSuffix formats the moderation reason, if any, for the end of an error message
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+
+	return ": " + reason
+}
+
 // revokeToken will take in a given refresh token from a user and record the token as revoked
 // within the database. Any subsequent use of the token will be blocked as Unauthorized.
 func (c *Config) revokeToken(w http.ResponseWriter, r *http.Request) {
@@ -69,67 +204,66 @@ func (c *Config) revokeToken(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errBody := errorBody{
 			Error:     fmt.Sprintf("%s", err),
+			Code:      codeUnauthenticated,
 			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	if err := c.db.RevokeToken(bearer); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
+	// the token may not be valid anymore, but if it is we can tie it back to its user and session
+	userID, sessionID := 0, 0
+	if claims, errBody := c.fetchClaims(r); errBody == nil {
+		if subject, err := strconv.Atoi(claims.Subject); err == nil {
+			userID = subject
 		}
 
-		errBody.writeErrorToPage(w)
+		if id, err := strconv.Atoi(claims.ID); err == nil {
+			sessionID = id
+		}
+	}
+
+	if err := c.db.RevokeToken(r.Context(), bearer, userID); err != nil {
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
+	// if the token is tied to a session, end the session as well
+	if sessionID > 0 {
+		if err := c.db.RevokeSession(r.Context(), sessionID); err != nil && !errors.Is(err, database.ErrNotFound) {
+			internalError(err).writeErrorToPage(w, r)
+			return
+		}
+	}
+
 	writeSuccessToPage(w, http.StatusOK, nil)
 }
 
 // refreshToken will take in a refresh token from a given user, ensure it is valid, and output a new
-// access token valid for one hour. We must ensure that the refresh token is not revoked and that it
-// is still for a valid user.
+// access token valid for one hour. We must ensure that the refresh token is not revoked, that it
+// is still for a valid user and that the session it belongs to is still active.
 func (c *Config) refreshToken(w http.ResponseWriter, r *http.Request) {
-	claims, respCode, err := c.fetchClaims(r)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: respCode,
-		}
-
-		errBody.writeErrorToPage(w)
+	claims, errBody := c.fetchClaims(r)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	if issuer, iErr := claims.GetIssuer(); err != nil {
+	if claims.Issuer != chirpyRefresh {
 		errBody := errorBody{
-			Error:     fmt.Sprintf("could not fetch issuer from token: %s", iErr),
+			Error:     fmt.Sprintf("expected refresh token, got %s", claims.Issuer),
+			Code:      codeUnauthenticated,
 			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
-		return
-	} else if issuer != chirpyRefresh {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("expected refresh token, got %s", issuer),
-			errorCode: http.StatusUnauthorized,
-		}
-
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	revokedTokens, err := c.db.GetRevokedTokens()
+	revokedTokens, err := c.db.GetRevokedTokens(r.Context())
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
@@ -137,10 +271,11 @@ func (c *Config) refreshToken(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errBody := errorBody{
 			Error:     fmt.Sprintf("%s", err),
+			Code:      codeUnauthenticated,
 			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
@@ -148,45 +283,78 @@ func (c *Config) refreshToken(w http.ResponseWriter, r *http.Request) {
 		if bearer == revokedToken.Token {
 			errBody := errorBody{
 				Error:     fmt.Sprintf("provided refresh token was revoked at: %s", revokedToken.RevokedAt),
+				Code:      codeTokenRevoked,
 				errorCode: http.StatusUnauthorized,
 			}
 
-			errBody.writeErrorToPage(w)
+			errBody.writeErrorToPage(w, r)
 			return
 		}
 	}
 
 	// we passed the checks for revoked token, so let's generate a new 60m token
-	idString, err := claims.GetSubject()
+	id, err := strconv.Atoi(claims.Subject)
 	if err != nil {
 		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
+			Error:     "token subject is not a valid userID",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+			cause:     err,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	id, err := strconv.Atoi(idString)
+	sessionID, err := strconv.Atoi(claims.ID)
 	if err != nil {
 		errBody := errorBody{
-			Error:     fmt.Sprintf("could not convert userID to string: %s", err),
-			errorCode: http.StatusInternalServerError,
+			Error:     "refresh token is not tied to a session, please log in again",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	token, err := c.generateJWT(chirpyAccess, (60 * 60), id)
-	if err != nil {
+	session, err := c.db.GetSessionByID(r.Context(), sessionID)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	} else if err != nil || session.UserID != id {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("could not find session %d for userID %d", sessionID, id),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	} else if session.RevokedAt != nil {
 		errBody := errorBody{
-			Error:     fmt.Sprintf("token generate: %s", err),
-			errorCode: http.StatusInternalServerError,
+			Error:     fmt.Sprintf("session was revoked at: %s", session.RevokedAt),
+			Code:      codeTokenRevoked,
+			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if errBody := c.checkAccount(r.Context(), id); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.TouchSession(r.Context(), session.ID); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	token, err := c.generateJWT(chirpyAccess, c.accessTokenTTL, id, session.ID)
+	if err != nil {
+		internalError(fmt.Errorf("token generate: %s", err)).writeErrorToPage(w, r)
 		return
 	}
 
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// enrollTwoFactor generates a new TOTP secret for the authenticated user and returns it along with the
+// otpauth URI for authenticator apps. Two-factor auth is not switched on until the user confirms a code.
+func (c *Config) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	user, err := c.db.GetUserFullByID(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if user.TwoFactor.Enabled {
+		errBody := errorBody{
+			Error:     "two-factor authentication is already enabled, disable it before enrolling again",
+			Code:      codeConflict,
+			errorCode: http.StatusConflict,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		internalError(fmt.Errorf("could not generate TOTP secret: %s", err)).writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.UpdateUserTwoFactor(r.Context(), id, database.TwoFactor{Secret: secret}); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}{
+		Secret: secret, OTPAuthURI: totpURI(user.Email, secret)})
+}
+
+// confirmTwoFactor verifies a code against the pending TOTP secret and, if it matches, switches on
+// two-factor auth for the user. The recovery codes are returned once here and only stored hashed.
+func (c *Config) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	user, err := c.db.GetUserFullByID(r.Context(), id)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	if user.TwoFactor.Enabled {
+		errBody := errorBody{
+			Error:     "two-factor authentication is already enabled",
+			Code:      codeConflict,
+			errorCode: http.StatusConflict,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	} else if user.TwoFactor.Secret == "" {
+		errBody := errorBody{
+			Error:     "no pending two-factor enrollment, please enroll first",
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	step, ok := validateTOTP(user.TwoFactor.Secret, bodyChk.Code, user.TwoFactor.LastUsedStep)
+	if !ok {
+		errBody := errorBody{
+			Error:     "invalid two-factor code",
+			Code:      codeInvalidTwoFactor,
+			errorCode: http.StatusUnauthorized,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		internalError(fmt.Errorf("could not generate recovery codes: %s", err)).writeErrorToPage(w, r)
+		return
+	}
+
+	hashedCodes := make([][]byte, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			internalError(fmt.Errorf("could not hash recovery codes: %s", err)).writeErrorToPage(w, r)
+			return
+		}
+
+		hashedCodes = append(hashedCodes, hash)
+	}
+
+	twoFactor := database.TwoFactor{
+		Secret:        user.TwoFactor.Secret,
+		Enabled:       true,
+		LastUsedStep:  step,
+		RecoveryCodes: hashedCodes,
+	}
+
+	if err := c.db.UpdateUserTwoFactor(r.Context(), id, twoFactor); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: recoveryCodes})
+}
+
+// disableTwoFactor switches off two-factor auth for the authenticated user, which requires a valid
+// TOTP or recovery code
+func (c *Config) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if _, errBody := c.verifySecondFactor(r.Context(), id, bodyChk.Code); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if err := c.db.UpdateUserTwoFactor(r.Context(), id, database.TwoFactor{}); err != nil {
+		internalError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	writeSuccessToPage(w, http.StatusOK, nil)
+}
+
+// loginTwoFactor is the second step of the login flow for users with two-factor auth enabled. The
+// challenge token issued by loginUser is exchanged, along with a valid TOTP or recovery code, for
+// the usual access and refresh tokens.
+func (c *Config) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type bodyCheck struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	bodyChk := bodyCheck{}
+
+	// handle a decode error
+	if err := decoder.Decode(&bodyChk); err != nil {
+		invalidJSONError(err).writeErrorToPage(w, r)
+		return
+	}
+
+	claims, errBody := c.fetchClaims(r)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	if issuer, claimErr := claims.GetIssuer(); claimErr != nil {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("%s", claimErr),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	} else if issuer != chirpyChallenge {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("expected two-factor challenge token, got %s", issuer),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	idString, err := claims.GetSubject()
+	if err != nil {
+		errBody := errorBody{
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		internalError(fmt.Errorf("could not convert userID to string: %s", err)).writeErrorToPage(w, r)
+		return
+	}
+
+	user, errBody := c.verifySecondFactor(r.Context(), id, bodyChk.Code)
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
+
+	c.writeLoginTokens(w, r, user)
+}
+
+// verifySecondFactor checks the provided code against the user's TOTP secret, falling back to their
+// recovery codes. A matching TOTP step is recorded to block replays, and a matching recovery code is
+// consumed so that it cannot be used again.
+func (c *Config) verifySecondFactor(ctx context.Context, userID int, code string) (database.User, *errorBody) {
+	user, err := c.db.GetUserFullByID(ctx, userID)
+	if err != nil {
+		return database.User{}, databaseError(err)
+	}
+
+	twoFactor := user.TwoFactor
+	if !twoFactor.Enabled {
+		return database.User{}, &errorBody{
+			Error:     fmt.Sprintf("two-factor authentication is not enabled for userID %d", userID),
+			Code:      codeValidationFailed,
+			errorCode: http.StatusBadRequest,
+		}
+	}
+
+	if step, ok := validateTOTP(twoFactor.Secret, code, twoFactor.LastUsedStep); ok {
+		if err := c.db.ConsumeSecondFactor(ctx, userID, step, nil); err != nil {
+			return database.User{}, consumeSecondFactorError(err)
+		}
+
+		return user.User, nil
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, hash := range twoFactor.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) != nil {
+			continue
+		}
+
+		if err := c.db.ConsumeSecondFactor(ctx, userID, 0, hash); err != nil {
+			return database.User{}, consumeSecondFactorError(err)
+		}
+
+		return user.User, nil
+	}
+
+	return database.User{}, &errorBody{
+		Error:     "invalid two-factor code",
+		Code:      codeInvalidTwoFactor,
+		errorCode: http.StatusUnauthorized,
+	}
+}
+
+// consumeSecondFactorError reports a second factor that a concurrent login consumed first as an invalid
+// code, like any other replay
+func consumeSecondFactorError(err error) *errorBody {
+	if errors.Is(err, database.ErrAlreadyUsed) {
+		return &errorBody{
+			Error:     "two-factor code was already used",
+			Code:      codeInvalidTwoFactor,
+			errorCode: http.StatusUnauthorized,
+		}
+	}
+
+	return databaseError(err)
+}
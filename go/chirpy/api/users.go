@@ -3,24 +3,25 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
-	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/logging"
 )
 
 // getUsers will fetch all of the users stored within the database
 func (c *Config) getUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := c.db.GetUsers()
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
+	if errBody := c.requirePATScope(r, scopeUsersRead); errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
+	}
 
-		errBody.writeErrorToPage(w)
+	users, err := c.db.GetUsers(r.Context())
+	if err != nil {
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
@@ -41,140 +42,150 @@ func (c *Config) loginUser(w http.ResponseWriter, r *http.Request) {
 
 	// handle a decode error
 	if err := decoder.Decode(&bodyChk); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		invalidJSONError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	users, err := c.db.GetUsersFull()
+	users, err := c.db.GetUsersFull(r.Context())
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(err).writeErrorToPage(w, r)
 		return
 	}
 
 	if bodyChk.Email == "" || bodyChk.Password == "" {
 		errBody := errorBody{
 			Error:     "login expected valid user email adddress and password",
+			Code:      codeValidationFailed,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
+	known := false
 	for _, user := range users {
-		passErr := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(bodyChk.Password))
 		if user.Email == bodyChk.Email {
-			if passErr == nil {
-				// default token expiration is 1 hour -> 60 * 60
-				token, err := c.generateJWT(chirpyAccess, (60 * 60), user.ID)
-				if err != nil {
-					errBody := errorBody{
-						Error:     fmt.Sprintf("token generate: %s", err),
-						errorCode: http.StatusInternalServerError,
+			match, needsRehash, passErr := c.passwords.Verify(bodyChk.Password, user.PasswordHash)
+			if passErr != nil {
+				internalError(fmt.Errorf("could not verify password: %s", passErr)).writeErrorToPage(w, r)
+				return
+			}
+
+			if match {
+				// transparently upgrade legacy (bcrypt) or outdated hashes now that we know the password
+				if needsRehash {
+					passHash, err := c.passwords.Hash(bodyChk.Password)
+					if err == nil {
+						err = c.db.UpdateUserPasswordHash(r.Context(), user.ID, passHash)
 					}
 
-					errBody.writeErrorToPage(w)
-					return
+					if err != nil {
+						slog.LogAttrs(r.Context(), slog.LevelWarn, "could not upgrade password hash",
+							append(logging.RequestAttrs(r), slog.Int("user_id", user.ID), slog.String("error", err.Error()))...)
+					}
 				}
 
-				// refreshToken is 60-days -> 60 * 60 * 24 * 60
-				refreshToken, err := c.generateJWT(chirpyRefresh, (60 * 60 * 24 * 60), user.ID)
-				if err != nil {
-					errBody := errorBody{
-						Error:     fmt.Sprintf("refresh token generate: %s", err),
-						errorCode: http.StatusInternalServerError,
+				if user.TwoFactor.Enabled {
+					challengeToken, err := c.generateJWT(chirpyChallenge, c.challengeTokenTTL, user.ID, 0)
+					if err != nil {
+						internalError(fmt.Errorf("challenge token generate: %s", err)).writeErrorToPage(w, r)
+						return
 					}
 
-					errBody.writeErrorToPage(w)
+					writeSuccessToPage(w, http.StatusOK, struct {
+						ID                int    `json:"id"`
+						Email             string `json:"email"`
+						TwoFactorRequired bool   `json:"two_factor_required"`
+						ChallengeToken    string `json:"challenge_token"`
+					}{
+						ID: user.ID, Email: user.Email, TwoFactorRequired: true, ChallengeToken: challengeToken})
 					return
 				}
 
-				writeSuccessToPage(w, http.StatusOK, struct {
-					ID           int    `json:"id"`
-					Email        string `json:"email"`
-					IsChirpyRed  bool   `json:"is_chirpy_red"`
-					Token        string `json:"token"`
-					RefreshToken string `json:"refresh_token"`
-				}{
-					ID: user.ID, Email: user.Email, IsChirpyRed: user.IsChirpyRed, Token: token, RefreshToken: refreshToken})
+				c.writeLoginTokens(w, r, user.User)
 				return
 			}
 
-			errBody := errorBody{
-				Error:     fmt.Sprintf("could not authenticate user with email %s", bodyChk.Email),
-				errorCode: http.StatusUnauthorized,
-			}
-
-			errBody.writeErrorToPage(w)
-			return
+			known = true
+			break
 		}
 	}
 
+	// unknown emails get the same response as wrong passwords, after the same amount of hashing, so that
+	// accounts cannot be enumerated by either the response or its timing
+	if !known {
+		c.passwords.VerifyMissing(bodyChk.Password)
+	}
+
 	errBody := errorBody{
-		Error:     fmt.Sprintf("could not find user with email %s", bodyChk.Email),
-		errorCode: http.StatusNotFound,
+		Error:     fmt.Sprintf("could not authenticate user with email %s", bodyChk.Email),
+		Code:      codeInvalidCredentials,
+		errorCode: http.StatusUnauthorized,
 	}
 
-	errBody.writeErrorToPage(w)
+	errBody.writeErrorToPage(w, r)
 }
 
-// getUserByID will fetch the specific user with the provided userID from the database
-func (c *Config) getUserByID(w http.ResponseWriter, r *http.Request) {
-	users, err := c.db.GetUsers()
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
+// writeLoginTokens starts a new session for the given user, generates a fresh access and refresh token
+// pair tied to it and writes them to the page; this is the final step of every successful login
+func (c *Config) writeLoginTokens(w http.ResponseWriter, r *http.Request, user database.User) {
+	logging.SetUser(r.Context(), strconv.Itoa(user.ID))
 
-		errBody.writeErrorToPage(w)
+	// suspended and banned users can prove who they are but do not get a session
+	if errBody := c.checkAccount(r.Context(), user.ID); errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	session, err := c.db.CreateSession(r.Context(), user.ID, r.UserAgent(), clientIP(r))
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
+		internalError(fmt.Errorf("session create: %s", err)).writeErrorToPage(w, r)
+		return
+	}
 
-		errBody.writeErrorToPage(w)
+	token, err := c.generateJWT(chirpyAccess, c.accessTokenTTL, user.ID, session.ID)
+	if err != nil {
+		internalError(fmt.Errorf("token generate: %s", err)).writeErrorToPage(w, r)
 		return
 	}
 
-	if userID <= 0 {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("expected valid userID (>0), got %d", userID),
-			errorCode: http.StatusBadRequest,
-		}
+	refreshToken, err := c.generateJWT(chirpyRefresh, c.refreshTokenTTL, user.ID, session.ID)
+	if err != nil {
+		internalError(fmt.Errorf("refresh token generate: %s", err)).writeErrorToPage(w, r)
+		return
+	}
 
-		errBody.writeErrorToPage(w)
+	writeSuccessToPage(w, http.StatusOK, struct {
+		ID           int    `json:"id"`
+		Email        string `json:"email"`
+		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{
+		ID: user.ID, Email: user.Email, IsChirpyRed: user.IsChirpyRed, Token: token, RefreshToken: refreshToken})
+}
+
+// getUserByID will fetch the specific user with the provided userID from the database
+func (c *Config) getUserByID(w http.ResponseWriter, r *http.Request) {
+	if errBody := c.requirePATScope(r, scopeUsersRead); errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	for _, user := range users {
-		if user.ID == userID {
-			writeSuccessToPage(w, http.StatusOK, user)
-			return
-		}
+	userID, errBody := pathID(r, "userID")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
+		return
 	}
 
-	errBody := errorBody{
-		Error:     fmt.Sprintf("could not find userID %d", userID),
-		errorCode: http.StatusNotFound,
+	user, err := c.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
+		return
 	}
 
-	errBody.writeErrorToPage(w)
+	writeSuccessToPage(w, http.StatusOK, user)
 }
 
 // writeUser will persist the user to the database, if the user does not exist
@@ -188,46 +199,42 @@ func (c *Config) writeUser(w http.ResponseWriter, r *http.Request) {
 	bodyChk := bodyCheck{}
 
 	// handle a decode error
-
 	if err := decoder.Decode(&bodyChk); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		invalidJSONError(err).writeErrorToPage(w, r)
 		return
 	}
 
 	if bodyChk.Email == "" || bodyChk.Password == "" {
 		errBody := errorBody{
 			Error:     "system requires both a valid email and password",
+			Code:      codeValidationFailed,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(bodyChk.Password), bcrypt.DefaultCost)
-	if err != nil {
+	if err := c.passwords.Validate(bodyChk.Password); err != nil {
 		errBody := errorBody{
-			Error:     "could not encode password, please send valid string",
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeValidationFailed,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	user, err := c.db.CreateUser(bodyChk.Email, passHash)
+	passHash, err := c.passwords.Hash(bodyChk.Password)
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
+		internalError(fmt.Errorf("could not hash password: %s", err)).writeErrorToPage(w, r)
+		return
+	}
 
-		errBody.writeErrorToPage(w)
+	user, err := c.db.CreateUser(r.Context(), bodyChk.Email, passHash)
+	if err != nil {
+		databaseError(err).writeErrorToPage(w, r)
 		return
 	}
 
@@ -235,127 +242,104 @@ func (c *Config) writeUser(w http.ResponseWriter, r *http.Request) {
 }
 
 // fetchClaims helps to fetch out and validate the JWT token and claims from the request
-func (c *Config) fetchClaims(r *http.Request) (*jwt.RegisteredClaims, int, error) {
+func (c *Config) fetchClaims(r *http.Request) (*jwt.RegisteredClaims, *errorBody) {
 	bearer, err := fetchToken(r)
 	if err != nil {
-		return nil, http.StatusUnauthorized, err
+		return nil, &errorBody{
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
 	}
 
 	token, err := c.decodeJWT(bearer)
 	if err != nil {
-		return nil, http.StatusUnauthorized, err
+		return nil, &errorBody{
+			Error:     "invalid or expired token",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+			cause:     err,
+		}
 	}
 
 	claims, ok := token.Claims.(*jwt.RegisteredClaims)
 	if !ok {
-		return nil, http.StatusBadRequest, fmt.Errorf("unknown claims type in JWT")
+		return nil, &errorBody{
+			Error:     "unknown claims type in JWT",
+			Code:      codeUnauthenticated,
+			errorCode: http.StatusUnauthorized,
+		}
 	}
 
-	return claims, http.StatusOK, nil
+	return claims, nil
 }
 
-// updateUser requires a JWT token to update the email address associated with a given user ID
+// updateUser requires a JWT token and the current password to replace the email address and password
+// associated with a given user ID. Profile fields and partial updates are handled by patchUser.
 func (c *Config) updateUser(w http.ResponseWriter, r *http.Request) {
 	type bodyCheck struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+		Email           string `json:"email"`
+		Password        string `json:"password"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	bodyChk := bodyCheck{}
 
 	// handle a decode error
-
 	if err := decoder.Decode(&bodyChk); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		invalidJSONError(err).writeErrorToPage(w, r)
 		return
 	}
 
 	if bodyChk.Email == "" || bodyChk.Password == "" {
 		errBody := errorBody{
 			Error:     "update existing entry requires both a valid email and password",
+			Code:      codeValidationFailed,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(bodyChk.Password), bcrypt.DefaultCost)
-	if err != nil {
+	if err := c.passwords.Validate(bodyChk.Password); err != nil {
 		errBody := errorBody{
-			Error:     "could not encode password, please send valid string",
+			Error:     fmt.Sprintf("%s", err),
+			Code:      codeValidationFailed,
 			errorCode: http.StatusBadRequest,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	claims, respCode, err := c.fetchClaims(r)
+	passHash, err := c.passwords.Hash(bodyChk.Password)
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: respCode,
-		}
-
-		errBody.writeErrorToPage(w)
+		internalError(fmt.Errorf("could not hash password: %s", err)).writeErrorToPage(w, r)
 		return
 	}
 
-	if issuer, claimErr := claims.GetIssuer(); claimErr != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", claimErr),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
-		return
-	} else if issuer == chirpyRefresh {
-		errBody := errorBody{
-			Error:     "cannot use refresh token for update request, please provide valid access token",
-			errorCode: http.StatusUnauthorized,
-		}
-
-		errBody.writeErrorToPage(w)
+	id, errBody := c.fetchUserID(r, "")
+	if errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	idString, err := claims.GetSubject()
+	current, err := c.db.GetUserFullByID(r.Context(), id)
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+		databaseError(err).writeErrorToPage(w, r)
 		return
 	}
 
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("could not convert userID to string: %s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+	if errBody := c.verifyCurrentPassword(bodyChk.CurrentPassword, current); errBody != nil {
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
-	user, err := c.db.UpdateUser(id, bodyChk.Email, passHash)
+	user, err := c.db.UpdateUser(r.Context(), id, bodyChk.Email, passHash)
 	if err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusBadRequest,
-		}
-
-		errBody.writeErrorToPage(w)
+		databaseError(err).writeErrorToPage(w, r)
 		return
 	}
 
@@ -27,29 +27,26 @@ func (c *Config) processPolkaUpdate(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errBody := errorBody{
 			Error:     fmt.Sprintf("%s", err),
+			Code:      codeUnauthenticated,
 			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	} else if apiKey != c.polkaAPIKey {
 		errBody := errorBody{
 			Error:     "received incorrect ApiKey",
+			Code:      codeUnauthenticated,
 			errorCode: http.StatusUnauthorized,
 		}
 
-		errBody.writeErrorToPage(w)
+		errBody.writeErrorToPage(w, r)
 		return
 	}
 
 	// handle a decode error
 	if err := decoder.Decode(&eventData); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusInternalServerError,
-		}
-
-		errBody.writeErrorToPage(w)
+		invalidJSONError(err).writeErrorToPage(w, r)
 		return
 	}
 
@@ -58,15 +55,12 @@ func (c *Config) processPolkaUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.db.UpdateUserToRed(eventData.EventUser.UserID); err != nil {
-		errBody := errorBody{
-			Error:     fmt.Sprintf("%s", err),
-			errorCode: http.StatusNotFound,
-		}
-
-		errBody.writeErrorToPage(w)
+	if err := c.db.UpdateUserToRed(r.Context(), eventData.EventUser.UserID); err != nil {
+		databaseError(err).writeErrorToPage(w, r)
 		return
 	}
 
+	c.rateLimitUsers.setChirpyRed(eventData.EventUser.UserID, true)
+
 	writeSuccessToPage(w, http.StatusOK, nil)
 }
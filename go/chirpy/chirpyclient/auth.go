@@ -0,0 +1,98 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+)
+
+// LoginResult is the outcome of Login. If TwoFactorRequired is set, no session was started yet and the
+// login must be completed with LoginTwoFactor and ChallengeToken.
+type LoginResult struct {
+	User              User
+	TwoFactorRequired bool
+	ChallengeToken    string
+}
+
+// loginResponse is the body of /api/login, either a session or a two-factor challenge
+type loginResponse struct {
+	ID                int    `json:"id"`
+	Email             string `json:"email"`
+	IsChirpyRed       bool   `json:"is_chirpy_red"`
+	Token             string `json:"token"`
+	RefreshToken      string `json:"refresh_token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+// Login logs in with an email address and password and, unless two-factor authentication is required,
+// stores the new session's tokens
+func (c *Client) Login(ctx context.Context, email, password string) (LoginResult, error) {
+	var out loginResponse
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/login",
+		body:   credentials{Email: email, Password: password},
+		out:    &out,
+	})
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	return c.finishLogin(out), nil
+}
+
+// LoginTwoFactor completes a login that requires two-factor authentication with a TOTP or recovery code,
+// storing the new session's tokens
+func (c *Client) LoginTwoFactor(ctx context.Context, challengeToken, code string) (LoginResult, error) {
+	var out loginResponse
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/login/2fa",
+		body: struct {
+			Code string `json:"code"`
+		}{Code: code},
+		bearer: "Bearer " + challengeToken,
+		out:    &out,
+	})
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	return c.finishLogin(out), nil
+}
+
+// finishLogin stores the tokens of a completed login
+func (c *Client) finishLogin(out loginResponse) LoginResult {
+	result := LoginResult{
+		User:              User{ID: out.ID, Email: out.Email, IsChirpyRed: out.IsChirpyRed},
+		TwoFactorRequired: out.TwoFactorRequired,
+		ChallengeToken:    out.ChallengeToken,
+	}
+
+	if !out.TwoFactorRequired {
+		c.SetTokens(Tokens{AccessToken: out.Token, RefreshToken: out.RefreshToken})
+	}
+
+	return result
+}
+
+// Refresh exchanges the stored refresh token for a new access token. It is called automatically when the
+// access token expires, so calling it directly is rarely needed.
+func (c *Client) Refresh(ctx context.Context) error {
+	return c.refresh(ctx, c.Tokens().AccessToken)
+}
+
+// Revoke revokes the stored refresh token, ending its session on the server, and forgets the tokens
+func (c *Client) Revoke(ctx context.Context) error {
+	if c.Tokens().RefreshToken == "" {
+		c.SetTokens(Tokens{})
+		return nil
+	}
+
+	if err := c.do(ctx, request{method: http.MethodPost, path: "/api/revoke", auth: authRefresh}); err != nil {
+		return err
+	}
+
+	c.SetTokens(Tokens{})
+	return nil
+}
@@ -0,0 +1,66 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Chirp is a single chirp
+type Chirp struct {
+	ID       int    `json:"id"`
+	AuthorID int    `json:"author_id"`
+	Body     string `json:"body"`
+}
+
+// ListChirpsOptions filter and order the chirps returned by ListChirps
+type ListChirpsOptions struct {
+	// AuthorID only returns the chirps by this user, if positive
+	AuthorID int
+	// Descending orders the chirps by descending ID rather than ascending
+	Descending bool
+}
+
+// ListChirps returns the visible chirps
+func (c *Client) ListChirps(ctx context.Context, opts ListChirpsOptions) ([]Chirp, error) {
+	query := url.Values{}
+	if opts.AuthorID > 0 {
+		query.Set("author_id", strconv.Itoa(opts.AuthorID))
+	}
+
+	if opts.Descending {
+		query.Set("sort", "desc")
+	}
+
+	var chirps []Chirp
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/chirps", query: query, out: &chirps})
+	return chirps, err
+}
+
+// GetChirp returns the chirp with the given ID
+func (c *Client) GetChirp(ctx context.Context, id int) (Chirp, error) {
+	var chirp Chirp
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/chirps/" + strconv.Itoa(id), out: &chirp})
+	return chirp, err
+}
+
+// CreateChirp posts a chirp as the authenticated user
+func (c *Client) CreateChirp(ctx context.Context, body string) (Chirp, error) {
+	var chirp Chirp
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/chirps",
+		body: struct {
+			Body string `json:"body"`
+		}{Body: body},
+		auth: authAccess,
+		out:  &chirp,
+	})
+	return chirp, err
+}
+
+// DeleteChirp deletes one of the authenticated user's chirps
+func (c *Client) DeleteChirp(ctx context.Context, id int) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/api/chirps/" + strconv.Itoa(id), auth: authAccess})
+}
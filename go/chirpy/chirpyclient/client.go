@@ -0,0 +1,404 @@
+// Package chirpyclient is a typed Go client for the chirpy API. A Client keeps the tokens of the user it
+// logged in as, refreshes the access token through /api/refresh before it expires (or once the server
+// rejects it), retries idempotent requests on transient failures and returns every API error as an *Error
+// mirroring the server's problem details.
+package chirpyclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access tokens expiring within this window are refreshed before the request is sent
+const refreshSkew = 30 * time.Second
+
+// Tokens are the credentials the Client authenticates with. AccessToken may also be a personal access
+// token, in which case RefreshToken is empty and no refresh is attempted.
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Client talks to a single chirpy server and is safe for concurrent use
+type Client struct {
+	baseURL      *url.URL
+	httpClient   *http.Client
+	userAgent    string
+	maxRetries   int
+	retryBackoff time.Duration
+	onTokens     func(Tokens)
+
+	tokens Tokens
+	mux    sync.Mutex
+
+	// refreshMux makes concurrent requests with an expired token share a single refresh
+	refreshMux sync.Mutex
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends the requests through hc rather than a default client with a 30s timeout
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithTokens starts the Client with previously stored tokens
+func WithTokens(tokens Tokens) Option {
+	return func(c *Client) {
+		c.tokens = tokens
+	}
+}
+
+// WithTokenCallback calls fn whenever the tokens change after a login, refresh or revoke, so that they can
+// be persisted
+func WithTokenCallback(fn func(Tokens)) Option {
+	return func(c *Client) {
+		c.onTokens = fn
+	}
+}
+
+// WithRetries retries idempotent requests up to n times on network errors, 429s and 502-504s, waiting
+// backoff, doubled on every attempt and jittered, unless the server sends Retry-After. n defaults to 3.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+		c.retryBackoff = backoff
+	}
+}
+
+// WithUserAgent sets the User-Agent header, which chirpy shows in the list of sessions
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// New returns a Client for the chirpy server at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chirpy base URL %q: %w", baseURL, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("expected absolute http(s) chirpy base URL, got %q", baseURL)
+	}
+
+	c := &Client{
+		baseURL:      u,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		userAgent:    "chirpyclient",
+		maxRetries:   3,
+		retryBackoff: 200 * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Tokens returns the tokens the Client currently authenticates with
+func (c *Client) Tokens() Tokens {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.tokens
+}
+
+// SetTokens replaces the tokens the Client authenticates with
+func (c *Client) SetTokens(tokens Tokens) {
+	c.mux.Lock()
+	c.tokens = tokens
+	onTokens := c.onTokens
+	c.mux.Unlock()
+
+	if onTokens != nil {
+		onTokens(tokens)
+	}
+}
+
+// auth selects the credentials sent with a request
+type auth int
+
+const (
+	authNone auth = iota
+	authAccess
+	authRefresh
+)
+
+// request describes one API call
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   any
+	auth   auth
+	// bearer overrides the stored token, e.g. for two-factor challenge tokens and webhook API keys
+	bearer string
+	// out receives the decoded JSON response, if not nil
+	out any
+}
+
+// idempotent reports whether the request can safely be sent again after a failure
+func (r request) idempotent() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// do sends the request, refreshing the access token and retrying as needed, and decodes the response
+func (c *Client) do(ctx context.Context, req request) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return fmt.Errorf("could not encode %s %s request: %w", req.method, req.path, err)
+		}
+	}
+
+	if req.auth == authAccess && req.bearer == "" {
+		if err := c.refreshIfExpiring(ctx); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(ctx, req, body)
+	if err != nil {
+		return err
+	}
+
+	// the access token may have been revoked or expired early; refresh once and try again
+	if resp.StatusCode == http.StatusUnauthorized && req.auth == authAccess && req.bearer == "" && c.canRefresh() {
+		sent := resp.Request.Header.Get("Authorization")
+		resp.Body.Close()
+
+		if err := c.refresh(ctx, strings.TrimPrefix(sent, "Bearer ")); err != nil {
+			return err
+		}
+
+		if resp, err = c.send(ctx, req, body); err != nil {
+			return err
+		}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newError(resp)
+	}
+
+	if req.out == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(req.out); err != nil {
+		return fmt.Errorf("could not decode %s %s response: %w", req.method, req.path, err)
+	}
+
+	return nil
+}
+
+// send performs the HTTP exchange, retrying idempotent requests on transient failures. The caller must
+// close the body of the returned response.
+func (c *Client) send(ctx context.Context, req request, body []byte) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+
+	attempts := 1
+	if req.idempotent() && c.maxRetries > 0 {
+		attempts += c.maxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("could not build %s %s request: %w", req.method, req.path, err)
+		}
+
+		httpReq.Header.Set("Accept", "application/json")
+		httpReq.Header.Set("User-Agent", c.userAgent)
+		if body != nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+
+		if authorization := c.authorization(req); authorization != "" {
+			httpReq.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			lastErr = fmt.Errorf("%s %s: %w", req.method, req.path, err)
+			continue
+		}
+
+		if attempt < attempts-1 && retryable(resp.StatusCode) {
+			lastErr = newError(resp)
+			resp.Body.Close()
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// authorization returns the Authorization header for the request, if any
+func (c *Client) authorization(req request) string {
+	if req.bearer != "" {
+		return req.bearer
+	}
+
+	tokens := c.Tokens()
+	switch req.auth {
+	case authAccess:
+		if tokens.AccessToken != "" {
+			return "Bearer " + tokens.AccessToken
+		}
+	case authRefresh:
+		if tokens.RefreshToken != "" {
+			return "Bearer " + tokens.RefreshToken
+		}
+	}
+
+	return ""
+}
+
+// retryable reports whether a response status is worth retrying
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns how long to wait before the given attempt, honoring the server's Retry-After
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	var apiErr *Error
+	if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+
+	wait := c.retryBackoff << (attempt - 1)
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// canRefresh reports whether the Client holds a refresh token
+func (c *Client) canRefresh() bool {
+	return c.Tokens().RefreshToken != ""
+}
+
+// refreshIfExpiring refreshes the access token if it is a JWT that expires within refreshSkew
+func (c *Client) refreshIfExpiring(ctx context.Context) error {
+	tokens := c.Tokens()
+	if tokens.RefreshToken == "" {
+		return nil
+	}
+
+	if expiry, ok := tokenExpiry(tokens.AccessToken); tokens.AccessToken != "" && (!ok || time.Until(expiry) > refreshSkew) {
+		return nil
+	}
+
+	return c.refresh(ctx, tokens.AccessToken)
+}
+
+// refresh exchanges the refresh token for a new access token, unless another request already replaced
+// stale in the meantime
+func (c *Client) refresh(ctx context.Context, stale string) error {
+	c.refreshMux.Lock()
+	defer c.refreshMux.Unlock()
+
+	tokens := c.Tokens()
+	if tokens.AccessToken != stale {
+		return nil
+	}
+
+	var out struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.do(ctx, request{method: http.MethodPost, path: "/api/refresh", auth: authRefresh, out: &out}); err != nil {
+		return fmt.Errorf("could not refresh access token: %w", err)
+	}
+
+	tokens.AccessToken = out.Token
+	c.SetTokens(tokens)
+	return nil
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it; the server remains the judge of its
+// validity, this only avoids sending a token that is known to be expired
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		ExpiresAt json.Number `json:"exp"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, false
+	}
+
+	exp, err := strconv.ParseInt(claims.ExpiresAt.String(), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(exp, 0), true
+}
@@ -0,0 +1,137 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Conversation is a direct message thread as seen by the authenticated user
+type Conversation struct {
+	ID             int       `json:"id"`
+	ParticipantIDs []int     `json:"participant_ids"`
+	CreatedBy      int       `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastMessageAt  time.Time `json:"last_message_at"`
+	LastMessage    *Message  `json:"last_message"`
+	UnreadCount    int       `json:"unread_count"`
+}
+
+// Message is a single direct message
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ListMessagesOptions page through the messages returned by ListMessages
+type ListMessagesOptions struct {
+	// BeforeID only returns the messages older than this one, if positive
+	BeforeID int
+	// Limit caps the number of messages returned, if positive; the server defaults to 50
+	Limit int
+}
+
+// ListConversations returns the authenticated user's conversations, most recently active first
+func (c *Client) ListConversations(ctx context.Context) ([]Conversation, error) {
+	var conversations []Conversation
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/conversations", auth: authAccess, out: &conversations})
+	return conversations, err
+}
+
+// CreateConversation starts a conversation with the given users, sending body as the first message unless
+// it is empty. An existing one-to-one conversation is returned rather than a new one.
+func (c *Client) CreateConversation(ctx context.Context, participantIDs []int, body string) (Conversation, error) {
+	var conversation Conversation
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/conversations",
+		body: struct {
+			ParticipantIDs []int  `json:"participant_ids"`
+			Body           string `json:"body,omitempty"`
+		}{ParticipantIDs: participantIDs, Body: body},
+		auth: authAccess,
+		out:  &conversation,
+	})
+	return conversation, err
+}
+
+// GetConversation returns one of the authenticated user's conversations
+func (c *Client) GetConversation(ctx context.Context, id int) (Conversation, error) {
+	var conversation Conversation
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/conversations/" + strconv.Itoa(id), auth: authAccess, out: &conversation})
+	return conversation, err
+}
+
+// ListMessages returns a page of the conversation's messages, newest first
+func (c *Client) ListMessages(ctx context.Context, conversationID int, opts ListMessagesOptions) ([]Message, error) {
+	query := url.Values{}
+	if opts.BeforeID > 0 {
+		query.Set("before_id", strconv.Itoa(opts.BeforeID))
+	}
+
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var messages []Message
+	err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/api/conversations/" + strconv.Itoa(conversationID) + "/messages",
+		query:  query,
+		auth:   authAccess,
+		out:    &messages,
+	})
+	return messages, err
+}
+
+// SendMessage sends a message to the conversation as the authenticated user
+func (c *Client) SendMessage(ctx context.Context, conversationID int, body string) (Message, error) {
+	var message Message
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/conversations/" + strconv.Itoa(conversationID) + "/messages",
+		body: struct {
+			Body string `json:"body"`
+		}{Body: body},
+		auth: authAccess,
+		out:  &message,
+	})
+	return message, err
+}
+
+// MarkConversationRead marks the conversation as read up to messageID, or entirely if it is zero
+func (c *Client) MarkConversationRead(ctx context.Context, conversationID, messageID int) (Conversation, error) {
+	var conversation Conversation
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/conversations/" + strconv.Itoa(conversationID) + "/read",
+		body: struct {
+			MessageID int `json:"message_id,omitempty"`
+		}{MessageID: messageID},
+		auth: authAccess,
+		out:  &conversation,
+	})
+	return conversation, err
+}
+
+// ListBlockedUsers returns the IDs of the users the authenticated user has blocked
+func (c *Client) ListBlockedUsers(ctx context.Context) ([]int, error) {
+	var ids []int
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/users/blocks", auth: authAccess, out: &ids})
+	return ids, err
+}
+
+// BlockUser blocks the user from messaging the authenticated user
+func (c *Client) BlockUser(ctx context.Context, id int) error {
+	return c.do(ctx, request{method: http.MethodPut, path: "/api/users/" + strconv.Itoa(id) + "/block", auth: authAccess})
+}
+
+// UnblockUser lifts a block set with BlockUser
+func (c *Client) UnblockUser(ctx context.Context, id int) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/api/users/" + strconv.Itoa(id) + "/block", auth: authAccess})
+}
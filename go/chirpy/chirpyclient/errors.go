@@ -0,0 +1,103 @@
+package chirpyclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Code is the stable, machine-readable kind of an API error; branch on it rather than on Detail
+type Code string
+
+// the codes returned by the chirpy API
+const (
+	CodeInvalidJSON        Code = "invalid_json"
+	CodeValidationFailed   Code = "validation_failed"
+	CodeInvalidID          Code = "invalid_id"
+	CodeChirpTooLong       Code = "chirp_too_long"
+	CodeUnauthenticated    Code = "unauthenticated"
+	CodeInvalidCredentials Code = "invalid_credentials"
+	CodeTokenRevoked       Code = "token_revoked"
+	CodeInvalidTwoFactor   Code = "invalid_two_factor_code"
+	CodeForbidden          Code = "forbidden"
+	CodeAccountSuspended   Code = "account_suspended"
+	CodeAccountBanned      Code = "account_banned"
+	CodeInsufficientScope  Code = "insufficient_scope"
+	CodeNotFound           Code = "not_found"
+	CodeConflict           Code = "conflict"
+	CodeRateLimited        Code = "rate_limited"
+	CodeUnavailable        Code = "unavailable"
+	CodeInternal           Code = "internal_error"
+)
+
+// Error is an error response from the chirpy API: the RFC 7807 problem details sent by the server, along
+// with the request ID to quote when reporting it. Responses that are not problem details, e.g. from a
+// proxy, only have Status and Detail set.
+type Error struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Code     Code   `json:"code"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+
+	// RequestID is the X-Request-ID the server logged the error under
+	RequestID string `json:"-"`
+	// RetryAfter is how long the server asked to wait before retrying, if it did
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("chirpy: %d %s", e.Status, e.Detail)
+	if e.Code != "" {
+		msg = fmt.Sprintf("chirpy: %d %s: %s", e.Status, e.Code, e.Detail)
+	}
+
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+
+	return msg
+}
+
+// IsCode reports whether err is an API error with the given code
+func IsCode(err error, code Code) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// newError builds an *Error from a failed response, reading up to 64KiB of its body
+func newError(resp *http.Response) *Error {
+	apiErr := &Error{}
+
+	dat, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(dat, apiErr); err != nil || apiErr.Detail == "" {
+		// the original error body only carries `error`, and anything else is shown as text
+		var legacy struct {
+			Error string `json:"error"`
+		}
+
+		if json.Unmarshal(dat, &legacy) == nil && legacy.Error != "" {
+			apiErr.Detail = legacy.Error
+		} else if apiErr.Detail == "" {
+			apiErr.Detail = string(dat)
+		}
+	}
+
+	apiErr.Status = resp.StatusCode
+	if apiErr.Title == "" {
+		apiErr.Title = http.StatusText(resp.StatusCode)
+	}
+
+	apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return apiErr
+}
@@ -0,0 +1,85 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// notification types, see Notification.Type
+const (
+	NotificationMention   = "mention"
+	NotificationChirpyRed = "chirpy_red"
+)
+
+// Notification tells the authenticated user about a mention or a change to their account
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Type      string    `json:"type"`
+	ActorID   int       `json:"actor_id,omitempty"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ReadAt is nil while the notification is unread
+	ReadAt *time.Time `json:"read_at"`
+}
+
+// ListNotificationsOptions filter and page through the notifications returned by ListNotifications
+type ListNotificationsOptions struct {
+	// Unread only returns the notifications that have not been read
+	Unread bool
+	// BeforeID only returns the notifications older than this one, if positive
+	BeforeID int
+	// Limit caps the number of notifications returned, if positive; the server defaults to 50
+	Limit int
+}
+
+// ListNotifications returns the authenticated user's notifications, newest first
+func (c *Client) ListNotifications(ctx context.Context, opts ListNotificationsOptions) ([]Notification, error) {
+	query := url.Values{}
+	if opts.Unread {
+		query.Set("unread", "true")
+	}
+
+	if opts.BeforeID > 0 {
+		query.Set("before_id", strconv.Itoa(opts.BeforeID))
+	}
+
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var notifications []Notification
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/notifications", query: query, auth: authAccess, out: &notifications})
+	return notifications, err
+}
+
+// unreadCount is the response of the endpoints that report the number of unread notifications
+type unreadCount struct {
+	UnreadCount int `json:"unread_count"`
+}
+
+// CountUnreadNotifications returns the number of notifications the authenticated user has not read
+func (c *Client) CountUnreadNotifications(ctx context.Context) (int, error) {
+	var count unreadCount
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/notifications/unread_count", auth: authAccess, out: &count})
+	return count.UnreadCount, err
+}
+
+// MarkNotificationsRead marks the given notifications as read, or all of them if ids is empty, and
+// returns the number still unread
+func (c *Client) MarkNotificationsRead(ctx context.Context, ids ...int) (int, error) {
+	var count unreadCount
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/notifications/read",
+		body: struct {
+			IDs []int `json:"ids,omitempty"`
+		}{IDs: ids},
+		auth: authAccess,
+		out:  &count,
+	})
+	return count.UnreadCount, err
+}
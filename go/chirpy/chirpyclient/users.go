@@ -0,0 +1,106 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// User is a chirpy user along with their public profile
+type User struct {
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// UserUpdate is a partial update of the authenticated user; nil fields are left untouched and an empty
+// string clears an optional profile field. Changing Email or Password requires CurrentPassword.
+type UserUpdate struct {
+	CurrentPassword string  `json:"current_password,omitempty"`
+	Email           *string `json:"email,omitempty"`
+	Password        *string `json:"password,omitempty"`
+	Handle          *string `json:"handle,omitempty"`
+	DisplayName     *string `json:"display_name,omitempty"`
+	Bio             *string `json:"bio,omitempty"`
+	AvatarURL       *string `json:"avatar_url,omitempty"`
+}
+
+// credentials is the body of sign up, login and credential replacement
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// ListUsers returns every user, ordered by ID
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/users", out: &users})
+	return users, err
+}
+
+// GetUser returns the user with the given ID
+func (c *Client) GetUser(ctx context.Context, id int) (User, error) {
+	var user User
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/users/" + strconv.Itoa(id), out: &user})
+	return user, err
+}
+
+// CreateUser signs up a new user; it does not log them in
+func (c *Client) CreateUser(ctx context.Context, email, password string) (User, error) {
+	var user User
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/users",
+		body:   credentials{Email: email, Password: password},
+		out:    &user,
+	})
+	return user, err
+}
+
+// ReplaceCredentials replaces the authenticated user's email address and password, confirmed with their
+// current password
+func (c *Client) ReplaceCredentials(ctx context.Context, currentPassword, email, password string) (User, error) {
+	var user User
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   "/api/users",
+		body: struct {
+			CurrentPassword string `json:"current_password"`
+			Email           string `json:"email"`
+			Password        string `json:"password"`
+		}{CurrentPassword: currentPassword, Email: email, Password: password},
+		auth: authAccess,
+		out:  &user,
+	})
+	return user, err
+}
+
+// UpdateUser applies a partial update to the authenticated user's account and profile
+func (c *Client) UpdateUser(ctx context.Context, update UserUpdate) (User, error) {
+	var user User
+	err := c.do(ctx, request{method: http.MethodPatch, path: "/api/users", body: update, auth: authAccess, out: &user})
+	return user, err
+}
+
+// DeleteUser permanently deletes the authenticated user, confirmed with their password, and forgets the
+// Client's tokens
+func (c *Client) DeleteUser(ctx context.Context, password string) error {
+	err := c.do(ctx, request{
+		method: http.MethodDelete,
+		path:   "/api/users",
+		body: struct {
+			Password string `json:"password"`
+		}{Password: password},
+		auth: authAccess,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.SetTokens(Tokens{})
+	return nil
+}
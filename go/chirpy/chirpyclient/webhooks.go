@@ -0,0 +1,37 @@
+package chirpyclient
+
+import (
+	"context"
+	"net/http"
+)
+
+// EventUserUpgraded is the Polka event that grants a user Chirpy Red; chirpy acknowledges and ignores
+// every other event
+const EventUserUpgraded = "user.upgraded"
+
+// PolkaEvent is a payment event delivered to chirpy's Polka webhook
+type PolkaEvent struct {
+	Event string `json:"event"`
+	Data  struct {
+		UserID int `json:"user_id"`
+	} `json:"data"`
+}
+
+// SendPolkaEvent delivers a Polka payment event, authenticated with the POLKA_API_KEY the server was
+// configured with rather than the Client's tokens
+func (c *Client) SendPolkaEvent(ctx context.Context, apiKey string, event PolkaEvent) error {
+	return c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/api/polka/webhooks",
+		body:   event,
+		bearer: "ApiKey " + apiKey,
+	})
+}
+
+// UpgradeUser tells chirpy, as Polka would, that the user has paid for Chirpy Red
+func (c *Client) UpgradeUser(ctx context.Context, apiKey string, userID int) error {
+	event := PolkaEvent{Event: EventUserUpgraded}
+	event.Data.UserID = userID
+
+	return c.SendPolkaEvent(ctx, apiKey, event)
+}
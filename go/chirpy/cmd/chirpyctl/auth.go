@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/chirpyclient"
+	"golang.org/x/term"
+)
+
+// login logs in to -server and caches the session, prompting for anything not given as a flag
+func (a *app) login(ctx context.Context, args []string) error {
+	fs := a.flagSet("login", "[-email EMAIL] [-password-stdin] [-code CODE]")
+	email := fs.String("email", "", "email address to log in with, prompted for if empty")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin instead of prompting")
+	code := fs.String("code", "", "two-factor code, prompted for if the account needs one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	if *email == "" {
+		if *email, err = a.prompt("Email: ", false); err != nil {
+			return err
+		}
+	}
+
+	var password string
+	if *passwordStdin {
+		password, err = a.readLine()
+	} else {
+		password, err = a.prompt("Password: ", true)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	result, err := c.Login(ctx, *email, password)
+	if err != nil {
+		return err
+	}
+
+	if result.TwoFactorRequired {
+		if *code == "" {
+			if *code, err = a.prompt("Two-factor code: ", false); err != nil {
+				return err
+			}
+		}
+
+		if result, err = c.LoginTwoFactor(ctx, result.ChallengeToken, *code); err != nil {
+			return err
+		}
+	}
+
+	// the token callback already cached the tokens, remember who they belong to as well
+	creds := a.creds.get(a.server)
+	creds.Email, creds.UserID = result.User.Email, result.User.ID
+	if err := a.creds.set(a.server, creds); err != nil {
+		return fmt.Errorf("logged in, but failed to cache credentials: %w", err)
+	}
+
+	return a.print(result.User, func(w io.Writer) {
+		fmt.Fprintf(w, "logged in to %s as %s (user %d)\n", a.server, result.User.Email, result.User.ID)
+	})
+}
+
+// logout revokes the cached session on -server and forgets it, even if the server can't be reached
+func (a *app) logout(ctx context.Context, args []string) error {
+	fs := a.flagSet("logout", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	if c.Tokens().AccessToken == "" && c.Tokens().RefreshToken == "" {
+		fmt.Fprintf(a.stderr, "not logged in to %s\n", a.server)
+		return nil
+	}
+
+	if err := c.Revoke(ctx); err != nil {
+		c.SetTokens(chirpyclient.Tokens{})
+		return fmt.Errorf("forgot the cached session, but failed to revoke it on the server: %w", err)
+	}
+
+	fmt.Fprintf(a.stderr, "logged out of %s\n", a.server)
+	return nil
+}
+
+// prompt asks for a single line on stderr. Secrets are read without echo when stdin is a terminal.
+func (a *app) prompt(label string, secret bool) (string, error) {
+	fmt.Fprint(a.stderr, label)
+	if secret && term.IsTerminal(int(os.Stdin.Fd())) {
+		dat, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(a.stderr)
+		return string(dat), err
+	}
+
+	return a.readLine()
+}
+
+// readLine reads a line from stdin without its line ending
+func (a *app) readLine() (string, error) {
+	line, err := a.stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("failed to read from stdin: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
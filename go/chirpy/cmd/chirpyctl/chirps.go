@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/chirpyclient"
+)
+
+const chirpsSubcommands = `  list            list the visible chirps
+  get ID          show a single chirp
+  post BODY...    post a chirp as the logged in user
+  delete ID       delete one of the logged in user's chirps
+  tail            print new chirps as they are posted
+`
+
+// chirps dispatches the chirps subcommands
+func (a *app) chirps(ctx context.Context, args []string) error {
+	sub, args, err := a.subcommand("chirps", args, chirpsSubcommands)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		return a.chirpsList(ctx, args)
+	case "get":
+		return a.chirpsGet(ctx, args)
+	case "post":
+		return a.chirpsPost(ctx, args)
+	case "delete":
+		return a.chirpsDelete(ctx, args)
+	case "tail":
+		return a.chirpsTail(ctx, args)
+	}
+
+	return unknownSubcommand("chirps", sub)
+}
+
+func (a *app) chirpsList(ctx context.Context, args []string) error {
+	fs := a.flagSet("chirps list", "[-author ID] [-desc]")
+	author := fs.Int("author", 0, "only list the chirps by this user")
+	desc := fs.Bool("desc", false, "list the newest chirps first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	chirps, err := c.ListChirps(ctx, chirpyclient.ListChirpsOptions{AuthorID: *author, Descending: *desc})
+	if err != nil {
+		return err
+	}
+
+	return a.print(chirps, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tAUTHOR\tBODY")
+		for _, chirp := range chirps {
+			fmt.Fprintf(tw, "%d\t%d\t%s\n", chirp.ID, chirp.AuthorID, chirp.Body)
+		}
+
+		tw.Flush()
+	})
+}
+
+func (a *app) chirpsGet(ctx context.Context, args []string) error {
+	fs := a.flagSet("chirps get", "ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := idArg(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	chirp, err := c.GetChirp(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return a.print(chirp, func(w io.Writer) {
+		printChirp(w, chirp)
+	})
+}
+
+func (a *app) chirpsPost(ctx context.Context, args []string) error {
+	fs := a.flagSet("chirps post", "BODY...")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	body := strings.Join(fs.Args(), " ")
+	if body == "" {
+		return errors.New("expected the chirp's body as arguments")
+	}
+
+	c, err := a.loggedInClient()
+	if err != nil {
+		return err
+	}
+
+	chirp, err := c.CreateChirp(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	return a.print(chirp, func(w io.Writer) {
+		printChirp(w, chirp)
+	})
+}
+
+func (a *app) chirpsDelete(ctx context.Context, args []string) error {
+	fs := a.flagSet("chirps delete", "ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := idArg(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	c, err := a.loggedInClient()
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeleteChirp(ctx, id); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stderr, "deleted chirp %d\n", id)
+	return nil
+}
+
+// chirpsTail polls for chirps with a higher ID than the last one printed until interrupted
+func (a *app) chirpsTail(ctx context.Context, args []string) error {
+	fs := a.flagSet("chirps tail", "[-author ID] [-n N] [-interval 5s]")
+	author := fs.Int("author", 0, "only print the chirps by this user")
+	n := fs.Int("n", 10, "number of existing chirps to print first")
+	interval := fs.Duration("interval", 5*time.Second, "how often to poll for new chirps")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *interval < time.Second {
+		return fmt.Errorf("expected an interval of at least 1s, got %s", *interval)
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	opts := chirpyclient.ListChirpsOptions{AuthorID: *author}
+	chirps, err := c.ListChirps(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	lastID := 0
+	if len(chirps) > 0 {
+		lastID = chirps[len(chirps)-1].ID
+	}
+
+	if *n >= 0 && len(chirps) > *n {
+		chirps = chirps[len(chirps)-*n:]
+	}
+
+	if err := a.printChirps(chirps); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		chirps, err := c.ListChirps(ctx, opts)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		} else if err != nil {
+			// keep tailing through a restart of the server
+			fmt.Fprintf(a.stderr, "chirpyctl: %s\n", err)
+			continue
+		}
+
+		var fresh []chirpyclient.Chirp
+		for _, chirp := range chirps {
+			if chirp.ID > lastID {
+				fresh = append(fresh, chirp)
+				lastID = chirp.ID
+			}
+		}
+
+		if err := a.printChirps(fresh); err != nil {
+			return err
+		}
+	}
+}
+
+// printChirps prints chirps one at a time, rather than as a list, so that tail can stream them
+func (a *app) printChirps(chirps []chirpyclient.Chirp) error {
+	for _, chirp := range chirps {
+		if err := a.print(chirp, func(w io.Writer) { printChirp(w, chirp) }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printChirp(w io.Writer, chirp chirpyclient.Chirp) {
+	fmt.Fprintf(w, "#%d by user %d: %s\n", chirp.ID, chirp.AuthorID, chirp.Body)
+}
+
+// idArg parses the single positional ID argument of a subcommand
+func idArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a single ID argument, got %d arguments", len(args))
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("expected a positive ID, got %q", args[0])
+	}
+
+	return id, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/chirpyclient"
+)
+
+// credentials are the cached login for a single server
+type credentials struct {
+	Email  string              `json:"email,omitempty"`
+	UserID int                 `json:"user_id,omitempty"`
+	Tokens chirpyclient.Tokens `json:"tokens"`
+}
+
+// credentialStore caches credentials per server URL in a file only the user can read
+type credentialStore struct {
+	path    string
+	Servers map[string]credentials `json:"servers"`
+}
+
+// credentialsPath is $CHIRPYCTL_CREDENTIALS, or chirpyctl/credentials.json in the user's config directory
+func credentialsPath() (string, error) {
+	if path := os.Getenv("CHIRPYCTL_CREDENTIALS"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the config directory for cached credentials: %w", err)
+	}
+
+	return filepath.Join(dir, "chirpyctl", "credentials.json"), nil
+}
+
+// loadCredentials reads the credential cache, which is empty if the file does not exist yet
+func loadCredentials() (*credentialStore, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &credentialStore{path: path, Servers: map[string]credentials{}}
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read cached credentials: %w", err)
+	}
+
+	if err := json.Unmarshal(dat, store); err != nil {
+		return nil, fmt.Errorf("failed to parse cached credentials in %s: %w", path, err)
+	}
+
+	if store.Servers == nil {
+		store.Servers = map[string]credentials{}
+	}
+
+	return store, nil
+}
+
+// get returns the cached credentials for server, if any
+func (s *credentialStore) get(server string) credentials {
+	return s.Servers[serverKey(server)]
+}
+
+// set replaces the cached credentials for server, forgetting them if they hold no tokens, and saves
+// the cache atomically with mode 0600
+func (s *credentialStore) set(server string, creds credentials) error {
+	if creds.Tokens.AccessToken == "" && creds.Tokens.RefreshToken == "" {
+		delete(s.Servers, serverKey(server))
+	} else {
+		s.Servers[serverKey(server)] = creds
+	}
+
+	dat, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, dat, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// serverKey normalizes a server URL so that trailing slashes don't split the cache
+func serverKey(server string) string {
+	return strings.TrimSuffix(server, "/")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/config"
+	"github.com/sebito91/bootdotdev/go/chirpy/database"
+	"github.com/sebito91/bootdotdev/go/chirpy/password"
+)
+
+const dbSubcommands = `  inspect         summarize the database file and report inconsistencies
+  repair          fix the inconsistencies that can be fixed safely
+  compact         drop expired sessions and tokens, read notifications and stale analytics
+  reset-password  set a new password for a user
+`
+
+// db dispatches the operator subcommands, which open the database file directly
+func (a *app) db(ctx context.Context, args []string) error {
+	sub, args, err := a.subcommand("db", args, dbSubcommands)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "inspect":
+		return a.dbInspect(ctx, args)
+	case "repair":
+		return a.dbRepair(ctx, args)
+	case "compact":
+		return a.dbCompact(ctx, args)
+	case "reset-password":
+		return a.dbResetPassword(ctx, args)
+	}
+
+	return unknownSubcommand("db", sub)
+}
+
+// dbFlags are the flags shared by the operator subcommands
+type dbFlags struct {
+	path     *string
+	noBackup *bool
+}
+
+// addDBFlags adds -db, defaulting to $DB_PATH like the server, and -no-backup to commands that modify
+// the file
+func addDBFlags(fs interface {
+	String(name, value, usage string) *string
+	Bool(name string, value bool, usage string) *bool
+}, modifies bool) dbFlags {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = config.Default().DBPath
+	}
+
+	flags := dbFlags{path: fs.String("db", path, "path to the JSON database file, the server must be stopped")}
+	if modifies {
+		flags.noBackup = fs.Bool("no-backup", false, "don't copy the file to PATH.<timestamp>.bak first")
+	}
+
+	return flags
+}
+
+// open opens the existing database file, backing it up first if the command modifies it. NewDB would
+// create a missing file, which is never what an operator means. It refuses to run alongside the server,
+// which holds the database lock while it is up.
+func (f dbFlags) open(stderr io.Writer) (*database.DB, error) {
+	if _, err := os.Stat(*f.path); err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+
+	db, err := database.NewDB(*f.path)
+	if errors.Is(err, database.ErrLocked) {
+		return nil, fmt.Errorf("failed to open the database: %w, stop the server first", err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+
+	if f.noBackup != nil && !*f.noBackup {
+		backup, err := backupFile(*f.path)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to back up the database: %w", err)
+		}
+
+		fmt.Fprintf(stderr, "backed up %s to %s\n", *f.path, backup)
+	}
+
+	return db, nil
+}
+
+// backupFile copies path next to itself with a timestamp and returns the copy's path
+func backupFile(path string) (string, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	return backup, os.WriteFile(backup, dat, 0o600)
+}
+
+func (a *app) dbInspect(ctx context.Context, args []string) error {
+	fs := a.flagSet("db inspect", "[-db PATH]")
+	flags := addDBFlags(fs, false)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := flags.open(a.stderr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Inspect(ctx)
+	if err != nil {
+		return err
+	}
+
+	return a.print(report, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "File:\t%s (%d bytes, modified %s)\n", report.Path, report.Size, report.ModTime.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Users:\t%d (%d moderated, last ID %d)\n", report.Users, report.ModeratedUsers, report.LastUserID)
+		fmt.Fprintf(tw, "Chirps:\t%d (%d hidden)\n", report.Chirps, report.HiddenChirps)
+		fmt.Fprintf(tw, "Sessions:\t%d (%d active)\n", report.Sessions, report.ActiveSessions)
+		fmt.Fprintf(tw, "Personal access tokens:\t%d\n", report.PersonalAccessTokens)
+		fmt.Fprintf(tw, "Conversations:\t%d (%d messages)\n", report.Conversations, report.Messages)
+		fmt.Fprintf(tw, "Notifications:\t%d\n", report.Notifications)
+		fmt.Fprintf(tw, "Revoked tokens:\t%d\n", report.RevokedTokens)
+		fmt.Fprintf(tw, "Analytics buckets:\t%d hourly, %d daily\n", report.HourlyBuckets, report.DailyBuckets)
+		tw.Flush()
+
+		printProblems(w, report.Problems, "no problems found")
+	})
+}
+
+func (a *app) dbRepair(ctx context.Context, args []string) error {
+	fs := a.flagSet("db repair", "[-db PATH] [-no-backup]")
+	flags := addDBFlags(fs, true)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := flags.open(a.stderr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problems, err := db.Repair(ctx)
+	if err != nil {
+		return err
+	}
+
+	return a.print(problems, func(w io.Writer) {
+		printProblems(w, problems, "nothing to repair")
+	})
+}
+
+func (a *app) dbCompact(ctx context.Context, args []string) error {
+	fs := a.flagSet("db compact", "[-db PATH] [-older-than 1440h] [-no-backup]")
+	flags := addDBFlags(fs, true)
+	olderThan := fs.Duration("older-than", config.Default().RefreshTokenTTL, "drop the sessions and tokens that ended this long ago, at least the server's refresh token lifetime")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *olderThan <= 0 {
+		return fmt.Errorf("expected a positive -older-than, got %s", *olderThan)
+	}
+
+	db, err := flags.open(a.stderr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.Compact(ctx, time.Now().UTC().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+
+	return a.print(stats, func(w io.Writer) {
+		fmt.Fprintf(w, "dropped %d sessions, %d personal access tokens, %d revoked tokens, %d read notifications and %d analytics buckets\n",
+			stats.Sessions, stats.PersonalAccessTokens, stats.RevokedTokens, stats.Notifications, stats.AnalyticsBuckets)
+		fmt.Fprintf(w, "%d bytes -> %d bytes\n", stats.SizeBefore, stats.SizeAfter)
+	})
+}
+
+// dbResetPassword sets a new password for the user with the given email address and revokes their
+// sessions, so that whoever knew the old password is logged out
+func (a *app) dbResetPassword(ctx context.Context, args []string) error {
+	fs := a.flagSet("db reset-password", "[-db PATH] [-disable-2fa] [-password-stdin] [-no-backup] EMAIL")
+	flags := addDBFlags(fs, true)
+	disable2FA := fs.Bool("disable-2fa", false, "also remove the user's two-factor enrollment")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin instead of prompting")
+	minLength := fs.Int("password-min-length", config.Default().PasswordMinLength, "minimum password length the server enforces")
+	minCharClasses := fs.Int("password-min-char-classes", config.Default().PasswordMinCharClasses, "minimum character classes the server enforces")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("expected the email address of the user as the only argument")
+	}
+	email := fs.Arg(0)
+
+	policy := password.DefaultPolicy
+	policy.MinLength = *minLength
+	policy.MinCharClasses = *minCharClasses
+	hasher := password.NewHasher(password.DefaultParams, policy)
+
+	// check the user exists before asking for a password or backing up the file
+	db, err := dbFlags{path: flags.path}.open(a.stderr)
+	if err != nil {
+		return err
+	}
+
+	user, err := findUserByEmail(ctx, db, email)
+	db.Close()
+	if err != nil {
+		return err
+	}
+
+	newPassword, err := a.newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	if err := hasher.Validate(newPassword); err != nil {
+		return err
+	}
+
+	hash, err := hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if db, err = flags.open(a.stderr); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.UpdateUserPasswordHash(ctx, user.ID, hash); err != nil {
+		return err
+	}
+
+	if err := db.RevokeSessionsByUserID(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if *disable2FA {
+		if err := db.UpdateUserTwoFactor(ctx, user.ID, database.TwoFactor{}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(a.stderr, "reset the password of user %d (%s) and revoked their sessions\n", user.ID, user.Email)
+	return nil
+}
+
+// findUserByEmail returns the user with exactly this email address, as the server matches logins
+func findUserByEmail(ctx context.Context, db *database.DB, email string) (database.UserWithPassword, error) {
+	users, err := db.GetUsersFull(ctx)
+	if err != nil {
+		return database.UserWithPassword{}, err
+	}
+
+	for _, user := range users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+
+	return database.UserWithPassword{}, fmt.Errorf("no user with email address %q", email)
+}
+
+func printProblems(w io.Writer, problems []string, none string) {
+	if len(problems) == 0 {
+		fmt.Fprintln(w, none)
+		return
+	}
+
+	fmt.Fprintln(w, "Problems:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  %s\n", strings.TrimSpace(problem))
+	}
+}
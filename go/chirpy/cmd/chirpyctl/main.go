@@ -0,0 +1,212 @@
+// Command chirpyctl is a command line client for chirpy.
+//
+// The API commands talk to a running server through chirpyclient and cache the login per server in the
+// user's config directory:
+//
+//	chirpyctl [-server URL] [-json] login [-email EMAIL]
+//	chirpyctl logout
+//	chirpyctl chirps list [-author ID] [-desc]
+//	chirpyctl chirps get ID
+//	chirpyctl chirps post BODY...
+//	chirpyctl chirps delete ID
+//	chirpyctl chirps tail [-author ID] [-n N] [-interval 5s]
+//	chirpyctl users list
+//	chirpyctl users get ID
+//	chirpyctl users create -email EMAIL
+//	chirpyctl users update [-email EMAIL] [-password] [-handle H] [-display-name N] [-bio B] [-avatar-url U]
+//	chirpyctl users delete
+//	chirpyctl users upgrade -polka-key KEY ID
+//
+// The operator commands work directly on a database file and must only be used while the server is
+// stopped, since the server does not reload the file. The ones that modify it back it up first:
+//
+//	chirpyctl db inspect [-db PATH]
+//	chirpyctl db repair [-db PATH] [-no-backup]
+//	chirpyctl db compact [-db PATH] [-older-than 1440h] [-no-backup]
+//	chirpyctl db reset-password [-db PATH] [-disable-2fa] [-no-backup] EMAIL
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/chirpyclient"
+)
+
+const usage = `usage: chirpyctl [-server URL] [-json] <command> [arguments]
+
+API commands, against the server at -server (or $CHIRPY_URL):
+  login           log in and cache the session's tokens
+  logout          revoke the cached session
+  chirps          list, get, post, delete or tail chirps
+  users           list, get, create, update, delete or upgrade users
+
+Operator commands, against a database file while the server is stopped:
+  db              inspect, repair, compact or reset-password
+
+Run "chirpyctl <command> -h" for the arguments of a command.
+`
+
+// app is the state shared by every command
+type app struct {
+	server  string
+	jsonOut bool
+	stdin   *bufio.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	creds   *credentialStore
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a := &app{stdin: bufio.NewReader(os.Stdin), stdout: os.Stdout, stderr: os.Stderr}
+	if err := a.run(ctx, os.Args[1:]); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "chirpyctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and dispatches to the command
+func (a *app) run(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("chirpyctl", flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprint(a.stderr, usage)
+		fmt.Fprintln(a.stderr, "\nglobal flags:")
+		fs.PrintDefaults()
+	}
+
+	server := os.Getenv("CHIRPY_URL")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	fs.StringVar(&a.server, "server", server, "base URL of the chirpy server")
+	fs.BoolVar(&a.jsonOut, "json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command")
+	}
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "login":
+		return a.login(ctx, args)
+	case "logout":
+		return a.logout(ctx, args)
+	case "chirps":
+		return a.chirps(ctx, args)
+	case "users":
+		return a.users(ctx, args)
+	case "db":
+		return a.db(ctx, args)
+	case "help":
+		fs.Usage()
+		return nil
+	}
+
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// client returns a chirpyclient for -server that authenticates with the cached tokens and caches any new
+// ones it is given
+func (a *app) client() (*chirpyclient.Client, error) {
+	if a.creds == nil {
+		creds, err := loadCredentials()
+		if err != nil {
+			return nil, err
+		}
+
+		a.creds = creds
+	}
+
+	return chirpyclient.New(a.server,
+		chirpyclient.WithTokens(a.creds.get(a.server).Tokens),
+		chirpyclient.WithUserAgent("chirpyctl"),
+		chirpyclient.WithTokenCallback(func(tokens chirpyclient.Tokens) {
+			creds := a.creds.get(a.server)
+			creds.Tokens = tokens
+			if err := a.creds.set(a.server, creds); err != nil {
+				fmt.Fprintf(a.stderr, "chirpyctl: failed to cache credentials: %s\n", err)
+			}
+		}),
+	)
+}
+
+// loggedInClient is client for commands that need a login
+func (a *app) loggedInClient() (*chirpyclient.Client, error) {
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Tokens().AccessToken == "" {
+		return nil, fmt.Errorf("not logged in to %s, run chirpyctl login first", a.server)
+	}
+
+	return c, nil
+}
+
+// subcommand splits the subcommand off args, printing the group's usage if there is none
+func (a *app) subcommand(group string, args []string, subcommands string) (string, []string, error) {
+	help := func() {
+		fmt.Fprintf(a.stderr, "usage: chirpyctl %s <subcommand> [arguments]\n\nsubcommands:\n%s", group, subcommands)
+	}
+
+	switch {
+	case len(args) == 0:
+		help()
+		return "", nil, fmt.Errorf("missing %s subcommand", group)
+	case args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help":
+		help()
+		return "", nil, flag.ErrHelp
+	}
+
+	return args[0], args[1:], nil
+}
+
+// unknownSubcommand reports a subcommand that the group doesn't have
+func unknownSubcommand(group, sub string) error {
+	return fmt.Errorf("unknown %s subcommand %q, see chirpyctl %s -h", group, sub, group)
+}
+
+// flagSet returns a FlagSet for a (sub)command that reports errors instead of exiting
+func (a *app) flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "usage: chirpyctl %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// print writes v as indented JSON with -json, or calls human otherwise
+func (a *app) print(v any, human func(w io.Writer)) error {
+	if !a.jsonOut {
+		human(a.stdout)
+		return nil
+	}
+
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sebito91/bootdotdev/go/chirpy/chirpyclient"
+)
+
+const usersSubcommands = `  list            list every user
+  get ID          show a single user
+  create          sign up a new user
+  update          update the logged in user's account and profile
+  delete          delete the logged in user's account
+  upgrade ID      grant a user Chirpy Red through the Polka webhook
+`
+
+// users dispatches the users subcommands
+func (a *app) users(ctx context.Context, args []string) error {
+	sub, args, err := a.subcommand("users", args, usersSubcommands)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		return a.usersList(ctx, args)
+	case "get":
+		return a.usersGet(ctx, args)
+	case "create":
+		return a.usersCreate(ctx, args)
+	case "update":
+		return a.usersUpdate(ctx, args)
+	case "delete":
+		return a.usersDelete(ctx, args)
+	case "upgrade":
+		return a.usersUpgrade(ctx, args)
+	}
+
+	return unknownSubcommand("users", sub)
+}
+
+func (a *app) usersList(ctx context.Context, args []string) error {
+	fs := a.flagSet("users list", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	users, err := c.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	return a.print(users, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tEMAIL\tHANDLE\tRED")
+		for _, user := range users {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", user.ID, user.Email, user.Handle, user.IsChirpyRed)
+		}
+
+		tw.Flush()
+	})
+}
+
+func (a *app) usersGet(ctx context.Context, args []string) error {
+	fs := a.flagSet("users get", "ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := idArg(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	user, err := c.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return a.print(user, func(w io.Writer) {
+		printUser(w, user)
+	})
+}
+
+func (a *app) usersCreate(ctx context.Context, args []string) error {
+	fs := a.flagSet("users create", "-email EMAIL [-password-stdin]")
+	email := fs.String("email", "", "email address of the new user")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin instead of prompting")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *email == "" {
+		return errors.New("expected an -email for the new user")
+	}
+
+	password, err := a.newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	user, err := c.CreateUser(ctx, *email, password)
+	if err != nil {
+		return err
+	}
+
+	return a.print(user, func(w io.Writer) {
+		printUser(w, user)
+	})
+}
+
+// usersUpdate sends only the flags that were set, so that an empty value clears a profile field
+func (a *app) usersUpdate(ctx context.Context, args []string) error {
+	fs := a.flagSet("users update", "[-email EMAIL] [-password] [-handle H] [-display-name N] [-bio B] [-avatar-url U]")
+	fs.String("email", "", "new email address, needs the current password")
+	changePassword := fs.Bool("password", false, "prompt for a new password, needs the current password")
+	fs.String("handle", "", "new handle, empty to clear it")
+	fs.String("display-name", "", "new display name, empty to clear it")
+	fs.String("bio", "", "new bio, empty to clear it")
+	fs.String("avatar-url", "", "new avatar URL, empty to clear it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var update chirpyclient.UserUpdate
+	fields := map[string]**string{
+		"email":        &update.Email,
+		"handle":       &update.Handle,
+		"display-name": &update.DisplayName,
+		"bio":          &update.Bio,
+		"avatar-url":   &update.AvatarURL,
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if field, ok := fields[f.Name]; ok {
+			value := f.Value.String()
+			*field = &value
+		}
+	})
+
+	if update.Email == nil && !*changePassword && update.Handle == nil && update.DisplayName == nil &&
+		update.Bio == nil && update.AvatarURL == nil {
+		return errors.New("nothing to update, see chirpyctl users update -h")
+	}
+
+	c, err := a.loggedInClient()
+	if err != nil {
+		return err
+	}
+
+	if update.Email != nil || *changePassword {
+		if update.CurrentPassword, err = a.prompt("Current password: ", true); err != nil {
+			return err
+		}
+	}
+
+	if *changePassword {
+		password, err := a.newPassword(false)
+		if err != nil {
+			return err
+		}
+
+		update.Password = &password
+	}
+
+	user, err := c.UpdateUser(ctx, update)
+	if err != nil {
+		return err
+	}
+
+	if update.Email != nil {
+		creds := a.creds.get(a.server)
+		creds.Email = user.Email
+		if err := a.creds.set(a.server, creds); err != nil {
+			fmt.Fprintf(a.stderr, "chirpyctl: failed to cache credentials: %s\n", err)
+		}
+	}
+
+	return a.print(user, func(w io.Writer) {
+		printUser(w, user)
+	})
+}
+
+// usersDelete deletes the logged in user after confirming their password, which also ends the login
+func (a *app) usersDelete(ctx context.Context, args []string) error {
+	fs := a.flagSet("users delete", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := a.loggedInClient()
+	if err != nil {
+		return err
+	}
+
+	creds := a.creds.get(a.server)
+	password, err := a.prompt(fmt.Sprintf("Password of %s to confirm deleting the account: ", creds.Email), true)
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeleteUser(ctx, password); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stderr, "deleted user %d (%s) and logged out\n", creds.UserID, creds.Email)
+	return nil
+}
+
+func (a *app) usersUpgrade(ctx context.Context, args []string) error {
+	fs := a.flagSet("users upgrade", "[-polka-key KEY] ID")
+	apiKey := fs.String("polka-key", os.Getenv("POLKA_API_KEY"), "Polka API key the server was configured with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := idArg(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	if *apiKey == "" {
+		return errors.New("expected a -polka-key or $POLKA_API_KEY")
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	if err := c.UpgradeUser(ctx, *apiKey, id); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stderr, "upgraded user %d to Chirpy Red\n", id)
+	return nil
+}
+
+// newPassword reads a new password from stdin, or prompts for it twice
+func (a *app) newPassword(fromStdin bool) (string, error) {
+	if fromStdin {
+		return a.readLine()
+	}
+
+	password, err := a.prompt("New password: ", true)
+	if err != nil {
+		return "", err
+	}
+
+	confirm, err := a.prompt("Repeat new password: ", true)
+	if err != nil {
+		return "", err
+	}
+
+	if password != confirm {
+		return "", errors.New("the passwords don't match")
+	}
+
+	return password, nil
+}
+
+func printUser(w io.Writer, user chirpyclient.User) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%d\n", user.ID)
+	fmt.Fprintf(tw, "Email:\t%s\n", user.Email)
+	fmt.Fprintf(tw, "Chirpy Red:\t%t\n", user.IsChirpyRed)
+	for _, field := range []struct{ name, value string }{
+		{"Handle", user.Handle},
+		{"Display name", user.DisplayName},
+		{"Bio", user.Bio},
+		{"Avatar URL", user.AvatarURL},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+
+	tw.Flush()
+}
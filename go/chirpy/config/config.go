@@ -0,0 +1,455 @@
+// Package config loads the chirpy server configuration. Values are layered, each source overriding the
+// one before it: built-in defaults, an optional YAML or TOML file, environment variables (including a
+// .env file if present) and finally command-line flags.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"github.com/sebito91/bootdotdev/go/chirpy/password"
+	"github.com/sebito91/bootdotdev/go/cors"
+	"github.com/sebito91/bootdotdev/go/tlsserver"
+	"gopkg.in/yaml.v3"
+)
+
+// account deletion modes, see Config.AccountDeletionMode
+const (
+	DeletionCascade   = "cascade"
+	DeletionAnonymize = "anonymize"
+)
+
+// RateLimit is a token bucket per client: Burst requests at most, refilled at PerMinute requests per
+// minute. Chirpy Red members get the Red* quotas instead.
+type RateLimit struct {
+	PerMinute    int `yaml:"per_minute" toml:"per_minute"`
+	Burst        int `yaml:"burst" toml:"burst"`
+	RedPerMinute int `yaml:"red_per_minute" toml:"red_per_minute"`
+	RedBurst     int `yaml:"red_burst" toml:"red_burst"`
+}
+
+// Config is the full set of settings for the chirpy server
+type Config struct {
+	// ListenAddr is the host:port the HTTP server binds to
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// DBPath is the location of the JSON database file
+	DBPath string `yaml:"db_path" toml:"db_path"`
+
+	// JWTSecret signs every access, refresh and two-factor challenge token
+	JWTSecret string `yaml:"jwt_secret" toml:"jwt_secret"`
+	// PolkaAPIKey authenticates the Polka payment webhooks
+	PolkaAPIKey string `yaml:"polka_api_key" toml:"polka_api_key"`
+	// AdminAPIKey protects the moderation, metrics and analytics endpoints and the console under /admin,
+	// which are disabled without it
+	AdminAPIKey string `yaml:"admin_api_key" toml:"admin_api_key"`
+
+	// AccessTokenTTL, RefreshTokenTTL and ChallengeTokenTTL are the lifetimes of the issued JWTs
+	AccessTokenTTL    time.Duration `yaml:"access_token_ttl" toml:"access_token_ttl"`
+	RefreshTokenTTL   time.Duration `yaml:"refresh_token_ttl" toml:"refresh_token_ttl"`
+	ChallengeTokenTTL time.Duration `yaml:"challenge_token_ttl" toml:"challenge_token_ttl"`
+
+	// ChirpMaxLength is the longest chirp body accepted, in characters
+	ChirpMaxLength int `yaml:"chirp_max_length" toml:"chirp_max_length"`
+
+	// AccountDeletionMode is either "cascade" to remove a deleted user's chirps as well, or "anonymize"
+	// to keep their chirps detached from the account
+	AccountDeletionMode string `yaml:"account_deletion_mode" toml:"account_deletion_mode"`
+
+	// PasswordMinLength and PasswordMinCharClasses tighten the password policy for new passwords
+	PasswordMinLength      int `yaml:"password_min_length" toml:"password_min_length"`
+	PasswordMinCharClasses int `yaml:"password_min_char_classes" toml:"password_min_char_classes"`
+
+	// ShutdownTimeout is how long in-flight requests get to finish on shutdown, and ShutdownDrainDelay how
+	// long /api/healthz reports unhealthy before the listener closes
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" toml:"shutdown_drain_delay"`
+
+	// RateLimitAuth, RateLimitWrite and RateLimitDefault limit the login and token routes, the routes
+	// creating content and every other API route, per user or per IP address for anonymous clients
+	RateLimitAuth    RateLimit `yaml:"rate_limit_auth" toml:"rate_limit_auth"`
+	RateLimitWrite   RateLimit `yaml:"rate_limit_write" toml:"rate_limit_write"`
+	RateLimitDefault RateLimit `yaml:"rate_limit_default" toml:"rate_limit_default"`
+
+	// AnalyticsFlushInterval is how often the traffic analytics counted in memory are written to the database
+	AnalyticsFlushInterval time.Duration `yaml:"analytics_flush_interval" toml:"analytics_flush_interval"`
+
+	// StaticCacheMaxAge is how long browsers may cache the web app's assets; HTML is always revalidated
+	StaticCacheMaxAge time.Duration `yaml:"static_cache_max_age" toml:"static_cache_max_age"`
+	// StaticSPAFallback serves index.html for unknown paths without a file extension
+	StaticSPAFallback bool `yaml:"static_spa_fallback" toml:"static_spa_fallback"`
+
+	// TLSCertFile and TLSKeyFile switch the listener to HTTPS; the pair is reloaded on SIGHUP and checked
+	// for changes every TLSReloadInterval
+	TLSCertFile       string        `yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile        string        `yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval" toml:"tls_reload_interval"`
+	// TLSSelfSigned serves HTTPS with a freshly generated self-signed certificate, for local testing only
+	TLSSelfSigned bool `yaml:"tls_self_signed" toml:"tls_self_signed"`
+	// HTTPRedirectAddr, if set, starts a plain HTTP listener on that address redirecting to HTTPS
+	HTTPRedirectAddr string `yaml:"http_redirect_addr" toml:"http_redirect_addr"`
+	// HSTSMaxAge, if positive, sends Strict-Transport-Security with that max-age on HTTPS responses
+	HSTSMaxAge time.Duration `yaml:"hsts_max_age" toml:"hsts_max_age"`
+
+	// CORSAllowedOrigins lists the origins allowed to call /api and the site, wildcards such as
+	// "https://*.example.com" included; CORSAdminAllowedOrigins does the same for /admin, which is closed
+	// to cross-origin callers by default
+	CORSAllowedOrigins      []string `yaml:"cors_allowed_origins" toml:"cors_allowed_origins"`
+	CORSAdminAllowedOrigins []string `yaml:"cors_admin_allowed_origins" toml:"cors_admin_allowed_origins"`
+	// CORSAllowedHeaders and CORSExposedHeaders list the request headers browsers may send and the
+	// response headers scripts may read
+	CORSAllowedHeaders []string `yaml:"cors_allowed_headers" toml:"cors_allowed_headers"`
+	CORSExposedHeaders []string `yaml:"cors_exposed_headers" toml:"cors_exposed_headers"`
+	// CORSAllowCredentials lets browsers send credentials cross-origin; it needs explicit origins
+	CORSAllowCredentials bool `yaml:"cors_allow_credentials" toml:"cors_allow_credentials"`
+	// CORSMaxAge is how long browsers may cache a preflight response
+	CORSMaxAge time.Duration `yaml:"cors_max_age" toml:"cors_max_age"`
+}
+
+// CORSPolicy returns the CORS policy for a route group reachable from the given origins with the given methods
+func (c Config) CORSPolicy(origins []string, methods ...string) cors.Policy {
+	return cors.Policy{
+		AllowedOrigins:   origins,
+		AllowedMethods:   methods,
+		AllowedHeaders:   c.CORSAllowedHeaders,
+		ExposedHeaders:   c.CORSExposedHeaders,
+		AllowCredentials: c.CORSAllowCredentials,
+		MaxAge:           c.CORSMaxAge,
+	}
+}
+
+// TLSOptions returns where the server takes its certificate from, see TLSEnabled
+func (c Config) TLSOptions() tlsserver.Options {
+	host, _, _ := net.SplitHostPort(c.ListenAddr)
+	return tlsserver.Options{
+		CertFile:       c.TLSCertFile,
+		KeyFile:        c.TLSKeyFile,
+		SelfSigned:     c.TLSSelfSigned,
+		Hosts:          []string{host},
+		ReloadInterval: c.TLSReloadInterval,
+	}
+}
+
+// TLSEnabled reports whether the server listens with HTTPS
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSSelfSigned
+}
+
+// Default returns the configuration used when nothing else is set. The secrets have no defaults.
+func Default() Config {
+	return Config{
+		ListenAddr:             "localhost:8080",
+		DBPath:                 "./database.json",
+		AccessTokenTTL:         time.Hour,
+		RefreshTokenTTL:        60 * 24 * time.Hour,
+		ChallengeTokenTTL:      5 * time.Minute,
+		ChirpMaxLength:         140,
+		AccountDeletionMode:    DeletionCascade,
+		PasswordMinLength:      password.DefaultPolicy.MinLength,
+		PasswordMinCharClasses: password.DefaultPolicy.MinCharClasses,
+		ShutdownTimeout:        15 * time.Second,
+		RateLimitAuth:          RateLimit{PerMinute: 10, Burst: 5, RedPerMinute: 10, RedBurst: 5},
+		RateLimitWrite:         RateLimit{PerMinute: 30, Burst: 10, RedPerMinute: 120, RedBurst: 30},
+		RateLimitDefault:       RateLimit{PerMinute: 300, Burst: 60, RedPerMinute: 600, RedBurst: 120},
+		AnalyticsFlushInterval: 30 * time.Second,
+		StaticCacheMaxAge:      time.Hour,
+		TLSReloadInterval:      10 * time.Second,
+		CORSAllowedOrigins:     []string{"*"},
+		CORSAllowedHeaders:     []string{"Authorization", "Content-Type", "X-Request-ID"},
+		CORSExposedHeaders:     []string{"X-Request-ID", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+		CORSMaxAge:             10 * time.Minute,
+	}
+}
+
+// setting binds one field of the Config to its environment variable and, unless it is a secret, its flag
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	target interface{}
+}
+
+// settings lists every Config field that can be overridden from the environment or the command line.
+// Secrets deliberately have no flag so that they never show up in the process list.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"LISTEN_ADDR", "listen", "host:port to listen on", &c.ListenAddr},
+		{"DB_PATH", "db", "path to the JSON database file", &c.DBPath},
+		{"JWT_SECRET", "", "secret used to sign JWTs", &c.JWTSecret},
+		{"POLKA_API_KEY", "", "API key expected on Polka webhooks", &c.PolkaAPIKey},
+		{"ADMIN_API_KEY", "", "API key for the admin moderation, metrics and analytics endpoints", &c.AdminAPIKey},
+		{"ACCESS_TOKEN_TTL", "access-token-ttl", "lifetime of access tokens", &c.AccessTokenTTL},
+		{"REFRESH_TOKEN_TTL", "refresh-token-ttl", "lifetime of refresh tokens", &c.RefreshTokenTTL},
+		{"CHALLENGE_TOKEN_TTL", "challenge-token-ttl", "lifetime of two-factor challenge tokens", &c.ChallengeTokenTTL},
+		{"CHIRP_MAX_LENGTH", "chirp-max-length", "maximum chirp length in characters", &c.ChirpMaxLength},
+		{"ACCOUNT_DELETION_MODE", "account-deletion-mode", "cascade or anonymize", &c.AccountDeletionMode},
+		{"PASSWORD_MIN_LENGTH", "password-min-length", "minimum password length", &c.PasswordMinLength},
+		{"PASSWORD_MIN_CHAR_CLASSES", "password-min-char-classes", "minimum character classes in a password", &c.PasswordMinCharClasses},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "time allowed for in-flight requests on shutdown", &c.ShutdownTimeout},
+		{"SHUTDOWN_DRAIN_DELAY", "shutdown-drain-delay", "time to report unhealthy before closing the listener", &c.ShutdownDrainDelay},
+		{"RATE_LIMIT_AUTH", "rate-limit-auth", "login and token rate limit as per_minute,burst,red_per_minute,red_burst", &c.RateLimitAuth},
+		{"RATE_LIMIT_WRITE", "rate-limit-write", "write rate limit as per_minute,burst,red_per_minute,red_burst", &c.RateLimitWrite},
+		{"RATE_LIMIT_DEFAULT", "rate-limit-default", "rate limit of the other API routes as per_minute,burst,red_per_minute,red_burst", &c.RateLimitDefault},
+		{"ANALYTICS_FLUSH_INTERVAL", "analytics-flush-interval", "how often traffic analytics are written to the database", &c.AnalyticsFlushInterval},
+		{"STATIC_CACHE_MAX_AGE", "static-cache-max-age", "how long browsers may cache the web app's assets", &c.StaticCacheMaxAge},
+		{"STATIC_SPA_FALLBACK", "static-spa-fallback", "serve index.html for unknown app routes", &c.StaticSPAFallback},
+		{"TLS_CERT_FILE", "tls-cert", "path to the PEM TLS certificate", &c.TLSCertFile},
+		{"TLS_KEY_FILE", "tls-key", "path to the PEM TLS private key", &c.TLSKeyFile},
+		{"TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often to check the TLS files for changes", &c.TLSReloadInterval},
+		{"TLS_SELF_SIGNED", "tls-self-signed", "serve HTTPS with a generated self-signed certificate (development only)", &c.TLSSelfSigned},
+		{"HTTP_REDIRECT_ADDR", "http-redirect-addr", "host:port of a plain HTTP listener redirecting to HTTPS", &c.HTTPRedirectAddr},
+		{"HSTS_MAX_AGE", "hsts-max-age", "max-age of the Strict-Transport-Security header, 0 to disable", &c.HSTSMaxAge},
+		{"CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma-separated origins allowed to call the API", &c.CORSAllowedOrigins},
+		{"CORS_ADMIN_ALLOWED_ORIGINS", "cors-admin-allowed-origins", "comma-separated origins allowed to call /admin", &c.CORSAdminAllowedOrigins},
+		{"CORS_ALLOWED_HEADERS", "cors-allowed-headers", "comma-separated request headers allowed cross-origin", &c.CORSAllowedHeaders},
+		{"CORS_EXPOSED_HEADERS", "cors-exposed-headers", "comma-separated response headers exposed cross-origin", &c.CORSExposedHeaders},
+		{"CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "allow credentials on cross-origin requests", &c.CORSAllowCredentials},
+		{"CORS_MAX_AGE", "cors-max-age", "how long browsers may cache preflight responses", &c.CORSMaxAge},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the given
+// command-line arguments (without the program name), then validates it. The config file is taken from
+// the -config flag or the CHIRPY_CONFIG environment variable; a missing .env file is not an error.
+func Load(args []string, stderr io.Writer) (Config, error) {
+	cfg := Default()
+
+	// collect the flags first and apply them last, so they win over the file and the environment
+	fs := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configPath := fs.String("config", "", "path to a YAML or TOML config file (env CHIRPY_CONFIG)")
+	flagValues := make(map[string]string)
+	for _, s := range cfg.settings() {
+		if s.flag == "" {
+			continue
+		}
+
+		name, usage := s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		setFlag := func(val string) error {
+			flagValues[name] = val
+			return nil
+		}
+
+		// boolean settings can be given as a bare -flag
+		if _, ok := s.target.(*bool); ok {
+			fs.BoolFunc(name, usage, setFlag)
+		} else {
+			fs.Func(name, usage, setFlag)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cfg, fmt.Errorf("could not load .env file: %s", err)
+	}
+
+	if *configPath == "" {
+		*configPath = os.Getenv("CHIRPY_CONFIG")
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if val, ok := os.LookupEnv(s.env); ok && val != "" {
+			if err := setValue(s.target, val); err != nil {
+				return cfg, fmt.Errorf("invalid value for %s: %s", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if val, ok := flagValues[s.flag]; ok && s.flag != "" {
+			if err := setValue(s.target, val); err != nil {
+				return cfg, fmt.Errorf("invalid value for -%s: %s", s.flag, err)
+			}
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// loadFile overlays the settings from a YAML (.yaml, .yml) or TOML (.toml) file onto the config. Keys
+// missing from the file keep their current values.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %s", err)
+	}
+
+	// unknown keys are rejected so that a typo does not silently fall back to the default
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("could not parse YAML config file %s: %s", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("could not parse TOML config file %s: %s", path, err)
+		}
+
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown keys in TOML config file %s: %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("expected config file to end in .yaml, .yml or .toml, got %s", path)
+	}
+
+	return nil
+}
+
+// setValue parses val into the field pointed to by target
+func setValue(target interface{}, val string) error {
+	switch t := target.(type) {
+	case *string:
+		*t = val
+	case *int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("expected integer, got %s", val)
+		}
+
+		*t = n
+	case *[]string:
+		*t = cors.ParseList(val)
+	case *bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %s", val)
+		}
+
+		*t = b
+	case *time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("expected duration such as 90s or 1h, got %s", val)
+		}
+
+		*t = d
+	case *RateLimit:
+		var limits []int
+		for _, field := range cors.ParseList(val) {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("expected per_minute,burst,red_per_minute,red_burst, got %s", val)
+			}
+
+			limits = append(limits, n)
+		}
+
+		if len(limits) != 4 {
+			return fmt.Errorf("expected per_minute,burst,red_per_minute,red_burst, got %s", val)
+		}
+
+		*t = RateLimit{PerMinute: limits[0], Burst: limits[1], RedPerMinute: limits[2], RedBurst: limits[3]}
+	default:
+		return fmt.Errorf("unsupported setting type %T", target)
+	}
+
+	return nil
+}
+
+// Validate checks that every setting is usable, reporting all of the problems at once
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.JWTSecret == "" {
+		errs = append(errs, errors.New("missing secret JWT_SECRET: set it in the environment, a .env file or jwt_secret in the config file"))
+	}
+
+	if c.PolkaAPIKey == "" {
+		errs = append(errs, errors.New("missing secret POLKA_API_KEY: set it in the environment, a .env file or polka_api_key in the config file"))
+	}
+
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen address cannot be empty"))
+	}
+
+	if c.DBPath == "" {
+		errs = append(errs, errors.New("database path cannot be empty"))
+	}
+
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 || c.ChallengeTokenTTL <= 0 {
+		errs = append(errs, errors.New("token lifetimes must be positive"))
+	} else if c.RefreshTokenTTL < c.AccessTokenTTL {
+		errs = append(errs, fmt.Errorf("refresh token lifetime (%s) must not be shorter than the access token lifetime (%s)", c.RefreshTokenTTL, c.AccessTokenTTL))
+	}
+
+	if c.ChirpMaxLength <= 0 {
+		errs = append(errs, fmt.Errorf("expected positive chirp max length, got %d", c.ChirpMaxLength))
+	}
+
+	if c.AccountDeletionMode != DeletionCascade && c.AccountDeletionMode != DeletionAnonymize {
+		errs = append(errs, fmt.Errorf("expected account deletion mode to be one of cascade or anonymize, got %s", c.AccountDeletionMode))
+	}
+
+	if c.PasswordMinLength <= 0 || c.PasswordMinLength > password.DefaultPolicy.MaxLength {
+		errs = append(errs, fmt.Errorf("expected password min length between 1 and %d, got %d", password.DefaultPolicy.MaxLength, c.PasswordMinLength))
+	}
+
+	if c.PasswordMinCharClasses < 1 || c.PasswordMinCharClasses > 4 {
+		errs = append(errs, fmt.Errorf("expected password min char classes between 1 and 4, got %d", c.PasswordMinCharClasses))
+	}
+
+	if c.ShutdownTimeout <= 0 || c.ShutdownDrainDelay < 0 {
+		errs = append(errs, errors.New("shutdown timeout must be positive and drain delay must not be negative"))
+	}
+
+	for name, limit := range map[string]RateLimit{"auth": c.RateLimitAuth, "write": c.RateLimitWrite, "default": c.RateLimitDefault} {
+		if limit.PerMinute <= 0 || limit.Burst <= 0 || limit.RedPerMinute <= 0 || limit.RedBurst <= 0 {
+			errs = append(errs, fmt.Errorf("expected positive %s rate limit and burst, got %+v", name, limit))
+		}
+	}
+
+	if c.AnalyticsFlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("expected positive analytics flush interval, got %s", c.AnalyticsFlushInterval))
+	}
+
+	if c.StaticCacheMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("expected non-negative static cache max age, got %s", c.StaticCacheMaxAge))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS needs both TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+
+	if c.TLSSelfSigned && c.TLSCertFile != "" {
+		errs = append(errs, errors.New("TLS_SELF_SIGNED cannot be combined with TLS_CERT_FILE"))
+	}
+
+	if c.TLSReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("expected positive TLS reload interval, got %s", c.TLSReloadInterval))
+	}
+
+	if !c.TLSEnabled() && (c.HTTPRedirectAddr != "" || c.HSTSMaxAge > 0) {
+		errs = append(errs, errors.New("HTTP_REDIRECT_ADDR and HSTS_MAX_AGE require TLS to be enabled"))
+	}
+
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("expected HSTS max age not to be negative, got %s", c.HSTSMaxAge))
+	}
+
+	errs = append(errs, c.CORSPolicy(c.CORSAllowedOrigins).Validate(), c.CORSPolicy(c.CORSAdminAllowedOrigins).Validate())
+
+	return errors.Join(errs...)
+}
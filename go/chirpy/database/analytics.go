@@ -0,0 +1,236 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// granularities of the stored analytics buckets
+const (
+	AnalyticsHourly = "hour"
+	AnalyticsDaily  = "day"
+)
+
+// how long analytics buckets are kept before being pruned
+const (
+	hourlyRetention = 31 * 24 * time.Hour
+	dailyRetention  = 400 * 24 * time.Hour
+)
+
+// AnalyticsBucket is the traffic seen during one hour or one day (UTC), starting at Start. Paths counts
+// the API calls by route and the page views by asset, so that neither grows with the URLs clients make up.
+type AnalyticsBucket struct {
+	Start     time.Time      `json:"start"`
+	Requests  int            `json:"requests"`
+	PageViews int            `json:"page_views"`
+	APICalls  int            `json:"api_calls"`
+	Paths     map[string]int `json:"paths"`
+	Statuses  map[string]int `json:"statuses"`
+	Visitors  VisitorSketch  `json:"visitors,omitempty"`
+}
+
+// Merge adds the traffic counted in other to the bucket
+func (b *AnalyticsBucket) Merge(other AnalyticsBucket) {
+	b.Requests += other.Requests
+	b.PageViews += other.PageViews
+	b.APICalls += other.APICalls
+
+	if b.Paths == nil {
+		b.Paths = make(map[string]int, len(other.Paths))
+	}
+
+	for path, count := range other.Paths {
+		b.Paths[path] += count
+	}
+
+	if b.Statuses == nil {
+		b.Statuses = make(map[string]int, len(other.Statuses))
+	}
+
+	for status, count := range other.Statuses {
+		b.Statuses[status] += count
+	}
+
+	b.Visitors.Merge(other.Visitors)
+}
+
+// sketchPrecision is the number of hash bits picking a VisitorSketch register; 8 bits keep a bucket's
+// sketch at 256 bytes for a standard error of about 6.5%
+const sketchPrecision = 8
+
+// VisitorSketch is a HyperLogLog sketch of the unique visitors of a bucket. It estimates their number in
+// a fixed size, never holding the visitor IDs themselves, and sketches of overlapping traffic can be merged
+// without counting a visitor twice. A nil sketch has seen no visitors.
+type VisitorSketch []byte
+
+// Add counts the visitor with the given pseudonymous ID, which must be uniformly distributed like a hash
+func (s *VisitorSketch) Add(visitorID uint64) {
+	if *s == nil {
+		*s = make(VisitorSketch, 1<<sketchPrecision)
+	}
+
+	register := visitorID >> (64 - sketchPrecision)
+	// the low bit set caps the rank for IDs whose remaining bits are all zero
+	rank := byte(bits.LeadingZeros64(visitorID<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > (*s)[register] {
+		(*s)[register] = rank
+	}
+}
+
+// Merge adds the visitors counted in other to the sketch
+func (s *VisitorSketch) Merge(other VisitorSketch) {
+	if len(other) == 0 {
+		return
+	}
+
+	if *s == nil {
+		*s = make(VisitorSketch, len(other))
+	}
+
+	for i, rank := range other {
+		if rank > (*s)[i] {
+			(*s)[i] = rank
+		}
+	}
+}
+
+// Count estimates the number of unique visitors added to the sketch
+func (s VisitorSketch) Count() int {
+	if len(s) == 0 {
+		return 0
+	}
+
+	m := float64(len(s))
+	sum, zeros := 0.0, 0
+	for _, rank := range s {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate while many registers are still empty
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int(math.Round(estimate))
+}
+
+// UnmarshalJSON reads the base64 encoded sketch. Buckets written before the sketch listed the visitor IDs
+// as hex strings, which are counted into a new sketch.
+func (s *VisitorSketch) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte("[")) {
+		var visitorIDs []string
+		if err := json.Unmarshal(data, &visitorIDs); err != nil {
+			return err
+		}
+
+		*s = nil
+		for _, visitorID := range visitorIDs {
+			id, err := strconv.ParseUint(visitorID, 16, 64)
+			if err != nil {
+				return fmt.Errorf("could not parse visitor ID %q: %w", visitorID, err)
+			}
+
+			s.Add(id)
+		}
+
+		return nil
+	}
+
+	var registers []byte
+	if err := json.Unmarshal(data, &registers); err != nil {
+		return err
+	}
+
+	if len(registers) != 0 && len(registers) != 1<<sketchPrecision {
+		return fmt.Errorf("expected %d visitor sketch registers, got %d", 1<<sketchPrecision, len(registers))
+	}
+
+	*s = registers
+	return nil
+}
+
+// Analytics holds the persisted traffic buckets, keyed by the Unix time of their start
+type Analytics struct {
+	Hourly map[int64]AnalyticsBucket `json:"hourly"`
+	Daily  map[int64]AnalyticsBucket `json:"daily"`
+}
+
+// RecordAnalytics merges the given hourly and daily buckets, keyed by the Unix time of their start, into
+// the stored ones and prunes the buckets that have outlived their retention
+func (db *DB) RecordAnalytics(ctx context.Context, hourly, daily map[int64]AnalyticsBucket) error {
+	ctx, span := tracer.Start(ctx, "DB.RecordAnalytics")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		mergeBuckets(dbStructure.Analytics.Hourly, hourly, now.Add(-hourlyRetention))
+		mergeBuckets(dbStructure.Analytics.Daily, daily, now.Add(-dailyRetention))
+
+		return nil
+	})
+}
+
+// mergeBuckets adds the updates to the stored buckets and drops any bucket that started before cutoff
+func mergeBuckets(stored, updates map[int64]AnalyticsBucket, cutoff time.Time) {
+	for start, update := range updates {
+		bucket, ok := stored[start]
+		if !ok {
+			bucket = AnalyticsBucket{Start: update.Start}
+		}
+
+		bucket.Merge(update)
+		stored[start] = bucket
+	}
+
+	for start := range stored {
+		if time.Unix(start, 0).Before(cutoff) {
+			delete(stored, start)
+		}
+	}
+}
+
+// GetAnalytics returns the stored buckets of the given granularity that start within [from, to), ordered
+// by start time. Periods without traffic have no bucket.
+func (db *DB) GetAnalytics(ctx context.Context, granularity string, from, to time.Time) ([]AnalyticsBucket, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetAnalytics")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored map[int64]AnalyticsBucket
+	switch granularity {
+	case AnalyticsHourly:
+		stored = dbStructure.Analytics.Hourly
+	case AnalyticsDaily:
+		stored = dbStructure.Analytics.Daily
+	default:
+		return nil, fmt.Errorf("expected analytics granularity of %s or %s, got %s", AnalyticsHourly, AnalyticsDaily, granularity)
+	}
+
+	buckets := make([]AnalyticsBucket, 0)
+	for start, bucket := range stored {
+		if t := time.Unix(start, 0); !t.Before(from) && t.Before(to) {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	sort.Slice(buckets, func(a, b int) bool {
+		return buckets[a].Start.Before(buckets[b].Start)
+	})
+
+	return buckets, nil
+}
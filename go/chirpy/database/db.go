@@ -1,62 +1,208 @@
 package database
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer starts a span for every database method and file operation
+var tracer = otel.Tracer("github.com/sebito91/bootdotdev/go/chirpy/database")
+
+// ErrNotFound is wrapped by errors for records that do not exist in the database
+var ErrNotFound = errors.New("not found")
+
+// ErrClosed is returned by every operation once the database has been closed
+var ErrClosed = errors.New("database is closed")
+
+// ErrLocked is returned by NewDB while another process has the database open
+var ErrLocked = errors.New("database is in use by another process")
+
+// ErrDuplicate is wrapped by errors for records that would violate a uniqueness constraint
+var ErrDuplicate = errors.New("already exists")
+
+// ErrBlocked is wrapped by errors for actions that one of the users involved has blocked
+var ErrBlocked = errors.New("blocked")
+
+// ErrAlreadyUsed is wrapped by errors for single-use credentials that have already been consumed
+var ErrAlreadyUsed = errors.New("already used")
+
 // DB is the struct to point at our database.json file
 type DB struct {
 	path string
-	mux  sync.RWMutex
+	// lock holds the exclusive lock on the file next to the database, see NewDB
+	lock   *os.File
+	closed bool
+	// mux guards the database file, see loadDB and update
+	mux sync.RWMutex
+
+	observer    Observer
+	observerMux sync.Mutex
 }
 
+// Observer is notified after every read or write of the database file with the operation ("load" or
+// "write"), how long it took and the error, if any
+type Observer func(op string, elapsed time.Duration, err error)
+
 // Chirp is the default struct for each individual chirp within the system
 type Chirp struct {
 	ID       int    `json:"id"`
 	AuthorID int    `json:"author_id"`
 	Body     string `json:"body"`
+	Hidden   bool   `json:"hidden,omitempty"`
 }
 
-// User is the default struct to represent an individual user in the database
+// User is the default struct to represent an individual user in the database, including their public profile
 type User struct {
 	ID          int    `json:"id"`
 	Email       string `json:"email"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// UserUpdate is the set of changes to apply to an existing user; nil fields are left untouched
+type UserUpdate struct {
+	Email        *string
+	PasswordHash []byte
+	Handle       *string
+	DisplayName  *string
+	Bio          *string
+	AvatarURL    *string
 }
 
-// UserWithPassword is a superset struct for a given user that appends their password (bcrypt-hashed)
+// UserWithPassword is a superset struct for a given user that appends their password hash; see the password
+// package for the supported formats
 type UserWithPassword struct {
 	User
-	PasswordHash []byte `json:"password"`
+	PasswordHash []byte     `json:"password"`
+	TwoFactor    TwoFactor  `json:"two_factor"`
+	Moderation   Moderation `json:"moderation"`
+	// BlockedUserIDs lists the users this user has blocked, see SetUserBlocked
+	BlockedUserIDs []int `json:"blocked_user_ids,omitempty"`
+}
+
+// account statuses, see Moderation
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusBanned    = "banned"
+)
+
+// Moderation records the action an admin has taken against a user. A suspension lifts on its own once
+// SuspendedUntil has passed, if set; a ban lasts until the user is reinstated.
+type Moderation struct {
+	Status         string     `json:"status,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// EffectiveStatus returns the status of the account at the given time, treating an expired suspension
+// as active
+func (m Moderation) EffectiveStatus(now time.Time) string {
+	switch {
+	case m.Status == StatusBanned:
+		return StatusBanned
+	case m.Status == StatusSuspended && (m.SuspendedUntil == nil || now.Before(*m.SuspendedUntil)):
+		return StatusSuspended
+	default:
+		return StatusActive
+	}
+}
+
+// TwoFactor holds the TOTP enrollment for a given user. The secret is only considered active
+// once Enabled is set, which happens after the user confirms a valid code.
+type TwoFactor struct {
+	Secret        string   `json:"secret,omitempty"`
+	Enabled       bool     `json:"enabled"`
+	LastUsedStep  int64    `json:"last_used_step,omitempty"`
+	RecoveryCodes [][]byte `json:"recovery_codes,omitempty"`
 }
 
 // RevokedToken is the struct to consume the revoked tokens within the database
 type RevokedToken struct {
 	RevokedAt time.Time `json:"revoked_at"`
 	Token     string    `json:"token"`
+	UserID    int       `json:"user_id,omitempty"`
+}
+
+// Session is the struct to track each refresh token issued to a user, along with the device it was issued to
+type Session struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PersonalAccessToken is the struct for a long-lived, scoped API token owned by a user. Only a hash
+// of the token is stored; the raw value is handed to the user once at creation time.
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	TokenHash  string     `json:"token_hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
 }
 
 // DBStructure is the interface to render the database
+// LastUserID tracks the highest userID ever issued so that IDs of deleted users are never reused
 type DBStructure struct {
+	LastUserID    int                      `json:"last_user_id"`
 	Chirps        map[int]Chirp            `json:"chirps"`
 	Users         map[int]UserWithPassword `json:"users"`
 	RevokedTokens map[int]RevokedToken     `json:"revoked_tokens"`
+	Sessions      map[int]Session          `json:"sessions"`
+
+	PersonalAccessTokens map[int]PersonalAccessToken `json:"personal_access_tokens"`
+
+	LastMessageID int                  `json:"last_message_id"`
+	Conversations map[int]Conversation `json:"conversations"`
+	Messages      map[int]Message      `json:"messages"`
+
+	Notifications map[int]Notification `json:"notifications"`
+
+	Analytics Analytics `json:"analytics"`
 }
 
 // NewDB creates a new database connection
-// and creates the database file if it doesn't exist
+// and creates the database file if it doesn't exist. It takes an exclusive lock on PATH.lock, held until
+// Close, and fails with ErrLocked if another process holds it. The lock can't be on the database file
+// itself since every write replaces it.
 func NewDB(path string) (*DB, error) {
 	if path == "" {
 		path = "./database.json"
 	}
 
-	db := &DB{path: path}
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{path: path, lock: lock}
 	if err := db.reassureDB(); err != nil {
+		lock.Close()
 		return nil, err
 	}
 
@@ -64,139 +210,77 @@ func NewDB(path string) (*DB, error) {
 }
 
 // CreateUser creates a new user and saves it to disk
-func (db *DB) CreateUser(email string, password []byte) (User, error) {
-	var user UserWithPassword
+func (db *DB) CreateUser(ctx context.Context, email string, password []byte) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateUser")
+	defer span.End()
 
-	nextUserID, err := db.getNextUserID()
-	if err != nil {
-		return user.User, err
-	}
-
-	user.ID = nextUserID
-	user.Email = email
-	user.PasswordHash = password
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return user.User, err
-	}
-
-	if _, ok := dbStructure.Users[user.ID]; ok {
-		return user.User, fmt.Errorf("expected unique userID but found duplicate at %d", user.ID)
-	}
+	var user UserWithPassword
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		user.ID = nextUserID(dbStructure)
+		user.Email = email
+		user.PasswordHash = password
 
-	// check if user already exists and throw an error if they do
-	for _, existingUser := range dbStructure.Users {
-		if user.Email == existingUser.Email {
-			return user.User, fmt.Errorf("found duplicate user with email %s", user.Email)
+		if _, ok := dbStructure.Users[user.ID]; ok {
+			return fmt.Errorf("expected unique userID but found duplicate at %d", user.ID)
 		}
-	}
-
-	dbStructure.Users[user.ID] = user
-	return user.User, db.writeDB(dbStructure)
-}
-
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(authorID int, body string) (Chirp, error) {
-	var chirp Chirp
-
-	nextChirpID, err := db.getNextChirpID()
-	if err != nil {
-		return chirp, err
-	}
-
-	chirp.ID = nextChirpID
-	chirp.AuthorID = authorID
-	chirp.Body = body
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return chirp, err
-	}
 
-	if _, ok := dbStructure.Chirps[chirp.ID]; ok {
-		return chirp, fmt.Errorf("expected unique chirpID but found duplicate at %d", chirp.ID)
-	}
-
-	dbStructure.Chirps[chirp.ID] = chirp
-	return chirp, db.writeDB(dbStructure)
-}
-
-// getNextRevokedTokenID is a helper function to determine the next revoked token ID from the database
-func (db *DB) getNextRevokedTokenID() (int, error) {
-	revokedTokens, err := db.GetRevokedTokens()
-	if err != nil {
-		return -1, err
-	}
-
-	if len(revokedTokens) == 0 {
-		return 1, nil
-	}
-
-	ids := make([]int, len(revokedTokens))
-	for idx, _ := range revokedTokens {
-		ids = append(ids, idx)
-	}
+		// check if user already exists and throw an error if they do
+		for _, existingUser := range dbStructure.Users {
+			if user.Email == existingUser.Email {
+				return fmt.Errorf("found duplicate user with email %s: %w", user.Email, ErrDuplicate)
+			}
+		}
 
-	// sort the IDs in descending order
-	sort.Slice(ids, func(a, b int) bool {
-		return ids[a] > ids[b]
+		dbStructure.Users[user.ID] = user
+		dbStructure.LastUserID = user.ID
+		return nil
 	})
 
-	return ids[0] + 1, nil
+	return user.User, err
 }
 
-// getNextUserID is a helper function to determine the next user's ID from the database
-func (db *DB) getNextUserID() (int, error) {
-	users, err := db.GetUsers()
-	if err != nil {
-		return -1, err
-	}
-
-	if len(users) == 0 {
-		return 1, nil
-	}
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(ctx context.Context, authorID int, body string) (Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateChirp")
+	defer span.End()
 
-	ids := make([]int, len(users))
-	for _, user := range users {
-		ids = append(ids, user.ID)
-	}
+	var chirp Chirp
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		chirp.ID = nextID(dbStructure.Chirps)
+		chirp.AuthorID = authorID
+		chirp.Body = body
 
-	// sort the IDs in descending order
-	sort.Slice(ids, func(a, b int) bool {
-		return ids[a] > ids[b]
+		dbStructure.Chirps[chirp.ID] = chirp
+		return nil
 	})
 
-	return ids[0] + 1, nil
+	return chirp, err
 }
 
-// getNextChirpID is a helper function to determine the next chirp's ID from the database
-func (db *DB) getNextChirpID() (int, error) {
-	chirps, err := db.GetChirps()
-	if err != nil {
-		return -1, err
-	}
-
-	if len(chirps) == 0 {
-		return 1, nil
-	}
-
-	ids := make([]int, len(chirps))
-	for _, chirp := range chirps {
-		ids = append(ids, chirp.ID)
+// nextID is a helper function to determine the next free ID of a table, one above the highest in use
+func nextID[T any](table map[int]T) int {
+	next := 1
+	for id := range table {
+		if id >= next {
+			next = id + 1
+		}
 	}
 
-	// sort the IDs in descending order
-	sort.Slice(ids, func(a, b int) bool {
-		return ids[a] > ids[b]
-	})
+	return next
+}
 
-	return ids[0] + 1, nil
+// nextUserID is a helper function to determine the next user's ID; user IDs are never reused, so it is
+// also above every ID issued before
+func nextUserID(dbStructure *DBStructure) int {
+	return max(nextID(dbStructure.Users), dbStructure.LastUserID+1)
 }
 
 // GetUsersFull return all users in the database with hashed passwords
-func (db *DB) GetUsersFull() ([]UserWithPassword, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetUsersFull(ctx context.Context) ([]UserWithPassword, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUsersFull")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -209,9 +293,30 @@ func (db *DB) GetUsersFull() ([]UserWithPassword, error) {
 	return users, nil
 }
 
+// GetUserFullByID returns the given user with hashed password and two-factor details, otherwise an error is returned
+func (db *DB) GetUserFullByID(ctx context.Context, userIDToFind int) (UserWithPassword, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUserFullByID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return UserWithPassword{}, err
+	}
+
+	user, ok := dbStructure.Users[userIDToFind]
+	if !ok {
+		return UserWithPassword{}, fmt.Errorf("could not find userID %d: %w", userIDToFind, ErrNotFound)
+	}
+
+	return user, nil
+}
+
 // GetUsers returns all users in the database
-func (db *DB) GetUsers() ([]User, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetUsers(ctx context.Context) ([]User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUsers")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -221,30 +326,38 @@ func (db *DB) GetUsers() ([]User, error) {
 		users = append(users, user.User)
 	}
 
+	// a stable order keeps the response, and so its ETag, the same until a user changes
+	sort.Slice(users, func(a, b int) bool {
+		return users[a].ID < users[b].ID
+	})
+
 	return users, nil
 }
 
 // GetUserByID returns the given user based on its ID, otherwise an error is returned
-func (db *DB) GetUserByID(userIDToFind int) (User, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetUserByID(ctx context.Context, userIDToFind int) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetUserByID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return User{}, err
 	}
 
 	user, ok := dbStructure.Users[userIDToFind]
 	if !ok {
-		return User{}, fmt.Errorf("could not find userID %d", userIDToFind)
+		return User{}, fmt.Errorf("could not find userID %d: %w", userIDToFind, ErrNotFound)
 	}
 
-	return User{
-		Email:       user.Email,
-		ID:          user.ID,
-		IsChirpyRed: user.IsChirpyRed}, nil
+	return user.User, nil
 }
 
 // GetChirps returns all chirps in the database
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetChirps(ctx context.Context) ([]Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetChirps")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -258,8 +371,11 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 }
 
 // GetChirpsByAuthorID returns all of the chirps by a given userID (author)
-func (db *DB) GetChirpsByAuthorID(authorID int) ([]Chirp, error) {
-	chirps, err := db.GetChirps()
+func (db *DB) GetChirpsByAuthorID(ctx context.Context, authorID int) ([]Chirp, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetChirpsByAuthorID")
+	defer span.End()
+
+	chirps, err := db.GetChirps(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -275,24 +391,62 @@ func (db *DB) GetChirpsByAuthorID(authorID int) ([]Chirp, error) {
 }
 
 // DeleteChirp will remove the provided chirp from the database
-func (db *DB) DeleteChirp(chirpToDelete Chirp) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+func (db *DB) DeleteChirp(ctx context.Context, chirpToDelete Chirp) error {
+	ctx, span := tracer.Start(ctx, "DB.DeleteChirp")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		for idx, chirp := range dbStructure.Chirps {
+			if chirp.ID == chirpToDelete.ID {
+				delete(dbStructure.Chirps, idx)
+			}
+		}
 
-	for idx, chirp := range dbStructure.Chirps {
-		if chirp.ID == chirpToDelete.ID {
-			delete(dbStructure.Chirps, idx)
+		// notifications about the chirp would only lead to a 404
+		for id, notification := range dbStructure.Notifications {
+			if notification.ChirpID == chirpToDelete.ID {
+				delete(dbStructure.Notifications, id)
+			}
 		}
-	}
 
-	return db.writeDB(dbStructure)
+		return nil
+	})
+}
+
+// SetChirpHidden will hide the given chirp from every public listing, or show it again. It reports
+// whether the chirp was changed, which is false if it already was in the requested state.
+func (db *DB) SetChirpHidden(ctx context.Context, chirpID int, hidden bool) (Chirp, bool, error) {
+	ctx, span := tracer.Start(ctx, "DB.SetChirpHidden")
+	defer span.End()
+
+	var chirp Chirp
+	changed := false
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		var ok bool
+		if chirp, ok = dbStructure.Chirps[chirpID]; !ok {
+			return fmt.Errorf("could not find chirpID %d: %w", chirpID, ErrNotFound)
+		}
+
+		if chirp.Hidden == hidden {
+			return errUnchanged
+		}
+
+		chirp.Hidden = hidden
+		changed = true
+
+		dbStructure.Chirps[chirp.ID] = chirp
+		return nil
+	})
+
+	return chirp, changed, err
 }
 
 // GetRevokedTokens retrieves the set of revoked tokens from the database
-func (db *DB) GetRevokedTokens() ([]RevokedToken, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetRevokedTokens(ctx context.Context) ([]RevokedToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetRevokedTokens")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -305,59 +459,519 @@ func (db *DB) GetRevokedTokens() ([]RevokedToken, error) {
 	return revokedTokens, nil
 }
 
-// RevokeToken will revoke the provided token from the database
-func (db *DB) RevokeToken(token string) error {
-	dbStructure, err := db.loadDB()
+// RevokeToken will revoke the provided token from the database; userID may be 0 if the owner is unknown
+func (db *DB) RevokeToken(ctx context.Context, token string, userID int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		dbStructure.RevokedTokens[nextID(dbStructure.RevokedTokens)] = RevokedToken{
+			RevokedAt: time.Now(),
+			Token:     token,
+			UserID:    userID,
+		}
+
+		return nil
+	})
+}
+
+// CreateSession records a new session for the given user and saves it to disk
+func (db *DB) CreateSession(ctx context.Context, userID int, userAgent, ip string) (Session, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateSession")
+	defer span.End()
+
+	var session Session
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		session = Session{
+			ID:         nextID(dbStructure.Sessions),
+			UserID:     userID,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			UserAgent:  userAgent,
+			IP:         ip,
+		}
+
+		dbStructure.Sessions[session.ID] = session
+		return nil
+	})
+
+	return session, err
+}
+
+// GetSessionByID returns the given session based on its ID, otherwise an error is returned
+func (db *DB) GetSessionByID(ctx context.Context, sessionID int) (Session, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetSessionByID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return Session{}, err
+	}
+
+	session, ok := dbStructure.Sessions[sessionID]
+	if !ok {
+		return Session{}, fmt.Errorf("could not find sessionID %d: %w", sessionID, ErrNotFound)
 	}
 
-	nextID, err := db.getNextRevokedTokenID()
+	return session, nil
+}
+
+// GetActiveSessionsByUserID returns all of the sessions for a given user that have not been revoked
+func (db *DB) GetActiveSessionsByUserID(ctx context.Context, userID int) ([]Session, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetActiveSessionsByUserID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	dbStructure.RevokedTokens[nextID] = RevokedToken{
-		RevokedAt: time.Now(),
-		Token:     token,
+	sessions := make([]Session, 0)
+	for _, session := range dbStructure.Sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			sessions = append(sessions, session)
+		}
 	}
 
-	return db.writeDB(dbStructure)
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].ID < sessions[b].ID
+	})
+
+	return sessions, nil
 }
 
-// UpdateUser will update the existing user at userID with a new email/password combination
-func (db *DB) UpdateUser(userID int, email string, passwordHash []byte) (User, error) {
-	var user UserWithPassword
+// TouchSession will record the current time as the last use of the given session
+func (db *DB) TouchSession(ctx context.Context, sessionID int) error {
+	ctx, span := tracer.Start(ctx, "DB.TouchSession")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[sessionID]
+		if !ok {
+			return fmt.Errorf("could not find sessionID %d: %w", sessionID, ErrNotFound)
+		}
+
+		session.LastUsedAt = time.Now().UTC()
+
+		dbStructure.Sessions[session.ID] = session
+		return nil
+	})
+}
+
+// RevokeSession will mark the given session as revoked, blocking any further refreshes with its token
+func (db *DB) RevokeSession(ctx context.Context, sessionID int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeSession")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[sessionID]
+		if !ok {
+			return fmt.Errorf("could not find sessionID %d: %w", sessionID, ErrNotFound)
+		}
+
+		if session.RevokedAt == nil {
+			now := time.Now().UTC()
+			session.RevokedAt = &now
+		}
+
+		dbStructure.Sessions[session.ID] = session
+		return nil
+	})
+}
+
+// RevokeSessionsByUserID will mark every active session for the given user as revoked
+func (db *DB) RevokeSessionsByUserID(ctx context.Context, userID int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokeSessionsByUserID")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, session := range dbStructure.Sessions {
+			if session.UserID == userID && session.RevokedAt == nil {
+				session.RevokedAt = &now
+				dbStructure.Sessions[id] = session
+			}
+		}
+
+		return nil
+	})
+}
+
+// CreatePersonalAccessToken records a new personal access token for the given user and saves it to disk
+func (db *DB) CreatePersonalAccessToken(ctx context.Context, userID int, name string, scopes []string, tokenHash string, expiresAt *time.Time) (PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreatePersonalAccessToken")
+	defer span.End()
+
+	var pat PersonalAccessToken
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		pat = PersonalAccessToken{
+			ID:        nextID(dbStructure.PersonalAccessTokens),
+			UserID:    userID,
+			Name:      name,
+			Scopes:    scopes,
+			TokenHash: tokenHash,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		}
 
-	user.ID = userID
-	user.Email = email
-	user.PasswordHash = passwordHash
+		dbStructure.PersonalAccessTokens[pat.ID] = pat
+		return nil
+	})
+
+	return pat, err
+}
 
-	dbStructure, err := db.loadDB()
+// GetPersonalAccessTokenByHash returns the personal access token matching the given hash, otherwise an error is returned
+func (db *DB) GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetPersonalAccessTokenByHash")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return user.User, err
+		return PersonalAccessToken{}, err
 	}
 
-	dbStructure.Users[user.ID] = user
-	return user.User, db.writeDB(dbStructure)
+	for _, pat := range dbStructure.PersonalAccessTokens {
+		if pat.TokenHash == tokenHash {
+			return pat, nil
+		}
+	}
+
+	return PersonalAccessToken{}, fmt.Errorf("could not find personal access token: %w", ErrNotFound)
 }
 
-// UpdateUserToRed will update the existing user to the ChirpyRed service
-func (db *DB) UpdateUserToRed(userID int) error {
-	dbStructure, err := db.loadDB()
+// GetActivePersonalAccessTokensByUserID returns all of the unrevoked personal access tokens for a given user
+func (db *DB) GetActivePersonalAccessTokensByUserID(ctx context.Context, userID int) ([]PersonalAccessToken, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetActivePersonalAccessTokensByUserID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	user, ok := dbStructure.Users[userID]
-	if !ok {
-		return fmt.Errorf("could not find userID %d when converting to ChirpyRed", userID)
+	pats := make([]PersonalAccessToken, 0)
+	for _, pat := range dbStructure.PersonalAccessTokens {
+		if pat.UserID == userID && pat.RevokedAt == nil {
+			pats = append(pats, pat)
+		}
+	}
+
+	sort.Slice(pats, func(a, b int) bool {
+		return pats[a].ID < pats[b].ID
+	})
+
+	return pats, nil
+}
+
+// TouchPersonalAccessToken will record the current time as the last use of the given personal access token
+func (db *DB) TouchPersonalAccessToken(ctx context.Context, patID int) error {
+	ctx, span := tracer.Start(ctx, "DB.TouchPersonalAccessToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		pat, ok := dbStructure.PersonalAccessTokens[patID]
+		if !ok {
+			return fmt.Errorf("could not find personal access tokenID %d: %w", patID, ErrNotFound)
+		}
+
+		now := time.Now().UTC()
+		pat.LastUsedAt = &now
+
+		dbStructure.PersonalAccessTokens[pat.ID] = pat
+		return nil
+	})
+}
+
+// RevokePersonalAccessToken will mark the given personal access token as revoked
+func (db *DB) RevokePersonalAccessToken(ctx context.Context, patID int) error {
+	ctx, span := tracer.Start(ctx, "DB.RevokePersonalAccessToken")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		pat, ok := dbStructure.PersonalAccessTokens[patID]
+		if !ok {
+			return fmt.Errorf("could not find personal access tokenID %d: %w", patID, ErrNotFound)
+		}
+
+		if pat.RevokedAt == nil {
+			now := time.Now().UTC()
+			pat.RevokedAt = &now
+		}
+
+		dbStructure.PersonalAccessTokens[pat.ID] = pat
+		return nil
+	})
+}
+
+// DeleteUser removes the given user along with their sessions and personal access tokens. If anonymize
+// is set, their chirps and revoked tokens are kept but detached from the user (AuthorID/UserID of 0);
+// otherwise they are deleted as well.
+func (db *DB) DeleteUser(ctx context.Context, userID int, anonymize bool) error {
+	ctx, span := tracer.Start(ctx, "DB.DeleteUser")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userID]; !ok {
+			return fmt.Errorf("could not find userID %d: %w", userID, ErrNotFound)
+		}
+
+		delete(dbStructure.Users, userID)
+
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.AuthorID != userID {
+				continue
+			}
+
+			if anonymize {
+				chirp.AuthorID = 0
+				dbStructure.Chirps[id] = chirp
+			} else {
+				delete(dbStructure.Chirps, id)
+			}
+		}
+
+		for id, revokedToken := range dbStructure.RevokedTokens {
+			if revokedToken.UserID != userID {
+				continue
+			}
+
+			if anonymize {
+				revokedToken.UserID = 0
+				dbStructure.RevokedTokens[id] = revokedToken
+			} else {
+				delete(dbStructure.RevokedTokens, id)
+			}
+		}
+
+		for id, session := range dbStructure.Sessions {
+			if session.UserID == userID {
+				delete(dbStructure.Sessions, id)
+			}
+		}
+
+		for id, pat := range dbStructure.PersonalAccessTokens {
+			if pat.UserID == userID {
+				delete(dbStructure.PersonalAccessTokens, id)
+			}
+		}
+
+		removeUserFromConversations(dbStructure, userID, anonymize)
+		removeUserFromNotifications(dbStructure, userID, anonymize)
+		return nil
+	})
+}
+
+// UpdateUser will update the existing user at userID with a new email/password combination
+func (db *DB) UpdateUser(ctx context.Context, userID int, email string, passwordHash []byte) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUser")
+	defer span.End()
+
+	return db.PatchUser(ctx, userID, UserUpdate{Email: &email, PasswordHash: passwordHash})
+}
+
+// PatchUser will apply the given partial update to the existing user at userID. Emails and handles must
+// stay unique across users; handles are compared case-insensitively.
+func (db *DB) PatchUser(ctx context.Context, userID int, update UserUpdate) (User, error) {
+	ctx, span := tracer.Start(ctx, "DB.PatchUser")
+	defer span.End()
+
+	var user UserWithPassword
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		// carry over the existing record so that fields outside of the update are not reset
+		var ok bool
+		if user, ok = dbStructure.Users[userID]; !ok {
+			return fmt.Errorf("could not find userID %d: %w", userID, ErrNotFound)
+		}
+
+		for _, existingUser := range dbStructure.Users {
+			if existingUser.ID == userID {
+				continue
+			}
+
+			if update.Email != nil && *update.Email == existingUser.Email {
+				return fmt.Errorf("found duplicate user with email %s: %w", *update.Email, ErrDuplicate)
+			}
+
+			if update.Handle != nil && *update.Handle != "" && strings.EqualFold(*update.Handle, existingUser.Handle) {
+				return fmt.Errorf("found duplicate user with handle %s: %w", *update.Handle, ErrDuplicate)
+			}
+		}
+
+		if update.Email != nil {
+			user.Email = *update.Email
+		}
+
+		if update.PasswordHash != nil {
+			user.PasswordHash = update.PasswordHash
+		}
+
+		if update.Handle != nil {
+			user.Handle = *update.Handle
+		}
+
+		if update.DisplayName != nil {
+			user.DisplayName = *update.DisplayName
+		}
+
+		if update.Bio != nil {
+			user.Bio = *update.Bio
+		}
+
+		if update.AvatarURL != nil {
+			user.AvatarURL = *update.AvatarURL
+		}
+
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+
+	return user.User, err
+}
+
+// UpdateUserPasswordHash will replace only the stored password hash for the existing user at userID
+func (db *DB) UpdateUserPasswordHash(ctx context.Context, userID int, passwordHash []byte) error {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserPasswordHash")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d when updating password: %w", userID, ErrNotFound)
+		}
+
+		user.PasswordHash = passwordHash
+
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+}
+
+// UpdateUserTwoFactor will replace the two-factor settings for the existing user at userID
+func (db *DB) UpdateUserTwoFactor(ctx context.Context, userID int, twoFactor TwoFactor) error {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserTwoFactor")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d when updating two-factor settings: %w", userID, ErrNotFound)
+		}
+
+		user.TwoFactor = twoFactor
+
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+}
+
+// ConsumeSecondFactor records the use of a verified second factor by the user at userID: the TOTP step,
+// or, when recoveryCode is set, the recovery code with that hash, which is removed. The step must be later
+// than the last one used and the recovery code still unused, checked under the same lock as the update
+// so that a code only ever lets one login through.
+func (db *DB) ConsumeSecondFactor(ctx context.Context, userID int, step int64, recoveryCode []byte) error {
+	ctx, span := tracer.Start(ctx, "DB.ConsumeSecondFactor")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d when consuming a second factor: %w", userID, ErrNotFound)
+		}
+
+		if recoveryCode == nil {
+			if step <= user.TwoFactor.LastUsedStep {
+				return fmt.Errorf("TOTP step %d for userID %d: %w", step, userID, ErrAlreadyUsed)
+			}
+
+			user.TwoFactor.LastUsedStep = step
+		} else {
+			idx := slices.IndexFunc(user.TwoFactor.RecoveryCodes, func(hash []byte) bool {
+				return bytes.Equal(hash, recoveryCode)
+			})
+			if idx < 0 {
+				return fmt.Errorf("recovery code for userID %d: %w", userID, ErrAlreadyUsed)
+			}
+
+			user.TwoFactor.RecoveryCodes = slices.Delete(slices.Clone(user.TwoFactor.RecoveryCodes), idx, idx+1)
+		}
+
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+}
+
+// UpdateUserModeration will replace the moderation status for the existing user at userID
+func (db *DB) UpdateUserModeration(ctx context.Context, userID int, moderation Moderation) error {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserModeration")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d when updating moderation status: %w", userID, ErrNotFound)
+		}
+
+		user.Moderation = moderation
+
+		dbStructure.Users[user.ID] = user
+		return nil
+	})
+}
+
+// UpdateUserToRed will update the existing user to the ChirpyRed service and notify them in the same
+// write, so that the notification is stored if and only if the upgrade is. Users who already are
+// ChirpyRed members are left unchanged and not notified again.
+func (db *DB) UpdateUserToRed(ctx context.Context, userID int) error {
+	ctx, span := tracer.Start(ctx, "DB.UpdateUserToRed")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d when converting to ChirpyRed: %w", userID, ErrNotFound)
+		}
+
+		if user.IsChirpyRed {
+			return errUnchanged
+		}
+
+		user.IsChirpyRed = true
+
+		dbStructure.Users[user.ID] = user
+		addNotification(dbStructure, Notification{UserID: userID, Type: NotificationChirpyRed, CreatedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+// endSpan records the outcome of a database file operation on its span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 
-	user.IsChirpyRed = true
+	span.End()
+}
 
-	dbStructure.Users[user.ID] = user
-	return db.writeDB(dbStructure)
+// SetObserver registers a function to be notified of every database file operation
+func (db *DB) SetObserver(observer Observer) {
+	db.observerMux.Lock()
+	db.observer = observer
+	db.observerMux.Unlock()
+}
+
+// observe reports a finished database file operation to the observer, if one is registered. It has its
+// own lock since it runs while update holds mux.
+func (db *DB) observe(op string, start time.Time, err error) {
+	db.observerMux.Lock()
+	observer := db.observer
+	db.observerMux.Unlock()
+
+	if observer != nil {
+		observer(op, time.Since(start), err)
+	}
 }
 
 // reassureDB creates a new database file if it doesn't exist
@@ -365,6 +979,10 @@ func (db *DB) reassureDB() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
+	if db.closed {
+		return ErrClosed
+	}
+
 	// If the file doesn't exist, create it, or append to the file
 	f, err := os.OpenFile(db.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -378,43 +996,163 @@ func (db *DB) reassureDB() error {
 	return nil
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	var dbStructure DBStructure
-
+// loadDB reads the database file into memory for methods that only read it; methods that change it go
+// through update instead
+func (db *DB) loadDB(ctx context.Context) (DBStructure, error) {
 	if err := db.reassureDB(); err != nil {
-		return dbStructure, err
+		return DBStructure{}, err
 	}
 
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.readFile(ctx)
+}
+
+// update loads the database, lets fn change it and writes it back, holding the lock throughout so that
+// no other write can land in between and be overwritten. Nothing is written if fn returns an error;
+// errUnchanged skips the write without failing.
+func (db *DB) update(ctx context.Context, fn func(dbStructure *DBStructure) error) error {
+	if err := db.reassureDB(); err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	// Close may have run since reassureDB released the lock
+	if db.closed {
+		return ErrClosed
+	}
+
+	dbStructure, err := db.readFile(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&dbStructure); errors.Is(err, errUnchanged) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return db.writeFile(ctx, dbStructure)
+}
+
+// errUnchanged is returned by an update function that found nothing to change
+var errUnchanged = errors.New("unchanged")
+
+// readFile reads and parses the database file; the caller must hold mux
+func (db *DB) readFile(ctx context.Context) (dbStructure DBStructure, err error) {
+	_, span := tracer.Start(ctx, "DB.loadDB")
+	defer func(start time.Time) {
+		endSpan(span, err)
+		db.observe("load", start, err)
+	}(time.Now())
+
 	data, err := os.ReadFile(db.path)
 	if err != nil {
 		return dbStructure, err
 	}
 
-	if len(data) == 0 {
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &dbStructure); err != nil {
+			return dbStructure, err
+		}
+	}
+
+	// make sure every section exists, including ones added after the file was first written
+	if dbStructure.Chirps == nil {
 		dbStructure.Chirps = make(map[int]Chirp)
+	}
+
+	if dbStructure.Users == nil {
 		dbStructure.Users = make(map[int]UserWithPassword)
+	}
+
+	if dbStructure.RevokedTokens == nil {
 		dbStructure.RevokedTokens = make(map[int]RevokedToken)
+	}
+
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = make(map[int]Session)
+	}
+
+	if dbStructure.PersonalAccessTokens == nil {
+		dbStructure.PersonalAccessTokens = make(map[int]PersonalAccessToken)
+	}
+
+	if dbStructure.Conversations == nil {
+		dbStructure.Conversations = make(map[int]Conversation)
+	}
+
+	if dbStructure.Messages == nil {
+		dbStructure.Messages = make(map[int]Message)
+	}
+
+	if dbStructure.Notifications == nil {
+		dbStructure.Notifications = make(map[int]Notification)
+	}
+
+	if dbStructure.Analytics.Hourly == nil {
+		dbStructure.Analytics.Hourly = make(map[int64]AnalyticsBucket)
+	}
 
-		return dbStructure, nil
+	if dbStructure.Analytics.Daily == nil {
+		dbStructure.Analytics.Daily = make(map[int64]AnalyticsBucket)
 	}
 
-	err = json.Unmarshal(data, &dbStructure)
-	return dbStructure, err
+	return dbStructure, nil
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// writeFile writes the database file to disk; the caller must hold mux for writing
+func (db *DB) writeFile(ctx context.Context, dbStructure DBStructure) (err error) {
+	_, span := tracer.Start(ctx, "DB.writeDB")
+	defer func(start time.Time) {
+		endSpan(span, err)
+		db.observe("write", start, err)
+	}(time.Now())
 
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(db.path, data, 0644)
+	// write to a temporary file and rename it over the database, so that a crash mid-write never
+	// leaves a truncated database.json behind
+	tmpPath := db.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, db.path)
+}
+
+// Close waits for any in-flight write to finish and then closes the database, releasing its lock for
+// other processes; every operation after this returns ErrClosed
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.closed {
+		return nil
+	}
+
+	db.closed = true
+	return db.lock.Close()
 }
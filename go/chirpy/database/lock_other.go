@@ -0,0 +1,11 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// lockFile opens the lock file at path. Advisory locks are only taken on unix, so elsewhere nothing keeps
+// a second process from opening the database.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile opens the lock file at path and takes an exclusive advisory lock on it, failing with ErrLocked
+// rather than waiting if another process holds it. Closing the file releases the lock.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+
+		return nil, fmt.Errorf("could not lock %s: %w", path, err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,437 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// The maintenance operations below work on the whole database file at once and are meant for chirpyctl
+// while the server is stopped; the server never calls them.
+
+// Report summarizes the contents of the database file and the inconsistencies found in it
+type Report struct {
+	Path                 string    `json:"path"`
+	Size                 int64     `json:"size"`
+	ModTime              time.Time `json:"mod_time"`
+	LastUserID           int       `json:"last_user_id"`
+	Users                int       `json:"users"`
+	ModeratedUsers       int       `json:"moderated_users"`
+	Chirps               int       `json:"chirps"`
+	HiddenChirps         int       `json:"hidden_chirps"`
+	RevokedTokens        int       `json:"revoked_tokens"`
+	Sessions             int       `json:"sessions"`
+	ActiveSessions       int       `json:"active_sessions"`
+	PersonalAccessTokens int       `json:"personal_access_tokens"`
+	Conversations        int       `json:"conversations"`
+	Messages             int       `json:"messages"`
+	Notifications        int       `json:"notifications"`
+	HourlyBuckets        int       `json:"hourly_buckets"`
+	DailyBuckets         int       `json:"daily_buckets"`
+	// Problems lists the inconsistencies; the ones Repair can fix are prefixed with "fixable:"
+	Problems []string `json:"problems"`
+}
+
+// Inspect returns a Report on the database file without changing it
+func (db *DB) Inspect(ctx context.Context) (Report, error) {
+	ctx, span := tracer.Start(ctx, "DB.Inspect")
+	defer span.End()
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return Report{}, err
+	}
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{
+		Path:                 db.path,
+		Size:                 info.Size(),
+		ModTime:              info.ModTime(),
+		LastUserID:           dbStructure.LastUserID,
+		Users:                len(dbStructure.Users),
+		Chirps:               len(dbStructure.Chirps),
+		RevokedTokens:        len(dbStructure.RevokedTokens),
+		Sessions:             len(dbStructure.Sessions),
+		PersonalAccessTokens: len(dbStructure.PersonalAccessTokens),
+		Conversations:        len(dbStructure.Conversations),
+		Messages:             len(dbStructure.Messages),
+		Notifications:        len(dbStructure.Notifications),
+		HourlyBuckets:        len(dbStructure.Analytics.Hourly),
+		DailyBuckets:         len(dbStructure.Analytics.Daily),
+	}
+
+	now := time.Now().UTC()
+	for _, user := range dbStructure.Users {
+		if user.Moderation.EffectiveStatus(now) != StatusActive {
+			report.ModeratedUsers++
+		}
+	}
+
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.Hidden {
+			report.HiddenChirps++
+		}
+	}
+
+	for _, session := range dbStructure.Sessions {
+		if session.RevokedAt == nil {
+			report.ActiveSessions++
+		}
+	}
+
+	if _, err := os.Stat(db.path + ".tmp"); err == nil {
+		report.Problems = append(report.Problems, "fixable: leftover "+db.path+".tmp from an interrupted write")
+	}
+
+	report.Problems = append(report.Problems, checkStructure(&dbStructure, false)...)
+	return report, nil
+}
+
+// Repair fixes the inconsistencies that can be fixed without guessing and writes the file back. It
+// returns what was fixed, followed by the problems that need a human.
+func (db *DB) Repair(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "DB.Repair")
+	defer span.End()
+
+	var fixed []string
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if err := os.Remove(db.path + ".tmp"); err == nil {
+			fixed = append(fixed, "fixed: removed leftover "+db.path+".tmp from an interrupted write")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		fixed = append(fixed, checkStructure(dbStructure, true)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fixed, nil
+}
+
+// checkStructure looks for records that contradict each other. With fix set the fixable ones are
+// repaired in place and reported as "fixed:", otherwise they are reported as "fixable:".
+func checkStructure(s *DBStructure, fix bool) []string {
+	var problems []string
+	report := func(fixable bool, format string, args ...any) {
+		prefix := ""
+		switch {
+		case fixable && fix:
+			prefix = "fixed: "
+		case fixable:
+			prefix = "fixable: "
+		}
+
+		problems = append(problems, prefix+fmt.Sprintf(format, args...))
+	}
+
+	// every record is stored under its own ID
+	for key, user := range s.Users {
+		if user.ID != key {
+			report(true, "user stored under key %d has ID %d", key, user.ID)
+			if fix {
+				user.ID = key
+				s.Users[key] = user
+			}
+		}
+	}
+
+	for key, chirp := range s.Chirps {
+		if chirp.ID != key {
+			report(true, "chirp stored under key %d has ID %d", key, chirp.ID)
+			if fix {
+				chirp.ID = key
+				s.Chirps[key] = chirp
+			}
+		}
+	}
+
+	for key, session := range s.Sessions {
+		if session.ID != key {
+			report(true, "session stored under key %d has ID %d", key, session.ID)
+			if fix {
+				session.ID = key
+				s.Sessions[key] = session
+			}
+		}
+	}
+
+	for key, pat := range s.PersonalAccessTokens {
+		if pat.ID != key {
+			report(true, "personal access token stored under key %d has ID %d", key, pat.ID)
+			if fix {
+				pat.ID = key
+				s.PersonalAccessTokens[key] = pat
+			}
+		}
+	}
+
+	for key, message := range s.Messages {
+		if message.ID != key {
+			report(true, "message stored under key %d has ID %d", key, message.ID)
+			if fix {
+				message.ID = key
+				s.Messages[key] = message
+			}
+		}
+	}
+
+	for key, notification := range s.Notifications {
+		if notification.ID != key {
+			report(true, "notification stored under key %d has ID %d", key, notification.ID)
+			if fix {
+				notification.ID = key
+				s.Notifications[key] = notification
+			}
+		}
+	}
+
+	// user IDs are never reused, so the high-water mark must cover every user
+	maxUserID := 0
+	for key := range s.Users {
+		if key > maxUserID {
+			maxUserID = key
+		}
+	}
+
+	if s.LastUserID < maxUserID {
+		report(true, "last_user_id %d is below the highest user ID %d", s.LastUserID, maxUserID)
+		if fix {
+			s.LastUserID = maxUserID
+		}
+	}
+
+	// neither are message IDs, see getNextMessageID
+	maxMessageID := 0
+	for key := range s.Messages {
+		if key > maxMessageID {
+			maxMessageID = key
+		}
+	}
+
+	if s.LastMessageID < maxMessageID {
+		report(true, "last_message_id %d is below the highest message ID %d", s.LastMessageID, maxMessageID)
+		if fix {
+			s.LastMessageID = maxMessageID
+		}
+	}
+
+	// records pointing at users that no longer exist; anonymized records point at user 0 on purpose
+	for key, chirp := range s.Chirps {
+		if _, ok := s.Users[chirp.AuthorID]; chirp.AuthorID != 0 && !ok {
+			report(true, "chirp %d belongs to missing user %d, anonymizing it", key, chirp.AuthorID)
+			if fix {
+				chirp.AuthorID = 0
+				s.Chirps[key] = chirp
+			}
+		}
+	}
+
+	for key, revokedToken := range s.RevokedTokens {
+		if _, ok := s.Users[revokedToken.UserID]; revokedToken.UserID != 0 && !ok {
+			report(true, "revoked token %d belongs to missing user %d, anonymizing it", key, revokedToken.UserID)
+			if fix {
+				revokedToken.UserID = 0
+				s.RevokedTokens[key] = revokedToken
+			}
+		}
+	}
+
+	for key, session := range s.Sessions {
+		if _, ok := s.Users[session.UserID]; !ok {
+			report(true, "session %d belongs to missing user %d, deleting it", key, session.UserID)
+			if fix {
+				delete(s.Sessions, key)
+			}
+		}
+	}
+
+	for key, pat := range s.PersonalAccessTokens {
+		if _, ok := s.Users[pat.UserID]; !ok {
+			report(true, "personal access token %d belongs to missing user %d, deleting it", key, pat.UserID)
+			if fix {
+				delete(s.PersonalAccessTokens, key)
+			}
+		}
+	}
+
+	for key, conversation := range s.Conversations {
+		for _, userID := range slices.Clone(conversation.ParticipantIDs) {
+			if _, ok := s.Users[userID]; !ok {
+				report(true, "conversation %d includes missing user %d, removing them", key, userID)
+				if fix {
+					conversation.ParticipantIDs = slices.DeleteFunc(conversation.ParticipantIDs, func(id int) bool { return id == userID })
+					delete(conversation.LastRead, userID)
+					s.Conversations[key] = conversation
+				}
+			}
+		}
+	}
+
+	for key, message := range s.Messages {
+		if _, ok := s.Conversations[message.ConversationID]; !ok {
+			report(true, "message %d belongs to missing conversation %d, deleting it", key, message.ConversationID)
+			if fix {
+				delete(s.Messages, key)
+			}
+
+			continue
+		}
+
+		if _, ok := s.Users[message.SenderID]; message.SenderID != 0 && !ok {
+			report(true, "message %d was sent by missing user %d, anonymizing it", key, message.SenderID)
+			if fix {
+				message.SenderID = 0
+				s.Messages[key] = message
+			}
+		}
+	}
+
+	for key, user := range s.Users {
+		for _, blockedID := range slices.Clone(user.BlockedUserIDs) {
+			if _, ok := s.Users[blockedID]; !ok {
+				report(true, "user %d blocks missing user %d, unblocking them", key, blockedID)
+				if fix {
+					user.BlockedUserIDs = slices.DeleteFunc(user.BlockedUserIDs, func(id int) bool { return id == blockedID })
+					s.Users[key] = user
+				}
+			}
+		}
+	}
+
+	for key, notification := range s.Notifications {
+		if _, ok := s.Users[notification.UserID]; !ok {
+			report(true, "notification %d belongs to missing user %d, deleting it", key, notification.UserID)
+			if fix {
+				delete(s.Notifications, key)
+			}
+
+			continue
+		}
+
+		if _, ok := s.Chirps[notification.ChirpID]; notification.ChirpID != 0 && !ok {
+			report(true, "notification %d is about missing chirp %d, deleting it", key, notification.ChirpID)
+			if fix {
+				delete(s.Notifications, key)
+			}
+
+			continue
+		}
+
+		if _, ok := s.Users[notification.ActorID]; notification.ActorID != 0 && !ok {
+			report(true, "notification %d was caused by missing user %d, anonymizing it", key, notification.ActorID)
+			if fix {
+				notification.ActorID = 0
+				s.Notifications[key] = notification
+			}
+		}
+	}
+
+	// problems that need a decision from a human
+	emails := make(map[string][]int)
+	for key, user := range s.Users {
+		emails[user.Email] = append(emails[user.Email], key)
+
+		if len(user.PasswordHash) == 0 {
+			report(false, "user %d has no password hash, reset their password", key)
+		}
+
+		switch user.Moderation.Status {
+		case "", StatusActive, StatusSuspended, StatusBanned:
+		default:
+			report(false, "user %d has unknown moderation status %q", key, user.Moderation.Status)
+		}
+	}
+
+	for email, ids := range emails {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			report(false, "users %v share the email address %s", ids, email)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// CompactStats counts the records dropped by Compact and the size of the file before and after
+type CompactStats struct {
+	RevokedTokens        int   `json:"revoked_tokens"`
+	Sessions             int   `json:"sessions"`
+	PersonalAccessTokens int   `json:"personal_access_tokens"`
+	Notifications        int   `json:"notifications"`
+	AnalyticsBuckets     int   `json:"analytics_buckets"`
+	SizeBefore           int64 `json:"size_before"`
+	SizeAfter            int64 `json:"size_after"`
+}
+
+// Compact drops the records that can no longer have any effect and rewrites the file: tokens revoked
+// before cutoff, sessions created or revoked before it and personal access tokens that were revoked or
+// expired before it, along with the analytics buckets past their retention. Notifications read before
+// cutoff are dropped too. cutoff must be at least the refresh token lifetime ago, so that every dropped
+// token has expired on its own.
+func (db *DB) Compact(ctx context.Context, cutoff time.Time) (CompactStats, error) {
+	ctx, span := tracer.Start(ctx, "DB.Compact")
+	defer span.End()
+
+	var stats CompactStats
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		if info, err := os.Stat(db.path); err == nil {
+			stats.SizeBefore = info.Size()
+		}
+
+		for id, revokedToken := range dbStructure.RevokedTokens {
+			if revokedToken.RevokedAt.Before(cutoff) {
+				delete(dbStructure.RevokedTokens, id)
+				stats.RevokedTokens++
+			}
+		}
+
+		for id, session := range dbStructure.Sessions {
+			if session.CreatedAt.Before(cutoff) || (session.RevokedAt != nil && session.RevokedAt.Before(cutoff)) {
+				delete(dbStructure.Sessions, id)
+				stats.Sessions++
+			}
+		}
+
+		for id, pat := range dbStructure.PersonalAccessTokens {
+			if (pat.RevokedAt != nil && pat.RevokedAt.Before(cutoff)) || (pat.ExpiresAt != nil && pat.ExpiresAt.Before(cutoff)) {
+				delete(dbStructure.PersonalAccessTokens, id)
+				stats.PersonalAccessTokens++
+			}
+		}
+
+		for id, notification := range dbStructure.Notifications {
+			if notification.ReadAt != nil && notification.ReadAt.Before(cutoff) {
+				delete(dbStructure.Notifications, id)
+				stats.Notifications++
+			}
+		}
+
+		buckets := len(dbStructure.Analytics.Hourly) + len(dbStructure.Analytics.Daily)
+		now := time.Now().UTC()
+		mergeBuckets(dbStructure.Analytics.Hourly, nil, now.Add(-hourlyRetention))
+		mergeBuckets(dbStructure.Analytics.Daily, nil, now.Add(-dailyRetention))
+		stats.AnalyticsBuckets = buckets - len(dbStructure.Analytics.Hourly) - len(dbStructure.Analytics.Daily)
+
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if info, err := os.Stat(db.path); err == nil {
+		stats.SizeAfter = info.Size()
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,435 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Conversation is a private thread between two or more users, separate from the public chirps
+type Conversation struct {
+	ID             int       `json:"id"`
+	ParticipantIDs []int     `json:"participant_ids"`
+	CreatedBy      int       `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastMessageAt  time.Time `json:"last_message_at"`
+	// LastRead is the ID of the last message each participant has read, keyed by their user ID
+	LastRead map[int]int `json:"last_read"`
+}
+
+// isParticipant reports whether the user takes part in the conversation
+func (c Conversation) isParticipant(userID int) bool {
+	return slices.Contains(c.ParticipantIDs, userID)
+}
+
+// Message is a single direct message within a conversation
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ConversationSummary is a conversation as seen by one of its participants
+type ConversationSummary struct {
+	Conversation
+	LastMessage *Message
+	UnreadCount int
+}
+
+// isBlocked reports whether either user has blocked the other
+func isBlocked(users map[int]UserWithPassword, a, b int) bool {
+	return slices.Contains(users[a].BlockedUserIDs, b) || slices.Contains(users[b].BlockedUserIDs, a)
+}
+
+// visibleTo reports whether the user gets to see the message; messages from users they blocked are hidden
+func visibleTo(users map[int]UserWithPassword, userID int, message Message) bool {
+	return !slices.Contains(users[userID].BlockedUserIDs, message.SenderID)
+}
+
+// summarize builds the participant's view of the conversation from the loaded database
+func summarize(dbStructure DBStructure, conversation Conversation, userID int) ConversationSummary {
+	summary := ConversationSummary{Conversation: conversation}
+	lastRead := conversation.LastRead[userID]
+
+	for _, message := range dbStructure.Messages {
+		if message.ConversationID != conversation.ID || !visibleTo(dbStructure.Users, userID, message) {
+			continue
+		}
+
+		if summary.LastMessage == nil || message.ID > summary.LastMessage.ID {
+			message := message
+			summary.LastMessage = &message
+		}
+
+		if message.ID > lastRead && message.SenderID != userID {
+			summary.UnreadCount++
+		}
+	}
+
+	return summary
+}
+
+// getNextMessageID returns the ID for a new message. Like user IDs, message IDs are never reused, so that
+// a participant's read marker can't cover a message sent after the one it was set on.
+func getNextMessageID(dbStructure *DBStructure) int {
+	for id := range dbStructure.Messages {
+		if id > dbStructure.LastMessageID {
+			dbStructure.LastMessageID = id
+		}
+	}
+
+	dbStructure.LastMessageID++
+	return dbStructure.LastMessageID
+}
+
+// CreateConversation starts a conversation between the creator and the other participants. A one-to-one
+// conversation is only created once: if the pair already has one, it is returned with created unset. A
+// non-empty body is sent as the creator's message in the same write, so the conversation is never stored
+// without it.
+func (db *DB) CreateConversation(ctx context.Context, creatorID int, participantIDs []int, body string) (conversation Conversation, created bool, err error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateConversation")
+	defer span.End()
+
+	err = db.update(ctx, func(dbStructure *DBStructure) error {
+		participants := []int{creatorID}
+		for _, id := range participantIDs {
+			if !slices.Contains(participants, id) {
+				participants = append(participants, id)
+			}
+		}
+		sort.Ints(participants)
+
+		for _, id := range participants {
+			if _, ok := dbStructure.Users[id]; !ok {
+				return fmt.Errorf("could not find userID %d: %w", id, ErrNotFound)
+			}
+
+			if id != creatorID && isBlocked(dbStructure.Users, creatorID, id) {
+				return fmt.Errorf("cannot start a conversation with userID %d: %w", id, ErrBlocked)
+			}
+		}
+
+		if len(participants) == 2 {
+			for _, existing := range dbStructure.Conversations {
+				if slices.Equal(existing.ParticipantIDs, participants) {
+					conversation = existing
+					break
+				}
+			}
+		}
+
+		if conversation.ID == 0 {
+			now := time.Now().UTC()
+			conversation = Conversation{
+				ID:             nextID(dbStructure.Conversations),
+				ParticipantIDs: participants,
+				CreatedBy:      creatorID,
+				CreatedAt:      now,
+				LastMessageAt:  now,
+				LastRead:       make(map[int]int),
+			}
+
+			dbStructure.Conversations[conversation.ID] = conversation
+			created = true
+		}
+
+		if body == "" {
+			if !created {
+				return errUnchanged
+			}
+
+			return nil
+		}
+
+		_, err := addMessage(dbStructure, conversation.ID, creatorID, body)
+		return err
+	})
+	if err != nil {
+		return Conversation{}, false, err
+	}
+
+	return conversation, created, nil
+}
+
+// GetConversationsByUserID returns the conversations the user takes part in, most recently active first
+func (db *DB) GetConversationsByUserID(ctx context.Context, userID int) ([]ConversationSummary, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetConversationsByUserID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ConversationSummary, 0)
+	for _, conversation := range dbStructure.Conversations {
+		if conversation.isParticipant(userID) {
+			summaries = append(summaries, summarize(dbStructure, conversation, userID))
+		}
+	}
+
+	sort.Slice(summaries, func(a, b int) bool {
+		if !summaries[a].LastMessageAt.Equal(summaries[b].LastMessageAt) {
+			return summaries[a].LastMessageAt.After(summaries[b].LastMessageAt)
+		}
+
+		return summaries[a].ID > summaries[b].ID
+	})
+
+	return summaries, nil
+}
+
+// GetConversation returns the conversation as seen by the user; it is not found unless they take part
+func (db *DB) GetConversation(ctx context.Context, conversationID, userID int) (ConversationSummary, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetConversation")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return ConversationSummary{}, err
+	}
+
+	conversation, ok := dbStructure.Conversations[conversationID]
+	if !ok || !conversation.isParticipant(userID) {
+		return ConversationSummary{}, fmt.Errorf("could not find conversationID %d: %w", conversationID, ErrNotFound)
+	}
+
+	return summarize(dbStructure, conversation, userID), nil
+}
+
+// GetMessages returns up to limit of the conversation's messages with an ID below beforeID, or the latest
+// ones if beforeID is zero, newest first. Only participants can read them, and the messages from users
+// the reader blocked are left out.
+func (db *DB) GetMessages(ctx context.Context, conversationID, userID, beforeID, limit int) ([]Message, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetMessages")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation, ok := dbStructure.Conversations[conversationID]
+	if !ok || !conversation.isParticipant(userID) {
+		return nil, fmt.Errorf("could not find conversationID %d: %w", conversationID, ErrNotFound)
+	}
+
+	messages := make([]Message, 0)
+	for _, message := range dbStructure.Messages {
+		if message.ConversationID == conversationID && (beforeID <= 0 || message.ID < beforeID) &&
+			visibleTo(dbStructure.Users, userID, message) {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(a, b int) bool {
+		return messages[a].ID > messages[b].ID
+	})
+
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+// CreateMessage sends a message to the conversation as one of its participants, which also marks the
+// conversation as read for them. Nobody can write in a one-to-one conversation while either side has
+// blocked the other.
+func (db *DB) CreateMessage(ctx context.Context, conversationID, senderID int, body string) (Message, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateMessage")
+	defer span.End()
+
+	var message Message
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		var err error
+		message, err = addMessage(dbStructure, conversationID, senderID, body)
+		return err
+	})
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// addMessage stores a message from senderID in the conversation, which the sender must take part in and,
+// for a one-to-one conversation, not be blocked from, and marks it as read by the sender
+func addMessage(dbStructure *DBStructure, conversationID, senderID int, body string) (Message, error) {
+	conversation, ok := dbStructure.Conversations[conversationID]
+	if !ok || !conversation.isParticipant(senderID) {
+		return Message{}, fmt.Errorf("could not find conversationID %d: %w", conversationID, ErrNotFound)
+	}
+
+	if len(conversation.ParticipantIDs) == 2 {
+		for _, id := range conversation.ParticipantIDs {
+			if id != senderID && isBlocked(dbStructure.Users, senderID, id) {
+				return Message{}, fmt.Errorf("cannot message userID %d: %w", id, ErrBlocked)
+			}
+		}
+	}
+
+	message := Message{
+		ID:             getNextMessageID(dbStructure),
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Body:           body,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	if conversation.LastRead == nil {
+		conversation.LastRead = make(map[int]int)
+	}
+
+	conversation.LastMessageAt = message.CreatedAt
+	conversation.LastRead[senderID] = message.ID
+
+	dbStructure.Messages[message.ID] = message
+	dbStructure.Conversations[conversationID] = conversation
+	return message, nil
+}
+
+// MarkConversationRead marks the conversation as read by the user up to and including messageID, or up
+// to its latest message if messageID is zero. The read marker never moves backwards.
+func (db *DB) MarkConversationRead(ctx context.Context, conversationID, userID, messageID int) error {
+	ctx, span := tracer.Start(ctx, "DB.MarkConversationRead")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		conversation, ok := dbStructure.Conversations[conversationID]
+		if !ok || !conversation.isParticipant(userID) {
+			return fmt.Errorf("could not find conversationID %d: %w", conversationID, ErrNotFound)
+		}
+
+		latest := 0
+		found := messageID == 0
+		for _, message := range dbStructure.Messages {
+			if message.ConversationID != conversationID {
+				continue
+			}
+
+			if message.ID > latest {
+				latest = message.ID
+			}
+
+			if message.ID == messageID {
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("could not find messageID %d in conversationID %d: %w", messageID, conversationID, ErrNotFound)
+		}
+
+		if messageID == 0 {
+			messageID = latest
+		}
+
+		if conversation.LastRead == nil {
+			conversation.LastRead = make(map[int]int)
+		}
+
+		if messageID <= conversation.LastRead[userID] {
+			return errUnchanged
+		}
+
+		conversation.LastRead[userID] = messageID
+		dbStructure.Conversations[conversationID] = conversation
+		return nil
+	})
+}
+
+// GetBlockedUserIDs returns the IDs of the users the user has blocked, in ascending order
+func (db *DB) GetBlockedUserIDs(ctx context.Context, userID int) ([]int, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetBlockedUserIDs")
+	defer span.End()
+
+	user, err := db.GetUserFullByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := append(make([]int, 0, len(user.BlockedUserIDs)), user.BlockedUserIDs...)
+	sort.Ints(blocked)
+	return blocked, nil
+}
+
+// SetUserBlocked blocks or unblocks blockedID for userID. Blocking is one-sided: the blocked user is not
+// told, but neither can start a conversation with the other and their messages are hidden from the user.
+func (db *DB) SetUserBlocked(ctx context.Context, userID, blockedID int, blocked bool) error {
+	ctx, span := tracer.Start(ctx, "DB.SetUserBlocked")
+	defer span.End()
+
+	return db.update(ctx, func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userID]
+		if !ok {
+			return fmt.Errorf("could not find userID %d: %w", userID, ErrNotFound)
+		}
+
+		if _, ok := dbStructure.Users[blockedID]; !ok {
+			return fmt.Errorf("could not find userID %d: %w", blockedID, ErrNotFound)
+		}
+
+		index := slices.Index(user.BlockedUserIDs, blockedID)
+		switch {
+		case blocked && index < 0:
+			user.BlockedUserIDs = append(user.BlockedUserIDs, blockedID)
+		case !blocked && index >= 0:
+			user.BlockedUserIDs = slices.Delete(user.BlockedUserIDs, index, index+1)
+		default:
+			return errUnchanged
+		}
+
+		dbStructure.Users[userID] = user
+		return nil
+	})
+}
+
+// removeUserFromConversations takes a deleted user out of every conversation and of everyone's block
+// list. Their messages are kept with sender 0 if anonymize is set and deleted otherwise, and conversations
+// nobody is left in are deleted along with their messages.
+func removeUserFromConversations(dbStructure *DBStructure, userID int, anonymize bool) {
+	for id, user := range dbStructure.Users {
+		if index := slices.Index(user.BlockedUserIDs, userID); index >= 0 {
+			user.BlockedUserIDs = slices.Delete(user.BlockedUserIDs, index, index+1)
+			dbStructure.Users[id] = user
+		}
+	}
+
+	for id, message := range dbStructure.Messages {
+		if message.SenderID != userID {
+			continue
+		}
+
+		if anonymize {
+			message.SenderID = 0
+			dbStructure.Messages[id] = message
+		} else {
+			delete(dbStructure.Messages, id)
+		}
+	}
+
+	for id, conversation := range dbStructure.Conversations {
+		index := slices.Index(conversation.ParticipantIDs, userID)
+		if index < 0 {
+			continue
+		}
+
+		conversation.ParticipantIDs = slices.Delete(conversation.ParticipantIDs, index, index+1)
+		delete(conversation.LastRead, userID)
+		dbStructure.Conversations[id] = conversation
+
+		if len(conversation.ParticipantIDs) == 0 {
+			delete(dbStructure.Conversations, id)
+			for messageID, message := range dbStructure.Messages {
+				if message.ConversationID == id {
+					delete(dbStructure.Messages, messageID)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// notification types, see Notification
+const (
+	// NotificationMention is sent to a user whose @handle appears in a new chirp
+	NotificationMention = "mention"
+	// NotificationChirpyRed is sent to a user once their account is upgraded to Chirpy Red
+	NotificationChirpyRed = "chirpy_red"
+)
+
+// Notification tells a user about something that happened to them while they were away
+type Notification struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Type   string `json:"type"`
+	// ActorID is the user who caused the notification, 0 for the system or a deleted account
+	ActorID int `json:"actor_id,omitempty"`
+	// ChirpID is the chirp the notification is about, if any
+	ChirpID   int        `json:"chirp_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+}
+
+// addNotification stores the notification under the next free ID and returns it
+func addNotification(dbStructure *DBStructure, notification Notification) Notification {
+	notification.ID = nextID(dbStructure.Notifications)
+	dbStructure.Notifications[notification.ID] = notification
+	return notification
+}
+
+// CreateMentionNotifications notifies the users whose handles are mentioned in the chirp. Handles match
+// case-insensitively and unknown ones are ignored, as are the author and users who blocked them.
+func (db *DB) CreateMentionNotifications(ctx context.Context, chirp Chirp, handles []string) ([]Notification, error) {
+	ctx, span := tracer.Start(ctx, "DB.CreateMentionNotifications")
+	defer span.End()
+
+	var notifications []Notification
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		var recipients []int
+		for _, user := range dbStructure.Users {
+			if user.Handle == "" || user.ID == chirp.AuthorID || slices.Contains(user.BlockedUserIDs, chirp.AuthorID) {
+				continue
+			}
+
+			if slices.ContainsFunc(handles, func(handle string) bool { return strings.EqualFold(handle, user.Handle) }) {
+				recipients = append(recipients, user.ID)
+			}
+		}
+
+		if len(recipients) == 0 {
+			return errUnchanged
+		}
+		sort.Ints(recipients)
+
+		now := time.Now().UTC()
+		notifications = make([]Notification, 0, len(recipients))
+		for _, userID := range recipients {
+			notifications = append(notifications, addNotification(dbStructure, Notification{
+				UserID:    userID,
+				Type:      NotificationMention,
+				ActorID:   chirp.AuthorID,
+				ChirpID:   chirp.ID,
+				CreatedAt: now,
+			}))
+		}
+
+		return nil
+	})
+
+	return notifications, err
+}
+
+// GetNotificationsByUserID returns up to limit of the user's notifications with an ID below beforeID, or
+// the latest ones if beforeID is zero, newest first. With unreadOnly set the read ones are left out.
+func (db *DB) GetNotificationsByUserID(ctx context.Context, userID int, unreadOnly bool, beforeID, limit int) ([]Notification, error) {
+	ctx, span := tracer.Start(ctx, "DB.GetNotificationsByUserID")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make([]Notification, 0)
+	for _, notification := range dbStructure.Notifications {
+		if notification.UserID != userID || (unreadOnly && notification.ReadAt != nil) {
+			continue
+		}
+
+		if beforeID <= 0 || notification.ID < beforeID {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	sort.Slice(notifications, func(a, b int) bool {
+		return notifications[a].ID > notifications[b].ID
+	})
+
+	if limit > 0 && len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+// CountUnreadNotifications returns the number of notifications the user has not read yet
+func (db *DB) CountUnreadNotifications(ctx context.Context, userID int) (int, error) {
+	ctx, span := tracer.Start(ctx, "DB.CountUnreadNotifications")
+	defer span.End()
+
+	dbStructure, err := db.loadDB(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	unread := 0
+	for _, notification := range dbStructure.Notifications {
+		if notification.UserID == userID && notification.ReadAt == nil {
+			unread++
+		}
+	}
+
+	return unread, nil
+}
+
+// MarkNotificationsRead marks the given notifications of the user as read, or all of them if ids is
+// empty, and returns how many were unread. Nothing is marked if one of the IDs is not the user's.
+func (db *DB) MarkNotificationsRead(ctx context.Context, userID int, ids []int) (int, error) {
+	ctx, span := tracer.Start(ctx, "DB.MarkNotificationsRead")
+	defer span.End()
+
+	marked := 0
+	err := db.update(ctx, func(dbStructure *DBStructure) error {
+		for _, id := range ids {
+			if notification, ok := dbStructure.Notifications[id]; !ok || notification.UserID != userID {
+				return fmt.Errorf("could not find notificationID %d: %w", id, ErrNotFound)
+			}
+		}
+
+		now := time.Now().UTC()
+		for id, notification := range dbStructure.Notifications {
+			if notification.UserID != userID || notification.ReadAt != nil || (len(ids) > 0 && !slices.Contains(ids, id)) {
+				continue
+			}
+
+			notification.ReadAt = &now
+			dbStructure.Notifications[id] = notification
+			marked++
+		}
+
+		if marked == 0 {
+			return errUnchanged
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return marked, nil
+}
+
+// removeUserFromNotifications deletes the notifications of a deleted user. The ones they caused for others
+// are kept with actor 0 if anonymize is set and deleted otherwise.
+func removeUserFromNotifications(dbStructure *DBStructure, userID int, anonymize bool) {
+	for id, notification := range dbStructure.Notifications {
+		switch {
+		case notification.UserID == userID:
+			delete(dbStructure.Notifications, id)
+		case notification.ActorID == userID && anonymize:
+			notification.ActorID = 0
+			dbStructure.Notifications[id] = notification
+		case notification.ActorID == userID:
+			delete(dbStructure.Notifications, id)
+		}
+	}
+}
@@ -1,51 +1,201 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/sebito91/bootdotdev/go/chirpy/admin"
 	"github.com/sebito91/bootdotdev/go/chirpy/api"
+	"github.com/sebito91/bootdotdev/go/chirpy/config"
+	"github.com/sebito91/bootdotdev/go/chirpy/web"
+	"github.com/sebito91/bootdotdev/go/httpcache"
+	"github.com/sebito91/bootdotdev/go/logging"
+	"github.com/sebito91/bootdotdev/go/tlsserver"
+	"github.com/sebito91/bootdotdev/go/tracing"
 )
 
 func main() {
-	fmt.Println("Welcome to Chirpy!")
+	cfg, cfgErr := config.Load(os.Args[1:], os.Stderr)
+	if errors.Is(cfgErr, flag.ErrHelp) {
+		os.Exit(0)
+	} else if cfgErr != nil {
+		fmt.Fprintf(os.Stderr, "invalid chirpy configuration:\n%s\n", cfgErr)
+		os.Exit(2)
+	}
+
+	logger, logErr := logging.NewLogger(os.Stderr)
+	if logErr != nil {
+		panic(logErr)
+	}
+
+	// route the standard library logger and any bare slog calls through the configured logger
+	slog.SetDefault(logger)
+	logger.Info("Welcome to Chirpy!")
 
 	appPrefix := "/"
-	apiCfg, apiErr := api.NewConfig()
+	apiCfg, apiErr := api.NewConfig(cfg)
 	if apiErr != nil {
 		panic(apiErr)
 	}
 
-	adminCfg, adminErr := admin.NewConfig(apiCfg)
+	shutdownTracing, traceErr := tracing.Setup(context.Background(), "chirpy")
+	if traceErr != nil {
+		panic(traceErr)
+	}
+
+	adminCfg, adminErr := admin.NewConfig(apiCfg, cfg.AdminAPIKey)
 	if adminErr != nil {
 		panic(adminErr)
 	}
 
-	mainHandler := http.StripPrefix(appPrefix, http.FileServer(http.Dir(".")))
-	fsHandler := apiCfg.MiddlewareMetricsInc(mainHandler)
+	webHandler, webErr := web.NewHandler(web.Options{
+		CacheMaxAge: cfg.StaticCacheMaxAge,
+		SPAFallback: cfg.StaticSPAFallback,
+		ModTime:     buildTime(),
+	})
+	if webErr != nil {
+		panic(webErr)
+	}
+
+	fsHandler := apiCfg.MiddlewareMetricsInc(http.StripPrefix(strings.TrimSuffix(appPrefix, "/"), webHandler))
 
 	// kick off the new multiplexer
 	r := chi.NewRouter()
-	r.Handle(appPrefix, fsHandler)
-	r.Handle(appPrefix+"/*", fsHandler)
+	r.Use(logging.MiddlewareRequestID)
+	r.Use(tracing.Middleware)
+	r.Use(logging.MiddlewareAccessLog(logger))
+	r.Use(apiCfg.MiddlewareMetrics)
+	r.Use(apiCfg.MiddlewareAnalytics)
 
-	r.Mount("/api", apiCfg.MiddlewareMetricsInc(apiCfg.GetAPI()))
-	r.Mount("/admin", adminCfg.GetAdminAPI())
+	// each route group gets its own CORS policy, answering the preflight requests for its routes
+	staticCORS := cfg.CORSPolicy(cfg.CORSAllowedOrigins, http.MethodGet, http.MethodHead)
+	apiCORS := cfg.CORSPolicy(cfg.CORSAllowedOrigins, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	adminCORS := cfg.CORSPolicy(cfg.CORSAdminAllowedOrigins, http.MethodGet, http.MethodPost, http.MethodDelete)
 
-	// wrap the mux in a custom middleware for CORS headers
-	corsMux := middlewareCors(r)
+	r.Handle(appPrefix, staticCORS.Handler(fsHandler))
+	r.Handle(appPrefix+"*", staticCORS.Handler(fsHandler))
+
+	r.Mount("/api", apiCORS.Handler(apiCfg.MiddlewareMetricsInc(httpcache.Handler(apiCfg.GetAPI()))))
+	r.Mount("/admin", adminCORS.Handler(adminCfg.GetAdminAPI()))
 
 	// create the server struct
 	server := &http.Server{
-		Addr:              "localhost:8080",
-		Handler:           corsMux,
+		Addr:              cfg.ListenAddr,
+		Handler:           tlsserver.MiddlewareHSTS(cfg.HSTSMaxAge)(r),
 		ReadHeaderTimeout: time.Second,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		panic(err)
+	// the chirp streams never finish on their own, end them as soon as the shutdown starts draining
+	server.RegisterOnShutdown(apiCfg.EndStreams)
+
+	// the first SIGINT/SIGTERM starts a graceful shutdown; a second one kills the process outright
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serve := server.ListenAndServe
+	if cfg.TLSEnabled() {
+		tlsConfig, tlsErr := tlsserver.NewServerConfig(ctx, cfg.TLSOptions(), logger)
+		if tlsErr != nil {
+			logger.Error("could not set up TLS", "error", tlsErr)
+			stop()
+			os.Exit(1)
+		}
+
+		server.TLSConfig = tlsConfig
+		serve = func() error { return server.ListenAndServeTLS("", "") }
 	}
+
+	serverErr := make(chan error, 2)
+	go func() {
+		logger.Info("starting chirpy listener", "addr", server.Addr, "tls", cfg.TLSEnabled())
+		serverErr <- serve()
+	}()
+
+	var redirectServer *http.Server
+	if cfg.HTTPRedirectAddr != "" {
+		redirectServer = &http.Server{
+			Addr:              cfg.HTTPRedirectAddr,
+			Handler:           tlsserver.RedirectHandler(cfg.ListenAddr),
+			ReadHeaderTimeout: time.Second,
+		}
+
+		go func() {
+			logger.Info("starting chirpy HTTPS redirect listener", "addr", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- err
+			}
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
+		logger.Error("chirpy listener failed", "error", err)
+		exitCode = 1
+	case <-ctx.Done():
+		logger.Info("received shutdown signal, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+	}
+
+	stop()
+
+	// report unhealthy first so load balancers can stop routing here before the listener closes
+	apiCfg.BeginShutdown()
+	time.Sleep(cfg.ShutdownDrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("could not drain in-flight requests before the deadline", "error", err)
+		exitCode = 1
+	}
+
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("could not close the HTTPS redirect listener", "error", err)
+			exitCode = 1
+		}
+	}
+
+	if err := apiCfg.Close(); err != nil {
+		logger.Error("could not close the database", "error", err)
+		exitCode = 1
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("could not flush traces", "error", err)
+		exitCode = 1
+	}
+
+	// os.Exit skips the deferred calls, so release the shutdown deadline here
+	cancel()
+
+	logger.Info("chirpy stopped")
+	os.Exit(exitCode)
+}
+
+// buildTime returns the modification time of the running binary, used as Last-Modified of the embedded
+// web app so that it stays stable across restarts of the same build
+func buildTime() time.Time {
+	exe, err := os.Executable()
+	if err != nil {
+		return time.Now()
+	}
+
+	info, err := os.Stat(exe)
+	if err != nil {
+		return time.Now()
+	}
+
+	return info.ModTime()
 }
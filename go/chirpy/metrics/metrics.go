@@ -0,0 +1,297 @@
+// Package metrics is a small, dependency-free set of counters, gauges and histograms that can be
+// rendered in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram upper bounds, in seconds, used for request and database latencies
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is anything that can write itself to the exposition output
+type collector interface {
+	writeText(w *bufio.Writer)
+}
+
+// Registry keeps every metric that should be exposed together
+type Registry struct {
+	collectors []collector
+	mux        sync.Mutex
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Sample is the value of a single labelled series, as returned by the Snapshot helpers
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// CounterVec is a set of monotonically increasing counters partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mux    sync.Mutex
+}
+
+// NewCounterVec registers a new CounterVec with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by delta
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+
+	c.mux.Lock()
+	c.values[key] += delta
+	c.mux.Unlock()
+}
+
+// Sum returns the total across every series of the counter
+func (c *CounterVec) Sum() float64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var sum float64
+	for _, v := range c.values {
+		sum += v
+	}
+
+	return sum
+}
+
+// Reset drops every series of the counter, as if the server restarted
+func (c *CounterVec) Reset() {
+	c.mux.Lock()
+	c.values = make(map[string]float64)
+	c.mux.Unlock()
+}
+
+// Snapshot returns every series of the counter ordered by label values
+func (c *CounterVec) Snapshot() []Sample {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	samples := make([]Sample, 0, len(c.values))
+	for _, key := range sortedKeys(c.values) {
+		samples = append(samples, Sample{Labels: splitKey(key), Value: c.values[key]})
+	}
+
+	return samples
+}
+
+func (c *CounterVec) writeText(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	for _, sample := range c.Snapshot() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, sample.Labels, "", ""), formatValue(sample.Value))
+	}
+}
+
+// histogram is the state of a single labelled series of a HistogramVec
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of histograms with shared buckets partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+	mux     sync.Mutex
+}
+
+// NewHistogramVec registers a new HistogramVec with the given upper bounds and label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+// Observe records a single value for the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for idx, bound := range h.buckets {
+		if value <= bound {
+			s.counts[idx]++
+		}
+	}
+
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) writeText(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, key := range sortedKeys(h.series) {
+		s, values := h.series[key], splitKey(key)
+		for idx, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(bound)), s.counts[idx])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), s.count)
+	}
+}
+
+// GaugeFunc is a gauge whose value is computed when the metrics are collected
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() (float64, error)
+}
+
+// NewGaugeFunc registers a gauge that calls fn on every collection; the gauge is skipped if fn errors
+func (r *Registry) NewGaugeFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+// Value returns the current value of the gauge
+func (g *GaugeFunc) Value() (float64, error) {
+	return g.fn()
+}
+
+func (g *GaugeFunc) writeText(w *bufio.Writer) {
+	value, err := g.fn()
+	if err != nil {
+		return
+	}
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(value))
+}
+
+// WriteText renders every registered metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mux.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mux.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.writeText(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler that serves the registry in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		if err := r.WriteText(w); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func (r *Registry) register(c collector) {
+	r.mux.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mux.Unlock()
+}
+
+// labelSeparator joins label values into a map key; it cannot appear in valid UTF-8 label values
+const labelSeparator = "\xff"
+
+func labelKey(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labels), len(values)))
+	}
+
+	return strings.Join(values, labelSeparator)
+}
+
+func splitKey(key string) []string {
+	return strings.Split(key, labelSeparator)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels renders a {name="value",...} label set, optionally with one extra label such as le
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	pairs := make([]string, 0, len(names)+1)
+	for idx, name := range names {
+		pairs = append(pairs, name+`="`+escaper.Replace(values[idx])+`"`)
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
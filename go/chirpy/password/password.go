@@ -0,0 +1,189 @@
+package password
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Params are the argon2id cost parameters; they are encoded with every hash so that hashes made with
+// older parameters can still be verified and flagged for an upgrade
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follows the OWASP recommendation for argon2id (19 MiB, 2 iterations, 1 thread)
+var DefaultParams = Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Policy describes the minimum strength a new password must meet
+type Policy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int
+}
+
+// DefaultPolicy only requires a reasonable length; character classes are opt-in
+var DefaultPolicy = Policy{
+	MinLength:      8,
+	MaxLength:      256,
+	MinCharClasses: 1,
+}
+
+// Hasher hashes new passwords with argon2id and verifies both argon2id and legacy bcrypt hashes
+type Hasher struct {
+	Params Params
+	Policy Policy
+}
+
+// NewHasher returns a Hasher with the given parameters and policy
+func NewHasher(params Params, policy Policy) *Hasher {
+	return &Hasher{Params: params, Policy: policy}
+}
+
+// Validate checks the password against the configured strength policy
+func (h *Hasher) Validate(password string) error {
+	if len(password) < h.Policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", h.Policy.MinLength)
+	}
+
+	if h.Policy.MaxLength > 0 && len(password) > h.Policy.MaxLength {
+		return fmt.Errorf("password must be at most %d characters long", h.Policy.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, found := range []bool{lower, upper, digit, symbol} {
+		if found {
+			classes++
+		}
+	}
+
+	if classes < h.Policy.MinCharClasses {
+		return fmt.Errorf("password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", h.Policy.MinCharClasses)
+	}
+
+	return nil
+}
+
+// Hash returns the argon2id hash of the password in the PHC string format, i.e.
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func (h *Hasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Params.Memory, h.Params.Iterations, h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+// Verify compares the password against the stored hash. needsRehash is set on a successful match when the
+// hash was made with a legacy algorithm or with parameters other than the current ones.
+func (h *Hasher) Verify(password string, hash []byte) (match bool, needsRehash bool, err error) {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		params, salt, key, err := decodeArgon2id(string(hash))
+		if err != nil {
+			return false, false, err
+		}
+
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false, nil
+		}
+
+		current := h.Params
+		return true, params.Memory != current.Memory || params.Iterations != current.Iterations ||
+			params.Parallelism != current.Parallelism || params.KeyLength != current.KeyLength ||
+			uint32(len(salt)) != current.SaltLength, nil
+	}
+
+	// anything else is assumed to be a bcrypt hash from before argon2id was introduced
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+
+		return false, false, err
+	}
+
+	return true, true, nil
+}
+
+// VerifyMissing does the work of verifying the password against an argon2id hash made with the current
+// parameters and throws the result away. Logins for unknown accounts call it so that they take as long
+// as a wrong password would, and response times do not reveal which accounts exist.
+func (h *Hasher) VerifyMissing(password string) {
+	salt := make([]byte, h.Params.SaltLength)
+	_ = argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+}
+
+// decodeArgon2id parses a PHC-formatted argon2id hash into its parameters, salt and key
+func decodeArgon2id(encoded string) (Params, []byte, []byte, error) {
+	var params Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id version: %s", err)
+	} else if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %s", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %s", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %s", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,278 @@
+// Package web serves the chirpy web app. The files are embedded in the binary and only the ones on the
+// allow-list are served, so nothing else in the working directory (the database, .env, ...) can leak.
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/sebito91/bootdotdev/go/httpcache"
+)
+
+//go:embed index.html assets
+var files embed.FS
+
+// Allowed lists the embedded files that are served, as path.Match patterns relative to the site root
+var Allowed = []string{
+	"index.html",
+	"assets/*.png",
+	"assets/*.svg",
+	"assets/*.ico",
+	"assets/*.css",
+	"assets/*.js",
+}
+
+// content types that are already compressed and gain nothing from gzip or brotli
+var precompressedTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "font/woff2"}
+
+// Options tune how the web app is served
+type Options struct {
+	// CacheMaxAge is the max-age of the Cache-Control header for assets; HTML pages are always
+	// revalidated so that a new release shows up straight away
+	CacheMaxAge time.Duration
+	// SPAFallback serves index.html for unknown paths that look like app routes, rather than a 404
+	SPAFallback bool
+	// ModTime is sent as Last-Modified, since embedded files carry no modification time
+	ModTime time.Time
+}
+
+// variant is one encoding of a file, with its own ETag
+type variant struct {
+	encoding string
+	data     []byte
+	etag     string
+}
+
+// asset is a served file with its identity encoding first, followed by its compressed variants
+type asset struct {
+	name         string
+	contentType  string
+	cacheControl string
+	variants     []variant
+}
+
+// Handler serves the allowed embedded files
+type Handler struct {
+	assets  map[string]*asset
+	index   *asset
+	opts    Options
+	modTime time.Time
+}
+
+// NewHandler reads and compresses the allowed embedded files up front so that requests only ever copy
+// bytes from memory
+func NewHandler(opts Options) (*Handler, error) {
+	if opts.ModTime.IsZero() {
+		opts.ModTime = time.Now()
+	}
+
+	h := &Handler{
+		assets:  make(map[string]*asset),
+		opts:    opts,
+		modTime: opts.ModTime.UTC().Truncate(time.Second),
+	}
+
+	err := fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !allowed(name) {
+			return err
+		}
+
+		data, err := files.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		a, err := newAsset(name, data, opts.CacheMaxAge)
+		if err != nil {
+			return fmt.Errorf("could not prepare %s: %w", name, err)
+		}
+
+		h.assets[name] = a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.index = h.assets["index.html"]
+	if h.index == nil {
+		return nil, fmt.Errorf("expected index.html to be embedded and allowed")
+	}
+
+	return h, nil
+}
+
+// allowed reports whether name matches one of the Allowed patterns
+func allowed(name string) bool {
+	for _, pattern := range Allowed {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Asset returns the name of the allowed embedded file served at urlPath, leaving out the SPA fallback
+func Asset(urlPath string) (string, bool) {
+	name := assetName(urlPath)
+	if !allowed(name) {
+		return "", false
+	}
+
+	if _, err := fs.Stat(files, name); err != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+// assetName maps a request path to the name of the embedded file, the site root being index.html
+func assetName(urlPath string) string {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	return name
+}
+
+// newAsset builds the identity, brotli and gzip variants of a file, keeping a compressed variant only
+// when it is actually smaller
+func newAsset(name string, data []byte, maxAge time.Duration) (*asset, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if strings.HasPrefix(contentType, "text/html") {
+		cacheControl = "no-cache"
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+
+	a := &asset{
+		name:         name,
+		contentType:  contentType,
+		cacheControl: cacheControl,
+		variants:     []variant{{data: data, etag: `"` + hash + `"`}},
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, t := range precompressedTypes {
+		if mediaType == t {
+			return a, nil
+		}
+	}
+
+	var br bytes.Buffer
+	bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+	if _, err := bw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+
+	var gz bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, v := range []variant{
+		{encoding: "br", data: br.Bytes(), etag: `"` + hash + `-br"`},
+		{encoding: "gzip", data: gz.Bytes(), etag: `"` + hash + `-gz"`},
+	} {
+		if len(v.data) < len(data) {
+			a.variants = append(a.variants, v)
+		}
+	}
+
+	return a, nil
+}
+
+// ServeHTTP serves the file at the request path, answering conditional and range requests
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := assetName(r.URL.Path)
+
+	a, ok := h.assets[name]
+	if !ok && h.opts.SPAFallback && isAppRoute(name) {
+		a, ok = h.index, true
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	v := a.negotiate(r.Header.Get("Accept-Encoding"))
+
+	header := w.Header()
+	header.Set("Content-Type", a.contentType)
+	header.Set("Cache-Control", a.cacheControl)
+	header.Set("ETag", v.etag)
+	header.Set("X-Content-Type-Options", "nosniff")
+	if len(a.variants) > 1 {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if v.encoding != "" {
+		header.Set("Content-Encoding", v.encoding)
+	}
+
+	http.ServeContent(w, r, a.name, h.modTime, bytes.NewReader(v.data))
+}
+
+// isAppRoute reports whether a missing path should fall back to index.html: files with an extension
+// are real 404s, anything else is assumed to be a client-side route
+func isAppRoute(name string) bool {
+	return path.Ext(name) == ""
+}
+
+// negotiate picks the variant the client accepts with the highest quality, the compressed variants being
+// in order of preference
+func (a *asset) negotiate(acceptEncoding string) variant {
+	offered := make([]string, 0, len(a.variants)-1)
+	for _, v := range a.variants[1:] {
+		offered = append(offered, v.encoding)
+	}
+
+	encoding := httpcache.Negotiate(acceptEncoding, offered...)
+	for _, v := range a.variants[1:] {
+		if v.encoding == encoding {
+			return v
+		}
+	}
+
+	return a.variants[0]
+}
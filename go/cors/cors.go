@@ -0,0 +1,225 @@
+// Package cors implements the cross-origin resource sharing policy shared by chirpy and bloggy. A Policy
+// is attached to a group of routes and answers the browser's preflight requests for them, adding the
+// CORS headers to actual requests coming from an allowed origin.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy describes which cross-origin requests a group of routes accepts
+type Policy struct {
+	// AllowedOrigins lists the origins allowed to call the routes, e.g. "https://chirpy.example.com". An
+	// entry may contain a single "*" wildcard, as in "https://*.example.com", and "*" alone allows any.
+	AllowedOrigins []string
+	// AllowedMethods lists the methods accepted in preflight requests
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers accepted in preflight requests; "*" allows any
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers that scripts are allowed to read
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and Authorization headers and read the response
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight request; zero leaves it to them
+	MaxAge time.Duration
+}
+
+// ParseList splits a comma-separated setting such as "GET, POST" into its trimmed, non-empty entries
+func ParseList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// Validate checks that the policy can be enforced, reporting all of the problems at once
+func (p Policy) Validate() error {
+	var errs []error
+
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				errs = append(errs, errors.New("CORS credentials cannot be allowed for every origin, list the origins explicitly"))
+			}
+
+			continue
+		}
+
+		if strings.Count(origin, "*") > 1 {
+			errs = append(errs, fmt.Errorf("expected at most one wildcard in CORS origin %s", origin))
+			continue
+		}
+
+		u, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("expected CORS origin of the form https://host[:port], got %s", origin))
+		}
+	}
+
+	for _, method := range p.AllowedMethods {
+		if method != strings.ToUpper(method) {
+			errs = append(errs, fmt.Errorf("expected upper case CORS method, got %s", method))
+		}
+	}
+
+	if p.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("expected CORS max age not to be negative, got %s", p.MaxAge))
+	}
+
+	return errors.Join(errs...)
+}
+
+// AllowsOrigin reports whether the policy accepts requests from origin, for handlers that have to check
+// the origin themselves, such as WebSocket upgrades, which browsers send without a preflight
+func (p Policy) AllowsOrigin(origin string) bool {
+	return p.allowsAnyOrigin() || p.allowsOrigin(origin)
+}
+
+// allowsOrigin reports whether origin matches one of the allowed origins
+func (p Policy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+
+		prefix, suffix, wildcard := strings.Cut(allowed, "*")
+		if !wildcard {
+			if origin == allowed {
+				return true
+			}
+
+			continue
+		}
+
+		// the wildcard has to stand for at least one character so "https://*.example.com" does not match
+		// "https://.example.com"
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsAnyOrigin reports whether the policy accepts requests from every origin
+func (p Policy) allowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsMethod reports whether method may be used in a cross-origin request
+func (p Policy) allowsMethod(method string) bool {
+	for _, allowed := range p.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsHeaders reports whether every header named in the comma-separated list may be sent
+func (p Policy) allowsHeaders(requested string) bool {
+	for _, header := range ParseList(requested) {
+		found := false
+		for _, allowed := range p.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setOrigin writes the Access-Control-Allow-Origin and Access-Control-Allow-Credentials headers. The
+// origin is echoed back unless any origin is allowed without credentials, so that caches keyed on
+// Vary: Origin stay correct.
+func (p Policy) setOrigin(h http.Header, origin string) {
+	if p.allowsAnyOrigin() && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Handler applies the policy to the routes served by next. Preflight requests are answered directly:
+// 204 if the origin, method and headers are allowed and 403 otherwise. Other requests are passed on,
+// with the CORS headers added only for allowed origins so that the browser blocks the rest.
+func (p Policy) Handler(next http.Handler) http.Handler {
+	allowedMethods := strings.Join(p.AllowedMethods, ", ")
+	exposedHeaders := strings.Join(p.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(p.MaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		// same-origin and non-browser requests carry no Origin and need no CORS headers
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestedMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestedMethod == "" {
+			if p.allowsOrigin(origin) {
+				p.setOrigin(w.Header(), origin)
+				if exposedHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// preflight request
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+		if !p.allowsOrigin(origin) || !p.allowsMethod(requestedMethod) || !p.allowsHeaders(requestedHeaders) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		p.setOrigin(w.Header(), origin)
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		if requestedHeaders != "" {
+			// the requested headers have been checked above, echoing them also covers a "*" entry that
+			// browsers do not honour together with credentials
+			w.Header().Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+
+		if p.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,268 @@
+package cors_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sebito91/bootdotdev/go/cors"
+)
+
+// TestAllowsOrigin checks the exact and wildcard origin matching, including the look-alike origins a
+// wildcard must not match
+func TestAllowsOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"exact", []string{"https://chirpy.example.com"}, "https://chirpy.example.com", true},
+		{"exact ignores case and trailing slash", []string{"https://Chirpy.example.com/"}, "https://chirpy.example.com", true},
+		{"exact other host", []string{"https://chirpy.example.com"}, "https://bloggy.example.com", false},
+		{"exact other scheme", []string{"https://chirpy.example.com"}, "http://chirpy.example.com", false},
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://x.example.com", true},
+		{"wildcard nested subdomain", []string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard empty label", []string{"https://*.example.com"}, "https://.example.com", false},
+		{"wildcard apex", []string{"https://*.example.com"}, "https://example.com", false},
+		{"wildcard suffixed host", []string{"https://*.example.com"}, "https://x.example.com.evil.com", false},
+		{"wildcard other scheme", []string{"https://*.example.com"}, "http://x.example.com", false},
+		{"wildcard port", []string{"http://localhost:*"}, "http://localhost:5173", true},
+		{"any origin", []string{"*"}, "https://evil.com", true},
+		{"no origins", nil, "https://chirpy.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := cors.Policy{AllowedOrigins: tt.allowed}
+			if got := p.AllowsOrigin(tt.origin); got != tt.want {
+				t.Errorf("expected AllowsOrigin(%q) with %q to be %t, got %t", tt.origin, tt.allowed, tt.want, got)
+			}
+		})
+	}
+}
+
+// TestValidate checks that the policies which cannot be enforced are rejected
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  cors.Policy
+		wantErr bool
+	}{
+		{"explicit origins", cors.Policy{AllowedOrigins: []string{"https://chirpy.example.com", "https://*.example.com"}, AllowCredentials: true}, false},
+		{"any origin without credentials", cors.Policy{AllowedOrigins: []string{"*"}}, false},
+		{"any origin with credentials", cors.Policy{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{"two wildcards", cors.Policy{AllowedOrigins: []string{"https://*.*.example.com"}}, true},
+		{"missing scheme", cors.Policy{AllowedOrigins: []string{"chirpy.example.com"}}, true},
+		{"path", cors.Policy{AllowedOrigins: []string{"https://chirpy.example.com/app"}}, true},
+		{"lower case method", cors.Policy{AllowedMethods: []string{"get"}}, true},
+		{"negative max age", cors.Policy{MaxAge: -time.Second}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestHandler checks the status and CORS headers of actual and preflight requests
+func TestHandler(t *testing.T) {
+	explicit := cors.Policy{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	anyOrigin := cors.Policy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"*"},
+	}
+
+	preflightVary := []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}
+
+	tests := []struct {
+		name        string
+		policy      cors.Policy
+		method      string
+		header      map[string]string
+		wantStatus  int
+		wantHeaders map[string]string
+		wantVary    []string
+	}{
+		{
+			name:        "no origin",
+			policy:      explicit,
+			method:      http.MethodGet,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:       "allowed origin",
+			policy:     explicit,
+			method:     http.MethodGet,
+			header:     map[string]string{"Origin": "https://x.example.com"},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://x.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-ID",
+			},
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:        "disallowed origin is served without CORS headers",
+			policy:      explicit,
+			method:      http.MethodGet,
+			header:      map[string]string{"Origin": "https://x.example.com.evil.com"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:        "any origin without credentials",
+			policy:      anyOrigin,
+			method:      http.MethodGet,
+			header:      map[string]string{"Origin": "https://evil.com"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name: "any origin with credentials echoes the origin",
+			policy: cors.Policy{
+				AllowedOrigins:   []string{"*"},
+				AllowCredentials: true,
+			},
+			method:     http.MethodGet,
+			header:     map[string]string{"Origin": "https://evil.com"},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://evil.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:   "allowed preflight",
+			policy: explicit,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://x.example.com",
+				"Access-Control-Request-Method":  http.MethodPost,
+				"Access-Control-Request-Headers": "authorization, content-type",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://x.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, POST",
+				"Access-Control-Allow-Headers":     "authorization, content-type",
+				"Access-Control-Max-Age":           "600",
+			},
+			wantVary: preflightVary,
+		},
+		{
+			name:   "preflight from a disallowed origin",
+			policy: explicit,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                        "https://.example.com",
+				"Access-Control-Request-Method": http.MethodPost,
+			},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    preflightVary,
+		},
+		{
+			name:   "preflight for a disallowed method",
+			policy: explicit,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                        "https://x.example.com",
+				"Access-Control-Request-Method": http.MethodDelete,
+			},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    preflightVary,
+		},
+		{
+			name:   "preflight for a disallowed header",
+			policy: explicit,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://x.example.com",
+				"Access-Control-Request-Method":  http.MethodPost,
+				"Access-Control-Request-Headers": "X-Debug",
+			},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    preflightVary,
+		},
+		{
+			name:   "preflight with a wildcard header and no max age",
+			policy: anyOrigin,
+			method: http.MethodOptions,
+			header: map[string]string{
+				"Origin":                         "https://evil.com",
+				"Access-Control-Request-Method":  http.MethodGet,
+				"Access-Control-Request-Headers": "X-Debug",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Headers": "X-Debug",
+				"Access-Control-Max-Age":       "",
+			},
+			wantVary: preflightVary,
+		},
+		{
+			name:        "OPTIONS without a requested method is not a preflight",
+			policy:      explicit,
+			method:      http.MethodOptions,
+			header:      map[string]string{"Origin": "https://x.example.com"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://x.example.com", "Access-Control-Allow-Methods": ""},
+			wantVary:    []string{"Origin"},
+		},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/chirps", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			tt.policy.Handler(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			for k, want := range tt.wantHeaders {
+				if got := rec.Header().Get(k); got != want {
+					t.Errorf("expected %s %q, got %q", k, want, got)
+				}
+			}
+
+			if got := rec.Header().Values("Vary"); !reflect.DeepEqual(got, tt.wantVary) {
+				t.Errorf("expected Vary %q, got %q", tt.wantVary, got)
+			}
+		})
+	}
+}
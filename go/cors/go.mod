@@ -0,0 +1,3 @@
+module github.com/sebito91/bootdotdev/go/cors
+
+go 1.21.3
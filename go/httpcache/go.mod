@@ -0,0 +1,5 @@
+module github.com/sebito91/bootdotdev/go/httpcache
+
+go 1.21.3
+
+require github.com/klauspost/compress v1.17.4
@@ -0,0 +1,244 @@
+// Package httpcache implements the conditional GET and response compression shared by chirpy and bloggy.
+// Handler buffers successful JSON responses to GET and HEAD requests, tags them with a weak ETag computed
+// over the body, answers a matching If-None-Match with 304 Not Modified and otherwise compresses the body
+// with zstd or gzip, as negotiated from Accept-Encoding.
+package httpcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bodies smaller than this are sent uncompressed, as the framing would outweigh the savings
+const minCompressSize = 256
+
+// the encodings Handler can produce, in order of preference when the client accepts several equally
+var encodings = []string{"zstd", "gzip"}
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		gw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return gw
+	},
+}
+
+// zstdEncoder is only used through EncodeAll, which is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+
+// Handler adds ETags, conditional GET and compression to the JSON responses of next. Any other response,
+// including errors, streams and protocol upgrades, is passed through untouched.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+		bw.finish(r)
+	})
+}
+
+// bufferedWriter holds back an eligible response until the handler is done, so that its ETag can be
+// computed; ineligible responses are written straight through
+type bufferedWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	wroteHeader bool
+	passthrough bool
+}
+
+// WriteHeader decides, once the handler has set its headers, whether the response is buffered
+func (bw *bufferedWriter) WriteHeader(status int) {
+	if bw.wroteHeader {
+		return
+	}
+
+	bw.wroteHeader = true
+	bw.status = status
+
+	if !eligible(status, bw.Header()) {
+		bw.passthrough = true
+		bw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write buffers the body of eligible responses
+func (bw *bufferedWriter) Write(p []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+
+	if bw.passthrough {
+		return bw.ResponseWriter.Write(p)
+	}
+
+	return bw.buf.Write(p)
+}
+
+// Flush gives up on buffering: a handler that flushes wants its output on the wire as it is written
+func (bw *bufferedWriter) Flush() {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+
+	if !bw.passthrough {
+		bw.passthrough = true
+		bw.ResponseWriter.WriteHeader(bw.status)
+		if _, err := bw.ResponseWriter.Write(bw.buf.Bytes()); err != nil {
+			slog.Error("could not write buffered response", "error", err)
+		}
+
+		bw.buf.Reset()
+	}
+
+	// the writers below may only expose Flush through Unwrap
+	if err := http.NewResponseController(bw.ResponseWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Error("could not flush response", "error", err)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (bw *bufferedWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// eligible reports whether a response is a successful, not yet encoded, JSON document
+func eligible(status int, header http.Header) bool {
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// finish writes out the buffered response as a 304, a compressed body or the body as is
+func (bw *bufferedWriter) finish(r *http.Request) {
+	if !bw.wroteHeader || bw.passthrough {
+		return
+	}
+
+	body := bw.buf.Bytes()
+	header := bw.Header()
+
+	etag := header.Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = `W/"` + hex.EncodeToString(sum[:16]) + `"`
+		header.Set("ETag", etag)
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		bw.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	encoding := ""
+	if len(body) >= minCompressSize {
+		encoding = Negotiate(r.Header.Get("Accept-Encoding"), encodings...)
+	}
+
+	switch encoding {
+	case "zstd":
+		body = zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/2))
+	case "gzip":
+		var gz bytes.Buffer
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(&gz)
+		if _, err := gw.Write(body); err != nil {
+			slog.Error("could not gzip response", "error", err)
+		}
+
+		if err := gw.Close(); err != nil {
+			slog.Error("could not gzip response", "error", err)
+		}
+
+		gzipWriters.Put(gw)
+		body = gz.Bytes()
+	}
+
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	bw.ResponseWriter.WriteHeader(bw.status)
+	if _, err := bw.ResponseWriter.Write(body); err != nil {
+		slog.Error("could not write response", "error", err)
+	}
+}
+
+// matchesETag applies the weak comparison of If-None-Match, where W/"x" and "x" are the same tag
+func matchesETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Negotiate picks the offered encoding with the highest quality in Accept-Encoding, preferring the earlier
+// one when several are equally acceptable, or "" for the identity encoding. An explicit entry for an
+// encoding wins over the * wildcard, and a quality of zero refuses it.
+func Negotiate(acceptEncoding string, offered ...string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" {
+			continue
+		}
+
+		q := 1.0
+		if val, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		qualities[token] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,318 @@
+package httpcache_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sebito91/bootdotdev/go/httpcache"
+)
+
+// TestNegotiate checks the choice of encoding for a range of Accept-Encoding headers
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		offered        []string
+		want           string
+	}{
+		{"no header", "", []string{"zstd", "gzip"}, ""},
+		{"identity only", "identity", []string{"zstd", "gzip"}, ""},
+		{"single encoding", "gzip", []string{"zstd", "gzip"}, "gzip"},
+		{"case insensitive", "GZip", []string{"zstd", "gzip"}, "gzip"},
+		{"equal quality prefers the first offered", "gzip, zstd", []string{"zstd", "gzip"}, "zstd"},
+		{"higher quality wins", "zstd;q=0.5, gzip", []string{"zstd", "gzip"}, "gzip"},
+		{"spaces around the quality", "zstd ; q=0.8, gzip; q = 0.9", []string{"zstd", "gzip"}, "gzip"},
+		{"invalid quality counts as 1", "zstd;q=x, gzip;q=0.9", []string{"zstd", "gzip"}, "zstd"},
+		{"zero quality refuses", "gzip;q=0", []string{"zstd", "gzip"}, ""},
+		{"wildcard", "*", []string{"zstd", "gzip"}, "zstd"},
+		{"explicit entry wins over the wildcard", "*;q=0.1, zstd;q=0", []string{"zstd", "gzip"}, "gzip"},
+		{"wildcard refuses the rest", "gzip, *;q=0", []string{"zstd", "gzip"}, "gzip"},
+		{"nothing offered is accepted", "br", []string{"zstd", "gzip"}, ""},
+		{"other offers", "gzip, br", []string{"br", "gzip"}, "br"},
+		{"nothing offered", "gzip", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpcache.Negotiate(tt.acceptEncoding, tt.offered...); got != tt.want {
+				t.Errorf("expected Negotiate(%q, %q) to be %q, got %q", tt.acceptEncoding, tt.offered, tt.want, got)
+			}
+		})
+	}
+}
+
+// jsonHandler writes body as a JSON response with the given status and ETag, if any
+func jsonHandler(status int, etag, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	})
+}
+
+// decode undoes the Content-Encoding of a response body
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	switch encoding {
+	case "":
+		return string(body)
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not read gzip body: %s", err)
+		}
+
+		decoded, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("could not read gzip body: %s", err)
+		}
+
+		return string(decoded)
+	case "zstd":
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatalf("could not create zstd reader: %s", err)
+		}
+		defer zr.Close()
+
+		decoded, err := zr.DecodeAll(body, nil)
+		if err != nil {
+			t.Fatalf("could not read zstd body: %s", err)
+		}
+
+		return string(decoded)
+	default:
+		t.Fatalf("unexpected Content-Encoding %q", encoding)
+		return ""
+	}
+}
+
+// TestHandler checks the ETags, conditional GETs and compression applied to the responses of a handler
+func TestHandler(t *testing.T) {
+	large := `{"body":"` + strings.Repeat("chirp ", 100) + `"}`
+	small := `{"body":"chirp"}`
+
+	// the ETag Handler computes for the large body
+	rec := httptest.NewRecorder()
+	httpcache.Handler(jsonHandler(http.StatusOK, "", large)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("expected a weak ETag, got %q", etag)
+	}
+
+	strongETag := strings.TrimPrefix(etag, "W/")
+
+	tests := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		next         http.Handler
+		wantStatus   int
+		wantETag     string
+		wantEncoding string
+		wantVary     bool
+		wantBody     string
+	}{
+		{
+			name:       "uncompressed",
+			method:     http.MethodGet,
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusOK,
+			wantETag:   etag,
+			wantVary:   true,
+			wantBody:   large,
+		},
+		{
+			name:         "gzip",
+			method:       http.MethodGet,
+			header:       map[string]string{"Accept-Encoding": "gzip"},
+			next:         jsonHandler(http.StatusOK, "", large),
+			wantStatus:   http.StatusOK,
+			wantETag:     etag,
+			wantEncoding: "gzip",
+			wantVary:     true,
+			wantBody:     large,
+		},
+		{
+			name:         "zstd preferred",
+			method:       http.MethodGet,
+			header:       map[string]string{"Accept-Encoding": "gzip, zstd"},
+			next:         jsonHandler(http.StatusOK, "", large),
+			wantStatus:   http.StatusOK,
+			wantETag:     etag,
+			wantEncoding: "zstd",
+			wantVary:     true,
+			wantBody:     large,
+		},
+		{
+			name:       "small bodies are not compressed",
+			method:     http.MethodGet,
+			header:     map[string]string{"Accept-Encoding": "gzip"},
+			next:       jsonHandler(http.StatusOK, "", small),
+			wantStatus: http.StatusOK,
+			wantVary:   true,
+			wantBody:   small,
+		},
+		{
+			name:       "matching If-None-Match",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": etag},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   etag,
+			wantVary:   true,
+		},
+		{
+			name:       "If-None-Match uses the weak comparison",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": strongETag},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   etag,
+			wantVary:   true,
+		},
+		{
+			name:       "If-None-Match list",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": `"other", ` + etag},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   etag,
+			wantVary:   true,
+		},
+		{
+			name:       "If-None-Match wildcard",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": "*"},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   etag,
+			wantVary:   true,
+		},
+		{
+			name:       "stale If-None-Match",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": `W/"other"`},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusOK,
+			wantETag:   etag,
+			wantVary:   true,
+			wantBody:   large,
+		},
+		{
+			name:       "handler ETag is kept",
+			method:     http.MethodGet,
+			header:     map[string]string{"If-None-Match": `"v1"`},
+			next:       jsonHandler(http.StatusOK, `"v1"`, large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   `"v1"`,
+			wantVary:   true,
+		},
+		{
+			name:       "HEAD",
+			method:     http.MethodHead,
+			header:     map[string]string{"If-None-Match": etag},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusNotModified,
+			wantETag:   etag,
+			wantVary:   true,
+		},
+		{
+			name:       "errors pass through",
+			method:     http.MethodGet,
+			header:     map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "*"},
+			next:       jsonHandler(http.StatusNotFound, "", large),
+			wantStatus: http.StatusNotFound,
+			wantBody:   large,
+		},
+		{
+			name:       "POST passes through",
+			method:     http.MethodPost,
+			header:     map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "*"},
+			next:       jsonHandler(http.StatusOK, "", large),
+			wantStatus: http.StatusOK,
+			wantBody:   large,
+		},
+		{
+			name:   "non-JSON passes through",
+			method: http.MethodGet,
+			header: map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "*"},
+			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = io.WriteString(w, large)
+			}),
+			wantStatus: http.StatusOK,
+			wantBody:   large,
+		},
+		{
+			name:   "problem+json is eligible",
+			method: http.MethodGet,
+			header: map[string]string{"Accept-Encoding": "gzip"},
+			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				_, _ = io.WriteString(w, large)
+			}),
+			wantStatus:   http.StatusOK,
+			wantETag:     etag,
+			wantEncoding: "gzip",
+			wantVary:     true,
+			wantBody:     large,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			httpcache.Handler(tt.next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			if tt.wantETag != "" {
+				if got := rec.Header().Get("ETag"); got != tt.wantETag {
+					t.Errorf("expected ETag %q, got %q", tt.wantETag, got)
+				}
+			} else if !tt.wantVary && rec.Header().Get("ETag") != "" {
+				t.Errorf("expected no ETag on a response passed through, got %q", rec.Header().Get("ETag"))
+			}
+
+			encoding := rec.Header().Get("Content-Encoding")
+			if encoding != tt.wantEncoding {
+				t.Errorf("expected Content-Encoding %q, got %q", tt.wantEncoding, encoding)
+			}
+
+			if got := rec.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+				t.Errorf("expected Vary: Accept-Encoding %t, got %q", tt.wantVary, rec.Header().Values("Vary"))
+			}
+
+			if tt.wantStatus == http.StatusNotModified {
+				if rec.Body.Len() != 0 {
+					t.Errorf("expected an empty 304 body, got %d bytes", rec.Body.Len())
+				}
+
+				return
+			}
+
+			if got := decode(t, encoding, rec.Body.Bytes()); got != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/sebito91/bootdotdev/go/logging
+
+go 1.21.3
+
+require github.com/go-chi/chi/v5 v5.0.10
@@ -0,0 +1,212 @@
+// Package logging configures the structured logger shared by chirpy and bloggy and provides the request
+// ID and access log middlewares that tie each log line back to the request that produced it.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// RequestIDHeader is the header used to receive and return the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDRegex restricts the incoming request IDs we are willing to echo back and log
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// NewLogger returns a logger writing to w, configured by LOG_LEVEL (debug, info, warn or error; default
+// info) and LOG_FORMAT (json or text; default json)
+func NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if lvl := os.Getenv("LOG_LEVEL"); lvl != "" {
+		if err := level.UnmarshalText([]byte(lvl)); err != nil {
+			return nil, fmt.Errorf("expected LOG_LEVEL to be one of debug, info, warn or error, got %s", lvl)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("expected LOG_FORMAT to be one of json or text, got %s", format)
+	}
+}
+
+// requestInfo is the per-request state shared between the middlewares and the handlers
+type requestInfo struct {
+	id    string
+	start time.Time
+	user  string
+	mux   sync.Mutex
+}
+
+type contextKey struct{}
+
+func fromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(contextKey{}).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID of the request carried by ctx, or an empty string if there is none
+func RequestID(ctx context.Context) string {
+	if info := fromContext(ctx); info != nil {
+		return info.id
+	}
+
+	return ""
+}
+
+// SetUser records the authenticated user on the request so that it appears in its log lines
+func SetUser(ctx context.Context, user string) {
+	if info := fromContext(ctx); info != nil {
+		info.mux.Lock()
+		info.user = user
+		info.mux.Unlock()
+	}
+}
+
+// RequestAttrs returns the request ID, route, user and latency so far of the request, for use when
+// logging from within a handler
+func RequestAttrs(r *http.Request) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("route", RoutePattern(r)),
+	}
+
+	if info := fromContext(r.Context()); info != nil {
+		info.mux.Lock()
+		user := info.user
+		info.mux.Unlock()
+
+		attrs = append(attrs,
+			slog.String("request_id", info.id),
+			slog.String("user", user),
+			slog.Duration("latency", time.Since(info.start)))
+	}
+
+	return attrs
+}
+
+// MiddlewareRequestID assigns every request an ID, reusing a well-formed incoming X-Request-ID header,
+// and returns it in the response headers
+func MiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		info := &requestInfo{id: id, start: time.Now()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, info)))
+	})
+}
+
+// newRequestID generates a random 128-bit request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// ResponseRecorder wraps a ResponseWriter to remember the status code and size of the response, for the
+// middlewares that report on it once the handler has returned
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// NewResponseRecorder returns a ResponseRecorder passing everything on to w
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+// Status returns the status code written by the handler, or 200 if it never wrote one
+func (rr *ResponseRecorder) Status() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+
+	return rr.status
+}
+
+// Bytes returns the number of bytes written to the response body
+func (rr *ResponseRecorder) Bytes() int {
+	return rr.bytes
+}
+
+// WriteHeader records the status code before passing it on
+func (rr *ResponseRecorder) WriteHeader(code int) {
+	if rr.status == 0 {
+		rr.status = code
+	}
+
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 and the number of bytes written
+func (rr *ResponseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController
+func (rr *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// MiddlewareAccessLog writes one structured log line per request once it has been served. It must run
+// inside MiddlewareRequestID for the line to carry the request ID and user.
+func MiddlewareAccessLog(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := NewResponseRecorder(w)
+
+			next.ServeHTTP(rec, r)
+
+			attrs := append(RequestAttrs(r),
+				slog.Int("status", rec.Status()),
+				slog.Int("bytes", rec.Bytes()),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()))
+
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// RoutePattern returns the chi route that matched the request, or "unmatched" if there was none
+func RoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || len(rctx.RoutePatterns) == 0 {
+		return "unmatched"
+	}
+
+	// chi trims the trailing slash from patterns, which leaves the root route as an empty string
+	return "/" + strings.TrimPrefix(rctx.RoutePattern(), "/")
+}
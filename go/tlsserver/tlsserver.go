@@ -0,0 +1,286 @@
+// Package tlsserver provides what chirpy and bloggy need to terminate TLS themselves: a certificate source
+// that is reloaded without downtime, a self-signed certificate for local development, the plain HTTP listener
+// that redirects to HTTPS and the HSTS header middleware.
+package tlsserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloader serves a certificate and key pair from disk, swapping in the new pair whenever the files
+// change or the process receives SIGHUP. Handshakes in flight keep the certificate they started with.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mux     sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewReloader loads the certificate and key pair, failing if it cannot be used
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate and key pair again. On error the previous pair stays in use.
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate %s and key %s: %s", r.certFile, r.keyFile, err)
+	}
+
+	r.mux.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mux.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP and whenever either file has changed, checking every interval,
+// until ctx is done. Failed reloads are logged and retried on the next signal or check.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("received SIGHUP, reloading TLS certificate", "cert", r.certFile)
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				logger.Warn("could not check TLS certificate for changes", "error", err)
+				continue
+			}
+
+			r.mux.RLock()
+			changed := modTime.After(r.modTime)
+			r.mux.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			logger.Info("TLS certificate changed on disk, reloading", "cert", r.certFile)
+		}
+
+		if err := r.Reload(); err != nil {
+			logger.Error("could not reload TLS certificate, keeping the current one", "error", err)
+			continue
+		}
+
+		logger.Info("reloaded TLS certificate", "cert", r.certFile)
+	}
+}
+
+// latestModTime returns the most recent modification time of the certificate and key files
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, fmt.Errorf("could not stat %s: %s", path, err)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// SelfSigned generates a throwaway certificate valid for a week for localhost and the given extra hosts,
+// so that TLS can be tested locally. Clients will not trust it without being told to.
+func SelfSigned(hosts ...string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate private key: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate serial number: %s", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"bootdotdev development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	for _, host := range hosts {
+		if host == "" || host == "localhost" {
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.IsUnspecified() {
+				continue
+			}
+
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create self-signed certificate: %s", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Fingerprint returns the hex SHA-256 fingerprint of the leaf certificate, handy for pinning a dev cert
+func Fingerprint(cert *tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// Options select the certificate the server presents
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates a development certificate for localhost and Hosts instead of loading one
+	SelfSigned bool
+	Hosts      []string
+	// ReloadInterval is how often the certificate files are checked for changes, see Reloader.Watch
+	ReloadInterval time.Duration
+}
+
+// NewServerConfig returns the TLS settings for the listener: a generated certificate in self-signed mode,
+// otherwise the configured certificate and key, reloaded on change until ctx is done
+func NewServerConfig(ctx context.Context, opts Options, logger *slog.Logger) (*tls.Config, error) {
+	if opts.SelfSigned {
+		cert, err := SelfSigned(opts.Hosts...)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Warn("serving HTTPS with a self-signed certificate, do not use this outside of development",
+			"sha256", Fingerprint(cert))
+		return NewConfig(StaticCertificate(cert)), nil
+	}
+
+	reloader, err := NewReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	go reloader.Watch(ctx, opts.ReloadInterval, logger)
+	return NewConfig(reloader.GetCertificate), nil
+}
+
+// NewConfig returns the TLS settings for the server, taking the certificate from getCertificate on every
+// handshake so that it can be swapped at runtime
+func NewConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+	}
+}
+
+// StaticCertificate adapts a fixed certificate to tls.Config.GetCertificate
+func StaticCertificate(cert *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}
+}
+
+// RedirectHandler sends every plain HTTP request to the same host and path over HTTPS on httpsAddr's port.
+// A permanent redirect that keeps the method is used so that API clients replay their POSTs.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// MiddlewareHSTS sets the Strict-Transport-Security header on responses served over TLS, telling browsers
+// to only use HTTPS for the next maxAge. A zero maxAge leaves responses untouched.
+func MiddlewareHSTS(maxAge time.Duration) func(http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds())) + "; includeSubDomains"
+
+	return func(next http.Handler) http.Handler {
+		if maxAge <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
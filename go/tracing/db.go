@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DBTX is the connection used by the queries sqlc generates, which is satisfied by *sql.DB and *sql.Tx
+type DBTX interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// tracedDB wraps the connection used by the sqlc queries so that every query gets its own client span
+type tracedDB struct {
+	db     DBTX
+	tracer trace.Tracer
+}
+
+// WrapDB returns a DBTX that starts a span for every statement run through the PostgreSQL connection db.
+// Spans are named after the sqlc query (e.g. "GetFeeds") so they line up with the generated methods.
+func WrapDB(db DBTX) DBTX {
+	return &tracedDB{db: db, tracer: otel.Tracer(tracerName)}
+}
+
+func (t *tracedDB) start(ctx context.Context, query string) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, queryName(query), trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBStatement(query),
+	))
+}
+
+// ExecContext runs a statement that returns no rows
+func (t *tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := t.start(ctx, query)
+	defer span.End()
+
+	res, err := t.db.ExecContext(ctx, query, args...)
+	recordError(span, err)
+	return res, err
+}
+
+// PrepareContext prepares a statement for later use
+func (t *tracedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, span := t.start(ctx, query)
+	defer span.End()
+
+	stmt, err := t.db.PrepareContext(ctx, query)
+	recordError(span, err)
+	return stmt, err
+}
+
+// QueryContext runs a query that returns rows. The span covers the query itself, not the reading of
+// the rows by the caller.
+func (t *tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := t.start(ctx, query)
+	defer span.End()
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	recordError(span, err)
+	return rows, err
+}
+
+// QueryRowContext runs a query that returns at most one row; errors surface when the row is scanned
+func (t *tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := t.start(ctx, query)
+	defer span.End()
+
+	row := t.db.QueryRowContext(ctx, query, args...)
+	recordError(span, row.Err())
+	return row
+}
+
+// queryName extracts the sqlc query name from the "-- name: GetFeeds :many" header of the statement
+func queryName(query string) string {
+	if rest, ok := strings.CutPrefix(query, "-- name: "); ok {
+		if fields := strings.Fields(rest); len(fields) > 0 {
+			return "database." + fields[0]
+		}
+	}
+
+	return "database.query"
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
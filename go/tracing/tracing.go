@@ -0,0 +1,132 @@
+// Package tracing sets up the OpenTelemetry tracing shared by chirpy and bloggy and provides the HTTP
+// middleware that starts a span for every request, along with a wrapper tracing SQL statements.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sebito91/bootdotdev/go/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans started by this package
+const tracerName = "github.com/sebito91/bootdotdev/go/tracing"
+
+// Setup installs the global tracer provider for the given service. The exporter is chosen by
+// OTEL_TRACES_EXPORTER:
+//   - none (default): spans are created but dropped
+//   - stdout: spans are written to stdout as JSON
+//   - file: spans are appended as JSON to OTEL_TRACES_FILE (default traces.json)
+//   - otlp: spans are sent over OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables
+//
+// The returned function flushes any buffered spans and must be called before the server exits.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+
+	switch kind := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")); kind {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = exp
+	case "file":
+		path := os.Getenv("OTEL_TRACES_FILE")
+		if path == "" {
+			path = "traces.json"
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open OTEL_TRACES_FILE: %s", err)
+		}
+
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return nil, err
+		}
+
+		exporter, closer = exp, f
+	case "otlp":
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("expected OTEL_TRACES_EXPORTER to be one of none, stdout, file or otlp, got %s", kind)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if cErr := closer.Close(); err == nil {
+				err = cErr
+			}
+		}
+
+		return err
+	}, nil
+}
+
+// Middleware starts a server span for every request, continuing any trace propagated by the caller. The
+// span is named after the chi route once the request has been routed.
+func Middleware(next http.Handler) http.Handler {
+	tracer := otel.Tracer(tracerName)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPTarget(r.URL.RequestURI()),
+			semconv.UserAgentOriginal(r.UserAgent()),
+			attribute.String("net.sock.peer.addr", r.RemoteAddr),
+		))
+		defer span.End()
+
+		rec := logging.NewResponseRecorder(w)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(rec, r)
+
+		if route := logging.RoutePattern(r); route != "unmatched" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+
+		status := rec.Status()
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}